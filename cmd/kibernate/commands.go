@@ -0,0 +1,312 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/kibernate/kibernate/internal/app/kibernate"
+	"io"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var commands = map[string]func(args []string) error{
+	"status":   runStatus,
+	"wake":     runWake,
+	"sleep":    runSleep,
+	"validate": runValidate,
+	"explain":  runExplain,
+}
+
+func adminFlags(name string) (*flag.FlagSet, *string, *string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	admin := flags.String("admin", os.Getenv("KIBERNATE_ADMIN_URL"), "The base URL of the kibernate admin server, e.g. http://localhost:9091 after kubectl port-forward [default: $KIBERNATE_ADMIN_URL]")
+	output := flags.String("output", "table", "The output format - table, json [default: table]")
+	return flags, admin, output
+}
+
+func runStatus(args []string) error {
+	flags, admin, output := adminFlags("status")
+	source := flags.String("source", "admin", "Where target states are read from - admin (the admin API), cluster (status of Kibernate resources, read with the current kubeconfig context or in-cluster credentials) [default: admin]")
+	namespace := flags.String("namespace", "*", "The namespace Kibernate resources are listed in with source cluster, * for all namespaces [default: *]")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	var statuses []kibernate.StatusResponse
+	switch *source {
+	case "admin":
+		statuses, err = getAdminStatuses(*admin)
+	case "cluster":
+		statuses, err = getClusterStatuses(*namespace)
+	default:
+		return errors.New("source must be admin or cluster")
+	}
+	if err != nil {
+		return err
+	}
+	return printStatuses(*output, statuses)
+}
+
+func runWake(args []string) error {
+	return runTargetAction("wake", args)
+}
+
+func runSleep(args []string) error {
+	return runTargetAction("sleep", args)
+}
+
+func runTargetAction(action string, args []string) error {
+	flags, admin, output := adminFlags(action)
+	token := flags.String("token", os.Getenv("KIBERNATE_ADMIN_TOKEN"), "The bearer token of the admin server [default: $KIBERNATE_ADMIN_TOKEN]")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kibernate %s [flags] [target]\n\nThe target is a target key, namespace/deployment or deployment name and may be omitted if there is only one.\n\n", action)
+		flags.PrintDefaults()
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return errors.New("at most one target may be given")
+	}
+	baseUrl, err := adminBaseUrl(*admin)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, baseUrl+"/"+action+"?target="+url.QueryEscape(flags.Arg(0)), nil)
+	if err != nil {
+		return err
+	}
+	if *token != "" {
+		request.Header.Set("Authorization", "Bearer "+*token)
+	}
+	client := &http.Client{Timeout: 5 * time.Minute}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("admin server answered %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	var status kibernate.StatusResponse
+	err = json.Unmarshal(body, &status)
+	if err != nil {
+		return err
+	}
+	return printStatuses(*output, []kibernate.StatusResponse{status})
+}
+
+func runValidate(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	config, err := parseConfig(flags, args)
+	if err != nil {
+		return err
+	}
+	findings := kibernate.LintConfig(config)
+	errorCount := 0
+	for _, finding := range findings {
+		if finding.Severity == kibernate.LintSeverityError {
+			errorCount++
+		}
+		fmt.Printf("%s: %s\n", finding.Severity, finding.Message)
+	}
+	if errorCount > 0 {
+		return fmt.Errorf("configuration has %d errors", errorCount)
+	}
+	fmt.Printf("Configuration is valid (%d warnings)\n", len(findings))
+	return nil
+}
+
+func runExplain(args []string) error {
+	flags := flag.NewFlagSet("explain", flag.ExitOnError)
+	path := flags.String("path", "/", "The path of the request to explain [default: /]")
+	userAgent := flags.String("ua", "", "The User-Agent header of the request to explain [default: none]")
+	method := flags.String("method", http.MethodGet, "The method of the request to explain [default: GET]")
+	host := flags.String("host", "", "The Host header of the request to explain [default: none]")
+	headers := flags.String("headers", "", "A |-separated list of Name: Value headers of the request to explain [default: none]")
+	remoteAddr := flags.String("remoteAddr", "127.0.0.1:12345", "The remote address of the request to explain [default: 127.0.0.1:12345]")
+	status := flags.String("status", string(kibernate.DeploymenStatusDeactivated), "The deployment status the request is explained for - ready, possiblyReady, activating, deactivating, deactivated [default: deactivated]")
+	output := flags.String("output", "text", "The output format - text, json [default: text]")
+	config, err := parseConfig(flags, args)
+	if err != nil {
+		return err
+	}
+	if !kibernate.IsValidDeploymentStatus(kibernate.DeploymentStatus(*status)) {
+		return fmt.Errorf("invalid status '%s'", *status)
+	}
+	requestUrl, err := url.ParseRequestURI(*path)
+	if err != nil {
+		return fmt.Errorf("invalid path: %s", err.Error())
+	}
+	request := &http.Request{Method: *method, URL: requestUrl, Host: *host, RemoteAddr: *remoteAddr, Header: http.Header{}}
+	if *userAgent != "" {
+		request.Header.Set("User-Agent", *userAgent)
+	}
+	if *headers != "" {
+		for _, header := range strings.Split(*headers, "|") {
+			nameValue := strings.SplitN(header, ":", 2)
+			if len(nameValue) != 2 || strings.TrimSpace(nameValue[0]) == "" {
+				return errors.New("headers must be in the format Name: Value|Name: Value")
+			}
+			request.Header.Add(strings.TrimSpace(nameValue[0]), strings.TrimSpace(nameValue[1]))
+		}
+	}
+	explanation := kibernate.Explain(config, request, kibernate.DeploymentStatus(*status))
+	if *output == "json" {
+		return json.NewEncoder(os.Stdout).Encode(explanation)
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(writer, "Request:\t%s %s (User-Agent: %q)\n", explanation.Method, explanation.Path, explanation.UserAgent)
+	fmt.Fprintf(writer, "Deployment status:\t%s\n", explanation.Status)
+	if explanation.UptimeMonitor != "" {
+		fmt.Fprintf(writer, "Uptime monitor rule:\t%s\n", explanation.UptimeMonitor)
+	} else {
+		fmt.Fprintf(writer, "Uptime monitor rule:\tnone\n")
+		fmt.Fprintf(writer, "Activity:\t%t (%s)\n", explanation.Activity, explanation.ActivityRule)
+		if explanation.WaitType != "" {
+			fmt.Fprintf(writer, "Wait type:\t%s (%s)\n", explanation.WaitType, explanation.WaitTypeRule)
+		}
+	}
+	for _, ruleError := range explanation.RuleErrors {
+		fmt.Fprintf(writer, "Rule error:\t%s\n", ruleError)
+	}
+	fmt.Fprintf(writer, "Outcome:\t%s\n", explanation.Outcome)
+	return writer.Flush()
+}
+
+func adminBaseUrl(admin string) (string, error) {
+	if admin == "" {
+		return "", errors.New("the admin server URL must be set with -admin or $KIBERNATE_ADMIN_URL")
+	}
+	return strings.TrimSuffix(admin, "/"), nil
+}
+
+func getAdminStatuses(admin string) ([]kibernate.StatusResponse, error) {
+	baseUrl, err := adminBaseUrl(admin)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	response, err := client.Get(baseUrl + "/status")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("admin server answered %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	var statuses []kibernate.StatusResponse
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		err = json.Unmarshal(body, &statuses)
+		return statuses, err
+	}
+	var status kibernate.StatusResponse
+	err = json.Unmarshal(body, &status)
+	return []kibernate.StatusResponse{status}, err
+}
+
+func getClusterStatuses(namespace string) ([]kibernate.StatusResponse, error) {
+	if namespace == "*" {
+		namespace = metav1.NamespaceAll
+	}
+	restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{}).ClientConfig()
+	if clientcmd.IsEmptyConfig(err) {
+		restConfig, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	list, err := dynamicClient.Resource(kibernate.KibernateGroupVersionResource).Namespace(namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var statuses []kibernate.StatusResponse
+	for i := range list.Items {
+		object, err := kibernate.KibernateObjectFromUnstructured(&list.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		status := kibernate.StatusResponse{
+			Key:        object.Key(),
+			Namespace:  object.Namespace,
+			Deployment: object.Spec.TargetRef.Name,
+			Status:     object.Status.DeploymentStatus,
+		}
+		if object.Status.LastActivity != nil {
+			status.LastActivity = object.Status.LastActivity.Time
+		}
+		for _, route := range object.Routes() {
+			status.Routes = append(status.Routes, route.String())
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func printStatuses(output string, statuses []kibernate.StatusResponse) error {
+	if output == "json" {
+		return json.NewEncoder(os.Stdout).Encode(statuses)
+	}
+	if output != "table" {
+		return errors.New("output must be table or json")
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "TARGET\tSTATUS\tLAST ACTIVITY\tIN FLIGHT\tROUTES")
+	for _, status := range statuses {
+		target := status.Key
+		if target == "" {
+			target = status.Namespace + "/" + status.Deployment
+		}
+		lastActivity := "never"
+		if !status.LastActivity.IsZero() {
+			lastActivity = time.Since(status.LastActivity).Truncate(time.Second).String() + " ago"
+		}
+		routes := strings.Join(status.Routes, ",")
+		if routes == "" {
+			routes = "-"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%s\n", target, status.Status, lastActivity, status.InFlightRequests, routes)
+	}
+	return writer.Flush()
+}
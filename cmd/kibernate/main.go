@@ -17,130 +17,451 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/kibernate/kibernate/internal/app/kibernate"
-	"log"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
 	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
 )
 
 func main() {
-	namespace := flag.String("namespace", "default", "The namespace of the service and deployment [default: default]")
-	service := flag.String("service", "", "The name of the service to be proxied")
-	deployment := flag.String("deployment", "", "The name of the deployment to be activated/deactivated")
-	servicePort := flag.Uint("servicePort", 8080, "The port of the service to be proxied [default: 8080]")
-	idleTimeoutSecs := flag.Uint("idleTimeoutSecs", 600, "The number of seconds to wait for activity before deactivating the deployment [default: 600]")
-	defaultWaitType := flag.String("defaultWaitType", "connect", "The type of wait to perform by default - connect, loading, none [default: connect]")
-	activityPathMatch := flag.String("activityPathMatch", ".*", "A regular expression to match paths that should be considered activity [default: \".*\"]")
-	activityPathExclude := flag.String("activityPathExclude", "", "A regular expression to exclude paths that should not be considered activity")
-	activityUserAgentMatch := flag.String("activityUserAgentMatch", ".*", "A regular expression to match User-Agent headers that should be considered activity [default: \".*\"]")
-	activityUserAgentExclude := flag.String("activityUserAgentExclude", "", "A regular expression to exclude User-Agent headers that should not be considered activity")
-	waitNonePathMatch := flag.String("waitNonePathMatch", "", "A regular expression to match paths that should not wait for deployment readiness")
-	waitNonePathExclude := flag.String("waitNonePathExclude", "", "A regular expression to exclude paths that should not wait for deployment readiness")
-	waitConnectPathMatch := flag.String("waitConnectPathMatch", "", "A regular expression to match paths that should wait for deployment readiness")
-	waitConnectPathExclude := flag.String("waitConnectPathExclude", "", "A regular expression to exclude paths that should not wait for deployment readiness")
-	waitLoadingPathMatch := flag.String("waitLoadingPathMatch", "", "A regular expression to match paths that should deliver a loading page while waiting for the deployment to be ready")
-	waitLoadingPathExclude := flag.String("waitLoadingPathExclude", "", "A regular expression to exclude paths that should not deliver a loading page while waiting for the deployment to be ready")
-	uptimeMonitorUserAgentMatch := flag.String("uptimeMonitorUserAgentMatch", "", "A regular expression to match User-Agent headers that should be considered uptime monitoring requests")
-	uptimeMonitorUserAgentExclude := flag.String("uptimeMonitorUserAgentExclude", "", "A regular expression to exclude User-Agent headers that should not be considered uptime monitoring requests")
-	uptimeMonitorResponseCode := flag.Uint("uptimeMonitorResponseCode", 200, "The HTTP response code to return for uptime monitoring requests [default: 200]")
-	uptimeMonitorResponseMessage := flag.String("uptimeMonitorResponseMessage", "OK", "The HTTP response message to return for uptime monitoring requests [default: OK]")
-	noDeactivationMoFrFromToUTC := flag.String("noDeactivationMoFrFromToUTC", "", "A from-to UTC time range in the format HH:MM-HH:MM that should not be considered for deactivation on Monday through Friday [default: none]")
-	noDeactivationSatFromToUTC := flag.String("noDeactivationSatFromToUTC", "", "A from-to UTC time range in the format HH:MM-HH:MM that should not be considered for deactivation on Saturday [default: none]")
-	noDeactivationSunFromToUTC := flag.String("noDeactivationSunFromToUTC", "", "A from-to UTC time range in the format HH:MM-HH:MM that should not be considered for deactivation on Sunday [default: none]")
-	readinessProbePath := flag.String("readinessProbePath", "", "The path of the readiness probe [default: none]")
-	readinessTimeoutSecs := flag.Uint("readinessTimeoutSecs", 30, "The number of seconds to wait for the readiness probe to return a 200 response before proxying requests anyway [default: 30]")
-	noDeactivationAutostart := flag.Bool("noDeactivationAutostart", false, "If true, the deployment will autostart at the beginning of a configured no-deactivation time range [default: false]")
-	flag.Parse()
-	if *service == "" || *deployment == "" {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			err := command(os.Args[2:])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err.Error())
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	runProxy(os.Args[1:])
+}
+
+func runProxy(args []string) {
+	kibernateConfig, err := parseConfig(flag.NewFlagSet("kibernate", flag.ExitOnError), args)
+	if err != nil {
+		panic(err.Error())
+	}
+	logger, err := kibernate.NewLogger(kibernateConfig.LogLevel, kibernateConfig.LogFormat, os.Stderr)
+	if err != nil {
+		panic(err.Error())
+	}
+	slog.SetDefault(logger)
+	if kibernateConfig.Mode == kibernate.ModeSingle && (kibernateConfig.Service == "" || kibernateConfig.Deployment == "") {
 		panic("service and deployment must be set")
 	}
-	if *defaultWaitType != "connect" && *defaultWaitType != "loading" && *defaultWaitType != "none" {
-		panic("defaultWaitType must be connect, loading, or none")
+	kibernateInstance := kibernate.NewKibernate(kibernateConfig)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	err = kibernateInstance.Run(ctx)
+	if err != nil {
+		slog.Error("Error running kibernate", "error", err)
+		os.Exit(1)
+	}
+}
+
+func parseConfig(flags *flag.FlagSet, args []string) (kibernate.Config, error) {
+	mode := flags.String("mode", "single", "How targets are configured - single (flags), crd (Kibernate custom resources), annotations (annotated workloads), ingress (default backend for annotated ingresses), gateway (annotated Gateway API HTTP routes) [default: single]")
+	watchNamespaces := flags.String("watchNamespaces", "", "A comma-separated list of namespaces watched for targets in crd, annotations, ingress and gateway mode, * for all namespaces [default: namespace]")
+	annotatedKind := flags.String("annotatedKind", "deployment", "The kind of objects carrying kibernate.io annotations in annotations mode - deployment, service [default: deployment]")
+	resourceName := flags.String("resourceName", "", "The name of the only Kibernate resource served in crd mode, used by generated dedicated proxies [default: all]")
+	proxyImage := flags.String("proxyImage", "ghcr.io/kibernate/kibernate:latest", "The image of dedicated proxy deployments generated in crd mode [default: ghcr.io/kibernate/kibernate:latest]")
+	gatewayApiVersion := flags.String("gatewayApiVersion", "v1", "The version of the gateway.networking.k8s.io API HTTP routes are read from in gateway mode [default: v1]")
+	gatewayRewriteBackendRefs := flags.Bool("gatewayRewriteBackendRefs", false, "If true, backend refs of HTTP routes point to kibernate while their target is not ready and back to the target once it is, cross-namespace routes need a ReferenceGrant [default: false]")
+	gatewayService := flags.String("gatewayService", "kibernate", "The name of the kibernate service in namespace that rewritten backend refs point to [default: kibernate]")
+	gatewayServicePort := flags.Uint("gatewayServicePort", 8080, "The port of the kibernate service that rewritten backend refs point to [default: 8080]")
+	activityMetricsUrl := flags.String("activityMetricsUrl", "", "The URL of Prometheus metrics counting requests per service, e.g. of the ingress controller or gateway, awake targets are only deactivated for being idle in ingress mode and with gatewayRewriteBackendRefs if set [default: none]")
+	activityMetricsName := flags.String("activityMetricsName", "nginx_ingress_controller_requests", "The name of the request counter in activityMetricsUrl [default: nginx_ingress_controller_requests]")
+	activityMetricsNamespaceLabel := flags.String("activityMetricsNamespaceLabel", "namespace", "The label of activityMetricsName holding the namespace of the service [default: namespace]")
+	activityMetricsServiceLabel := flags.String("activityMetricsServiceLabel", "service", "The label of activityMetricsName holding the name of the service [default: service]")
+	configFile := flags.String("configFile", "", "The path of a YAML config file with rule lists such as uptimeMonitorRules, activityRules, waitTypeRules and waitTypeHandlers [default: none]")
+	namespace := flags.String("namespace", "default", "The namespace of the service and deployment [default: default]")
+	service := flags.String("service", "", "The name of the service to be proxied")
+	deployment := flags.String("deployment", "", "The name of the deployment to be activated/deactivated")
+	servicePort := flags.Uint("servicePort", 8080, "The port of the service to be proxied [default: 8080]")
+	idleTimeoutSecs := flags.Uint("idleTimeoutSecs", 600, "The number of seconds to wait for activity before deactivating the deployment [default: 600]")
+	defaultWaitType := flags.String("defaultWaitType", "connect", "The type of wait to perform by default - connect, loading, none, redirect, api [default: connect]")
+	activityPathMatch := flags.String("activityPathMatch", ".*", "A regular expression to match paths that should be considered activity [default: \".*\"]")
+	activityPathExclude := flags.String("activityPathExclude", "", "A regular expression to exclude paths that should not be considered activity")
+	activityUserAgentMatch := flags.String("activityUserAgentMatch", ".*", "A regular expression to match User-Agent headers that should be considered activity [default: \".*\"]")
+	activityUserAgentExclude := flags.String("activityUserAgentExclude", "", "A regular expression to exclude User-Agent headers that should not be considered activity")
+	trustedProxyCidrs := flags.String("trustedProxyCidrs", "", "A comma-separated list of CIDRs of trusted proxies whose X-Forwarded-For entries are used to determine the client IP [default: none]")
+	waitNonePathMatch := flags.String("waitNonePathMatch", "", "A regular expression to match paths that should not wait for deployment readiness")
+	waitNonePathExclude := flags.String("waitNonePathExclude", "", "A regular expression to exclude paths that should not wait for deployment readiness")
+	waitConnectPathMatch := flags.String("waitConnectPathMatch", "", "A regular expression to match paths that should wait for deployment readiness")
+	waitConnectPathExclude := flags.String("waitConnectPathExclude", "", "A regular expression to exclude paths that should not wait for deployment readiness")
+	waitLoadingPathMatch := flags.String("waitLoadingPathMatch", "", "A regular expression to match paths that should deliver a loading page while waiting for the deployment to be ready")
+	waitLoadingPathExclude := flags.String("waitLoadingPathExclude", "", "A regular expression to exclude paths that should not deliver a loading page while waiting for the deployment to be ready")
+	redirectUrl := flags.String("redirectUrl", "", "The absolute URL to redirect to with wait type redirect, e.g. a status page [default: none]")
+	redirectQueryParameter := flags.String("redirectQueryParameter", "url", "The name of the query parameter carrying the original URL with wait type redirect, empty to omit it [default: url]")
+	redirectStatusCode := flags.Uint("redirectStatusCode", 302, "The HTTP status code of redirects with wait type redirect [default: 302]")
+	loadingConfigMap := flags.String("loadingConfigMap", "kibernate-loading-html", "The name of the config map containing the loading page, the embedded default page is used if it does not exist [default: kibernate-loading-html]")
+	loadingConfigMapKey := flags.String("loadingConfigMapKey", "loading.html", "The key of the loading page in loadingConfigMap, localized variants use keys like loading.de.html [default: loading.html]")
+	loadingFile := flags.String("loadingFile", "", "The path of a file containing the loading page, takes precedence over loadingConfigMap [default: none]")
+	loadingInline := flags.String("loadingInline", "", "The loading page template itself, takes precedence over loadingFile and loadingConfigMap [default: none]")
+	loadingTemplates := flags.Bool("loadingTemplates", false, "If true, loading pages from loadingFile and loadingConfigMap are rendered as html/template templates, otherwise they are served as they are [default: false]")
+	apiStatusCode := flags.Uint("apiStatusCode", 503, "The HTTP status code returned with wait type api - 202, 429, 503 [default: 503]")
+	apiRetryAfterDefaultSecs := flags.Uint("apiRetryAfterDefaultSecs", 30, "The Retry-After seconds returned with wait type api and with JSON and plain text loading responses until a cold start duration has been observed [default: 30]")
+	uptimeMonitorUserAgentMatch := flags.String("uptimeMonitorUserAgentMatch", "", "A regular expression to match User-Agent headers that should be considered uptime monitoring requests")
+	uptimeMonitorUserAgentExclude := flags.String("uptimeMonitorUserAgentExclude", "", "A regular expression to exclude User-Agent headers that should not be considered uptime monitoring requests")
+	uptimeMonitorResponseCode := flags.Uint("uptimeMonitorResponseCode", 200, "The HTTP response code to return for uptime monitoring requests [default: 200]")
+	uptimeMonitorResponseMessage := flags.String("uptimeMonitorResponseMessage", "OK", "The HTTP response message to return for uptime monitoring requests [default: OK]")
+	noDeactivationMoFrFromToUTC := flags.String("noDeactivationMoFrFromToUTC", "", "A from-to UTC time range in the format HH:MM-HH:MM that should not be considered for deactivation on Monday through Friday [default: none]")
+	noDeactivationSatFromToUTC := flags.String("noDeactivationSatFromToUTC", "", "A from-to UTC time range in the format HH:MM-HH:MM that should not be considered for deactivation on Saturday [default: none]")
+	noDeactivationSunFromToUTC := flags.String("noDeactivationSunFromToUTC", "", "A from-to UTC time range in the format HH:MM-HH:MM that should not be considered for deactivation on Sunday [default: none]")
+	readinessProbePath := flags.String("readinessProbePath", "", "The path of the readiness probe [default: none]")
+	readinessTimeoutSecs := flags.Uint("readinessTimeoutSecs", 30, "The number of seconds to wait for the readiness probe to succeed before proxying requests anyway [default: 30]")
+	readinessProbeType := flags.String("readinessProbeType", "http", "The type of the readiness probe - http, tcp, grpc [default: http]")
+	readinessProbeMethod := flags.String("readinessProbeMethod", "GET", "The HTTP method of the readiness probe [default: GET]")
+	readinessProbeHeaders := flags.String("readinessProbeHeaders", "", "A |-separated list of Name: Value headers to send with the readiness probe [default: none]")
+	readinessProbeHost := flags.String("readinessProbeHost", "", "The Host header to send with the readiness probe [default: Host of the last proxied request]")
+	readinessProbeStatusCodes := flags.String("readinessProbeStatusCodes", "200", "A comma-separated list of status codes or from-to status code ranges the readiness probe accepts - e.g. 200-299,304 [default: 200]")
+	readinessProbeBodyMatch := flags.String("readinessProbeBodyMatch", "", "A regular expression the readiness probe response body must match [default: none]")
+	readinessProbeJsonPath := flags.String("readinessProbeJsonPath", "", "A JSON path expression evaluated against the readiness probe response body - e.g. {.status} [default: none]")
+	readinessProbeJsonMatch := flags.String("readinessProbeJsonMatch", "", "A regular expression the result of readinessProbeJsonPath must match [default: non-empty result]")
+	readinessProbeGrpcService := flags.String("readinessProbeGrpcService", "", "The service name to check with the gRPC health check readiness probe [default: server health]")
+	readinessProbeSuccessThreshold := flags.Uint("readinessProbeSuccessThreshold", 1, "The number of consecutive successful readiness probe attempts required to consider the deployment ready [default: 1]")
+	readinessProbeFailureThreshold := flags.Uint("readinessProbeFailureThreshold", 0, "The number of consecutive failed readiness probe attempts after which the deployment is kept not ready until its next status change, 0 to probe until readinessTimeoutSecs [default: 0]")
+	readinessEndpointSlices := flags.Bool("readinessEndpointSlices", false, "If true, the deployment is only considered ready once the service has at least one ready endpoint on the service port [default: false]")
+	dependencies := flags.String("dependencies", "", "A comma-separated list of kind/name workloads (deployment or statefulset) the deployment depends on, in activation order - e.g. statefulset/redis,deployment/worker [default: none]")
+	dependencyTimeoutSecs := flags.Uint("dependencyTimeoutSecs", 120, "The number of seconds to wait for a dependency to become ready or deactivated before continuing with the next one anyway [default: 120]")
+	webhookUrls := flags.String("webhookUrls", "", "A comma-separated list of URLs to POST lifecycle events to [default: none]")
+	webhookFormat := flags.String("webhookFormat", "json", "The payload format of lifecycle webhooks - json, cloudevents, slack [default: json]")
+	webhookSecret := flags.String("webhookSecret", os.Getenv("KIBERNATE_WEBHOOK_SECRET"), "The secret used to sign lifecycle webhooks with HMAC-SHA256 [default: $KIBERNATE_WEBHOOK_SECRET]")
+	webhookMaxRetries := flags.Uint("webhookMaxRetries", 3, "The number of retries with exponential back-off for failed lifecycle webhook deliveries [default: 3]")
+	webhookTimeoutSecs := flags.Uint("webhookTimeoutSecs", 10, "The timeout in seconds of a single lifecycle webhook delivery [default: 10]")
+	webhookDeadLetterFile := flags.String("webhookDeadLetterFile", "", "The path of a file undeliverable lifecycle webhooks are appended to as JSON lines [default: log]")
+	logLevel := flags.String("logLevel", "info", "The minimum level of log messages - debug, info, warn, error [default: info]")
+	logFormat := flags.String("logFormat", "text", "The format of log messages - text, json [default: text]")
+	accessLogFormat := flags.String("accessLogFormat", "", "The format of the access log - json, combined, empty to disable [default: disabled]")
+	accessLogFile := flags.String("accessLogFile", "", "The path of a file the access log is appended to [default: stdout]")
+	tracingOtlpEndpoint := flags.String("tracingOtlpEndpoint", "", "The host:port of an OTLP/HTTP endpoint traces are exported to, empty to disable [default: disabled]")
+	tracingOtlpInsecure := flags.Bool("tracingOtlpInsecure", false, "If true, traces are exported via plain HTTP instead of HTTPS [default: false]")
+	tracingSampleRatio := flags.Float64("tracingSampleRatio", 1, "The ratio of traces sampled if the incoming request carries no sampling decision [default: 1]")
+	prewarm := flags.Bool("prewarm", false, "If true, the deployment is activated ahead of weekday/hour slots that historically saw traffic [default: false]")
+	prewarmConfigMap := flags.String("prewarmConfigMap", "", "The name of the config map the activity histogram is persisted in [default: kibernate-prewarm-<deployment>]")
+	prewarmLeadSecs := flags.Uint("prewarmLeadSecs", 300, "How many seconds ahead of a likely busy hour the deployment is pre-warmed [default: 300]")
+	prewarmConfidence := flags.Float64("prewarmConfidence", 0.6, "The minimum share of observed days with traffic in an hour required to pre-warm for it [default: 0.6]")
+	prewarmMaxPerDay := flags.Uint("prewarmMaxPerDay", 2, "The maximum number of speculative pre-warm activations per day [default: 2]")
+	minUptimeSecs := flags.Uint("minUptimeSecs", 0, "The minimum number of seconds the deployment stays activated after each activation [default: 0]")
+	idleBackoffWindowSecs := flags.Uint("idleBackoffWindowSecs", 0, "Activations within this many seconds after a deactivation double the idle timeout, 0 to disable [default: 0]")
+	idleBackoffMaxSecs := flags.Uint("idleBackoffMaxSecs", 3600, "The maximum idle timeout in seconds the back-off may lengthen it to [default: 3600]")
+	maxDeactivationsPerHour := flags.Uint("maxDeactivationsPerHour", 0, "The maximum number of deactivations within any hour, 0 for unlimited [default: 0]")
+	shutdownTimeoutSecs := flags.Uint("shutdownTimeoutSecs", 25, "The number of seconds active proxied requests may take to finish on SIGTERM [default: 25]")
+	shutdownWaitType := flags.String("shutdownWaitType", "api", "The wait type answering requests still waiting for activation on shutdown - loading, none, redirect, api [default: api]")
+	drainTimeoutSecs := flags.Uint("drainTimeoutSecs", 0, "If greater than 0, new requests are held back for up to this many seconds before deactivation while in-flight requests finish [default: 0]")
+	hpaMode := flags.String("hpaMode", "annotate", "How a horizontal pod autoscaler targeting the deployment is handled on deactivation - annotate, patch (sets minReplicas to 0) [default: annotate]")
+	scalingMode := flags.String("scalingMode", "direct", "How the deployment is scaled - direct (kibernate updates the scale), keda (kibernate acts as a KEDA external push scaler) [default: direct]")
+	kedaPort := flags.Uint("kedaPort", 9090, "The port of the KEDA external scaler gRPC server in keda scaling mode [default: 9090]")
+	dryRun := flags.Bool("dryRun", false, "If true, activation and deactivation decisions are only recorded in logs, metrics and the status API, the deployment is never scaled and requests are always proxied [default: false]")
+	adminPort := flags.Uint("adminPort", 0, "The port of the admin server providing the status API, 0 to disable [default: 0]")
+	adminToken := flags.String("adminToken", os.Getenv("KIBERNATE_ADMIN_TOKEN"), "The bearer token required by the wake and sleep admin endpoints, empty to disable them [default: $KIBERNATE_ADMIN_TOKEN]")
+	noDeactivationAutostart := flags.Bool("noDeactivationAutostart", false, "If true, the deployment will autostart at the beginning of a configured no-deactivation time range [default: false]")
+	flags.StringVar(configFile, "config", "", "An alias of configFile")
+	err := flags.Parse(args)
+	if err != nil {
+		return kibernate.Config{}, err
+	}
+	_, err = kibernate.NewLogger(*logLevel, kibernate.LogFormat(*logFormat), io.Discard)
+	if err != nil {
+		return kibernate.Config{}, err
+	}
+	if *mode != "single" && *mode != "crd" && *mode != "annotations" && *mode != "ingress" && *mode != "gateway" {
+		return kibernate.Config{}, errors.New("mode must be single, crd, annotations, ingress, or gateway")
+	}
+	if *activityMetricsUrl != "" && *mode != "ingress" && !(*mode == "gateway" && *gatewayRewriteBackendRefs) {
+		return kibernate.Config{}, errors.New("activityMetricsUrl is only supported in ingress mode and in gateway mode with gatewayRewriteBackendRefs")
+	}
+	if *annotatedKind != "deployment" && *annotatedKind != "service" {
+		return kibernate.Config{}, errors.New("annotatedKind must be deployment or service")
+	}
+	if *mode != "single" && *scalingMode == "keda" {
+		return kibernate.Config{}, kibernate.ErrKedaRequiresSingleMode
+	}
+	if *defaultWaitType != "connect" && *defaultWaitType != "loading" && *defaultWaitType != "none" && *defaultWaitType != "redirect" && *defaultWaitType != "api" {
+		return kibernate.Config{}, errors.New("defaultWaitType must be connect, loading, none, redirect, or api")
+	}
+	if *defaultWaitType == "redirect" && *redirectUrl == "" {
+		return kibernate.Config{}, errors.New("redirectUrl must be set for defaultWaitType redirect")
+	}
+	if *redirectStatusCode < 300 || *redirectStatusCode > 399 {
+		return kibernate.Config{}, errors.New("redirectStatusCode must be a 3xx status code")
+	}
+	if *webhookFormat != "json" && *webhookFormat != "cloudevents" && *webhookFormat != "slack" {
+		return kibernate.Config{}, errors.New("webhookFormat must be json, cloudevents, or slack")
+	}
+	if *apiStatusCode != 202 && *apiStatusCode != 429 && *apiStatusCode != 503 {
+		return kibernate.Config{}, errors.New("apiStatusCode must be 202, 429, or 503")
+	}
+	if *readinessProbeType != "http" && *readinessProbeType != "tcp" && *readinessProbeType != "grpc" {
+		return kibernate.Config{}, errors.New("readinessProbeType must be http, tcp, or grpc")
+	}
+	if *tracingSampleRatio < 0 || *tracingSampleRatio > 1 {
+		return kibernate.Config{}, errors.New("tracingSampleRatio must be between 0 and 1")
+	}
+	if *prewarmConfidence <= 0 || *prewarmConfidence > 1 {
+		return kibernate.Config{}, errors.New("prewarmConfidence must be greater than 0 and at most 1")
+	}
+	if *shutdownWaitType != "loading" && *shutdownWaitType != "none" && *shutdownWaitType != "redirect" && *shutdownWaitType != "api" {
+		return kibernate.Config{}, errors.New("shutdownWaitType must be loading, none, redirect, or api")
+	}
+	if *hpaMode != "annotate" && *hpaMode != "patch" {
+		return kibernate.Config{}, errors.New("hpaMode must be annotate or patch")
+	}
+	if *dryRun && *scalingMode == "keda" {
+		return kibernate.Config{}, errors.New("dryRun is not supported with scalingMode keda")
+	}
+	if *scalingMode != "direct" && *scalingMode != "keda" {
+		return kibernate.Config{}, errors.New("scalingMode must be direct or keda")
+	}
+	if *accessLogFormat != "" && *accessLogFormat != "json" && *accessLogFormat != "combined" {
+		return kibernate.Config{}, errors.New("accessLogFormat must be json or combined")
 	}
 	kibernateConfig := kibernate.Config{
-		Namespace:                    *namespace,
-		Service:                      *service,
-		Deployment:                   *deployment,
-		ServicePort:                  uint16(*servicePort),
-		IdleTimeoutSecs:              uint16(*idleTimeoutSecs),
-		DefaultWaitType:              kibernate.WaitType(*defaultWaitType),
-		ListenPort:                   8080,
-		UptimeMonitorResponseCode:    uint16(*uptimeMonitorResponseCode),
-		UptimeMonitorResponseMessage: *uptimeMonitorResponseMessage,
-		ReadinessTimeoutSecs:         uint16(*readinessTimeoutSecs),
-		ReadinessProbePath:           *readinessProbePath,
-		NoDeactivationAutostart:      *noDeactivationAutostart,
+		Mode:                           kibernate.Mode(*mode),
+		ResourceName:                   *resourceName,
+		ProxyImage:                     *proxyImage,
+		AnnotatedKind:                  kibernate.AnnotatedKind(*annotatedKind),
+		GatewayApiVersion:              *gatewayApiVersion,
+		GatewayRewriteBackendRefs:      *gatewayRewriteBackendRefs,
+		GatewayService:                 *gatewayService,
+		GatewayServicePort:             uint16(*gatewayServicePort),
+		ActivityMetricsUrl:             *activityMetricsUrl,
+		ActivityMetricsName:            *activityMetricsName,
+		ActivityMetricsNamespaceLabel:  *activityMetricsNamespaceLabel,
+		ActivityMetricsServiceLabel:    *activityMetricsServiceLabel,
+		Namespace:                      *namespace,
+		Service:                        *service,
+		Deployment:                     *deployment,
+		ServicePort:                    uint16(*servicePort),
+		IdleTimeoutSecs:                uint16(*idleTimeoutSecs),
+		MinUptimeSecs:                  uint16(*minUptimeSecs),
+		IdleBackoffWindowSecs:          uint16(*idleBackoffWindowSecs),
+		IdleBackoffMaxSecs:             uint16(*idleBackoffMaxSecs),
+		MaxDeactivationsPerHour:        uint16(*maxDeactivationsPerHour),
+		DrainTimeoutSecs:               uint16(*drainTimeoutSecs),
+		HpaMode:                        kibernate.HpaMode(*hpaMode),
+		ScalingMode:                    kibernate.ScalingMode(*scalingMode),
+		KedaListenPort:                 uint16(*kedaPort),
+		DryRun:                         *dryRun,
+		DefaultWaitType:                kibernate.WaitType(*defaultWaitType),
+		ListenPort:                     8080,
+		RedirectUrl:                    *redirectUrl,
+		RedirectQueryParameter:         *redirectQueryParameter,
+		RedirectStatusCode:             uint16(*redirectStatusCode),
+		LoadingConfigMap:               *loadingConfigMap,
+		LoadingConfigMapKey:            *loadingConfigMapKey,
+		LoadingFile:                    *loadingFile,
+		LoadingInline:                  *loadingInline,
+		LoadingTemplates:               *loadingTemplates,
+		ApiStatusCode:                  uint16(*apiStatusCode),
+		ApiRetryAfterDefaultSecs:       uint16(*apiRetryAfterDefaultSecs),
+		UptimeMonitorResponseCode:      uint16(*uptimeMonitorResponseCode),
+		UptimeMonitorResponseMessage:   *uptimeMonitorResponseMessage,
+		ReadinessTimeoutSecs:           uint16(*readinessTimeoutSecs),
+		ReadinessProbePath:             *readinessProbePath,
+		ReadinessEndpointSlices:        *readinessEndpointSlices,
+		ReadinessProbeType:             kibernate.ReadinessProbeType(*readinessProbeType),
+		ReadinessProbeMethod:           *readinessProbeMethod,
+		ReadinessProbeHost:             *readinessProbeHost,
+		ReadinessProbeJsonPath:         *readinessProbeJsonPath,
+		ReadinessProbeGrpcService:      *readinessProbeGrpcService,
+		ReadinessProbeSuccessThreshold: uint16(*readinessProbeSuccessThreshold),
+		ReadinessProbeFailureThreshold: uint16(*readinessProbeFailureThreshold),
+		WebhookFormat:                  kibernate.WebhookFormat(*webhookFormat),
+		WebhookSecret:                  *webhookSecret,
+		WebhookMaxRetries:              uint16(*webhookMaxRetries),
+		WebhookTimeoutSecs:             uint16(*webhookTimeoutSecs),
+		WebhookDeadLetterFile:          *webhookDeadLetterFile,
+		AdminListenPort:                uint16(*adminPort),
+		AdminToken:                     *adminToken,
+		ShutdownTimeoutSecs:            uint16(*shutdownTimeoutSecs),
+		ShutdownWaitType:               kibernate.WaitType(*shutdownWaitType),
+		LogLevel:                       *logLevel,
+		LogFormat:                      kibernate.LogFormat(*logFormat),
+		AccessLogFormat:                kibernate.AccessLogFormat(*accessLogFormat),
+		AccessLogFile:                  *accessLogFile,
+		TracingOtlpEndpoint:            *tracingOtlpEndpoint,
+		TracingOtlpInsecure:            *tracingOtlpInsecure,
+		TracingSampleRatio:             *tracingSampleRatio,
+		PrewarmEnabled:                 *prewarm,
+		PrewarmConfigMap:               *prewarmConfigMap,
+		PrewarmLeadSecs:                uint16(*prewarmLeadSecs),
+		PrewarmConfidence:              *prewarmConfidence,
+		PrewarmMaxPerDay:               uint16(*prewarmMaxPerDay),
+		NoDeactivationAutostart:        *noDeactivationAutostart,
+		DependencyTimeoutSecs:          uint16(*dependencyTimeoutSecs),
+	}
+	if *watchNamespaces != "" {
+		for _, watchNamespace := range strings.Split(*watchNamespaces, ",") {
+			kibernateConfig.WatchNamespaces = append(kibernateConfig.WatchNamespaces, strings.TrimSpace(watchNamespace))
+		}
 	}
 	if *activityPathMatch != "" {
-		kibernateConfig.ActivityPathMatch = regexp.MustCompile(*activityPathMatch)
+		kibernateConfig.ActivityPathMatch, err = compileFlagRegexp("activityPathMatch", *activityPathMatch)
+		if err != nil {
+			return kibernate.Config{}, err
+		}
 	}
 	if *activityPathExclude != "" {
-		kibernateConfig.ActivityPathExclude = regexp.MustCompile(*activityPathExclude)
+		kibernateConfig.ActivityPathExclude, err = compileFlagRegexp("activityPathExclude", *activityPathExclude)
+		if err != nil {
+			return kibernate.Config{}, err
+		}
 	}
 	if *activityUserAgentMatch != "" {
-		kibernateConfig.ActivityUserAgentMatch = regexp.MustCompile(*activityUserAgentMatch)
+		kibernateConfig.ActivityUserAgentMatch, err = compileFlagRegexp("activityUserAgentMatch", *activityUserAgentMatch)
+		if err != nil {
+			return kibernate.Config{}, err
+		}
 	}
 	if *activityUserAgentExclude != "" {
-		kibernateConfig.ActivityUserAgentExclude = regexp.MustCompile(*activityUserAgentExclude)
-	}
-	if *waitNonePathMatch != "" {
-		kibernateConfig.WaitNonePathMatch = regexp.MustCompile(*waitNonePathMatch)
-	}
-	if *waitNonePathExclude != "" {
-		kibernateConfig.WaitNonePathExclude = regexp.MustCompile(*waitNonePathExclude)
-	}
-	if *waitConnectPathMatch != "" {
-		kibernateConfig.WaitConnectPathMatch = regexp.MustCompile(*waitConnectPathMatch)
-	}
-	if *waitConnectPathExclude != "" {
-		kibernateConfig.WaitConnectPathExclude = regexp.MustCompile(*waitConnectPathExclude)
+		kibernateConfig.ActivityUserAgentExclude, err = compileFlagRegexp("activityUserAgentExclude", *activityUserAgentExclude)
+		if err != nil {
+			return kibernate.Config{}, err
+		}
 	}
-	if *waitLoadingPathMatch != "" {
-		kibernateConfig.WaitLoadingPathMatch = regexp.MustCompile(*waitLoadingPathMatch)
+	if *trustedProxyCidrs != "" {
+		cidrs, err := kibernate.ParseCidrs(strings.Split(*trustedProxyCidrs, ","))
+		if err != nil {
+			return kibernate.Config{}, errors.New("trustedProxyCidrs must be a comma-separated list of CIDRs")
+		}
+		kibernateConfig.TrustedProxyCidrs = cidrs
 	}
-	if *waitLoadingPathExclude != "" {
-		kibernateConfig.WaitLoadingPathExclude = regexp.MustCompile(*waitLoadingPathExclude)
+	for _, waitTypePath := range []struct {
+		waitType    kibernate.WaitType
+		pathMatch   string
+		pathExclude string
+	}{
+		{kibernate.WaitTypeConnect, *waitConnectPathMatch, *waitConnectPathExclude},
+		{kibernate.WaitTypeLoading, *waitLoadingPathMatch, *waitLoadingPathExclude},
+		{kibernate.WaitTypeNone, *waitNonePathMatch, *waitNonePathExclude},
+	} {
+		if waitTypePath.pathMatch != "" {
+			rule, err := kibernate.NewPathWaitTypeRule(waitTypePath.pathMatch, waitTypePath.pathExclude, waitTypePath.waitType)
+			if err != nil {
+				return kibernate.Config{}, err
+			}
+			kibernateConfig.WaitTypeRules = append(kibernateConfig.WaitTypeRules, rule)
+		}
 	}
 	if *uptimeMonitorUserAgentMatch != "" {
-		kibernateConfig.UptimeMonitorUserAgentMatch = regexp.MustCompile(*uptimeMonitorUserAgentMatch)
+		kibernateConfig.UptimeMonitorUserAgentMatch, err = compileFlagRegexp("uptimeMonitorUserAgentMatch", *uptimeMonitorUserAgentMatch)
+		if err != nil {
+			return kibernate.Config{}, err
+		}
 	}
 	if *uptimeMonitorUserAgentExclude != "" {
-		kibernateConfig.UptimeMonitorUserAgentExclude = regexp.MustCompile(*uptimeMonitorUserAgentExclude)
+		kibernateConfig.UptimeMonitorUserAgentExclude, err = compileFlagRegexp("uptimeMonitorUserAgentExclude", *uptimeMonitorUserAgentExclude)
+		if err != nil {
+			return kibernate.Config{}, err
+		}
 	}
 	if *noDeactivationMoFrFromToUTC != "" {
 		fromTo := strings.SplitN(*noDeactivationMoFrFromToUTC, "-", 2)
 		if len(fromTo) != 2 {
-			panic("noDeactivationMoFrFromToUTC must be in the format HH:MM-HH:MM")
+			return kibernate.Config{}, errors.New("noDeactivationMoFrFromToUTC must be in the format HH:MM-HH:MM")
 		}
 		if !regexp.MustCompile(`^\d\d:\d\d$`).MatchString(fromTo[0]) || !regexp.MustCompile(`^\d\d:\d\d$`).MatchString(fromTo[1]) {
-			panic("noDeactivationMoFrFromToUTC must be in the format HH:MM-HH:MM")
+			return kibernate.Config{}, errors.New("noDeactivationMoFrFromToUTC must be in the format HH:MM-HH:MM")
 		}
 		kibernateConfig.NoDeactivationMoFrFromToUTC = fromTo
 	}
 	if *noDeactivationSatFromToUTC != "" {
 		fromTo := strings.SplitN(*noDeactivationSatFromToUTC, "-", 2)
 		if len(fromTo) != 2 {
-			panic("noDeactivationSatFromToUTC must be in the format HH:MM-HH:MM")
+			return kibernate.Config{}, errors.New("noDeactivationSatFromToUTC must be in the format HH:MM-HH:MM")
 		}
 		if !regexp.MustCompile(`^\d\d:\d\d$`).MatchString(fromTo[0]) || !regexp.MustCompile(`^\d\d:\d\d$`).MatchString(fromTo[1]) {
-			panic("noDeactivationSatFromToUTC must be in the format HH:MM-HH:MM")
+			return kibernate.Config{}, errors.New("noDeactivationSatFromToUTC must be in the format HH:MM-HH:MM")
 		}
 		kibernateConfig.NoDeactivationSatFromToUTC = fromTo
 	}
 	if *noDeactivationSunFromToUTC != "" {
 		fromTo := strings.SplitN(*noDeactivationSunFromToUTC, "-", 2)
 		if len(fromTo) != 2 {
-			panic("noDeactivationSunFromToUTC must be in the format HH:MM-HH:MM")
+			return kibernate.Config{}, errors.New("noDeactivationSunFromToUTC must be in the format HH:MM-HH:MM")
 		}
 		if !regexp.MustCompile(`^\d\d:\d\d$`).MatchString(fromTo[0]) || !regexp.MustCompile(`^\d\d:\d\d$`).MatchString(fromTo[1]) {
-			panic("noDeactivationSunFromToUTC must be in the format HH:MM-HH:MM")
+			return kibernate.Config{}, errors.New("noDeactivationSunFromToUTC must be in the format HH:MM-HH:MM")
 		}
 		kibernateConfig.NoDeactivationSunFromToUTC = fromTo
 	}
-	kibernateInstance := kibernate.NewKibernate(kibernateConfig)
-	err := kibernateInstance.Run()
+	if *webhookUrls != "" {
+		for _, webhookUrl := range strings.Split(*webhookUrls, ",") {
+			kibernateConfig.WebhookUrls = append(kibernateConfig.WebhookUrls, strings.TrimSpace(webhookUrl))
+		}
+	}
+	if *readinessProbeHeaders != "" {
+		kibernateConfig.ReadinessProbeHeaders = map[string]string{}
+		for _, header := range strings.Split(*readinessProbeHeaders, "|") {
+			nameValue := strings.SplitN(header, ":", 2)
+			if len(nameValue) != 2 || strings.TrimSpace(nameValue[0]) == "" {
+				return kibernate.Config{}, errors.New("readinessProbeHeaders must be in the format Name: Value|Name: Value")
+			}
+			kibernateConfig.ReadinessProbeHeaders[strings.TrimSpace(nameValue[0])] = strings.TrimSpace(nameValue[1])
+		}
+	}
+	if *readinessProbeStatusCodes != "" {
+		for _, statusCodes := range strings.Split(*readinessProbeStatusCodes, ",") {
+			fromTo := strings.SplitN(strings.TrimSpace(statusCodes), "-", 2)
+			from, err := strconv.Atoi(fromTo[0])
+			if err != nil {
+				return kibernate.Config{}, errors.New("readinessProbeStatusCodes must be in the format 200,200-299")
+			}
+			to := from
+			if len(fromTo) == 2 {
+				to, err = strconv.Atoi(fromTo[1])
+				if err != nil || to < from {
+					return kibernate.Config{}, errors.New("readinessProbeStatusCodes must be in the format 200,200-299")
+				}
+			}
+			kibernateConfig.ReadinessProbeStatusCodes = append(kibernateConfig.ReadinessProbeStatusCodes, kibernate.StatusCodeRange{From: from, To: to})
+		}
+	}
+	if *readinessProbeBodyMatch != "" {
+		kibernateConfig.ReadinessProbeBodyMatch, err = compileFlagRegexp("readinessProbeBodyMatch", *readinessProbeBodyMatch)
+		if err != nil {
+			return kibernate.Config{}, err
+		}
+	}
+	if *readinessProbeJsonMatch != "" {
+		kibernateConfig.ReadinessProbeJsonMatch, err = compileFlagRegexp("readinessProbeJsonMatch", *readinessProbeJsonMatch)
+		if err != nil {
+			return kibernate.Config{}, err
+		}
+	}
+	if *dependencies != "" {
+		for _, dependency := range strings.Split(*dependencies, ",") {
+			parsed, err := kibernate.ParseDependency(dependency)
+			if err != nil {
+				return kibernate.Config{}, err
+			}
+			kibernateConfig.Dependencies = append(kibernateConfig.Dependencies, parsed)
+		}
+	}
+	if *configFile != "" {
+		err = kibernate.LoadConfigFile(*configFile, &kibernateConfig)
+		if err != nil {
+			return kibernate.Config{}, err
+		}
+	}
+	return kibernateConfig, nil
+}
+
+func compileFlagRegexp(name string, expression string) (*regexp.Regexp, error) {
+	compiled, err := regexp.Compile(expression)
 	if err != nil {
-		log.Fatalf("Error running kibernate: %s", err.Error())
+		return nil, fmt.Errorf("%s is not a valid regular expression: %s", name, err.Error())
 	}
+	return compiled, nil
 }
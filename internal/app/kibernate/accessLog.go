@@ -0,0 +1,156 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+type AccessLogFormat string
+
+const (
+	AccessLogFormatJson     AccessLogFormat = "json"
+	AccessLogFormatCombined                 = "combined"
+)
+
+type AccessLogEntry struct {
+	Time                time.Time        `json:"time"`
+	RequestId           string           `json:"requestId"`
+	Target              string           `json:"target"`
+	RemoteAddr          string           `json:"remoteAddr"`
+	Method              string           `json:"method"`
+	Host                string           `json:"host"`
+	Uri                 string           `json:"uri"`
+	Protocol            string           `json:"protocol"`
+	StatusCode          int              `json:"statusCode"`
+	Bytes               int64            `json:"bytes"`
+	DurationMs          int64            `json:"durationMs"`
+	Referer             string           `json:"referer,omitempty"`
+	UserAgent           string           `json:"userAgent,omitempty"`
+	DeploymentStatus    DeploymentStatus `json:"deploymentStatus"`
+	WaitType            WaitType         `json:"waitType,omitempty"`
+	WaitDurationMs      int64            `json:"waitDurationMs"`
+	ActivationTriggered bool             `json:"activationTriggered"`
+}
+
+type AccessLogger struct {
+	Format AccessLogFormat
+	Writer io.Writer
+	mutex  sync.Mutex
+}
+
+func NewAccessLogger(config Config) (*AccessLogger, error) {
+	if config.AccessLogFormat == "" {
+		return nil, nil
+	}
+	if config.AccessLogFormat != AccessLogFormatJson && config.AccessLogFormat != AccessLogFormatCombined {
+		return nil, fmt.Errorf("invalid access log format '%s'", config.AccessLogFormat)
+	}
+	a := &AccessLogger{Format: config.AccessLogFormat, Writer: os.Stdout}
+	if config.AccessLogFile != "" {
+		file, err := os.OpenFile(config.AccessLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		a.Writer = file
+	}
+	return a, nil
+}
+
+func (a *AccessLogger) Log(entry *AccessLogEntry) {
+	if a == nil {
+		return
+	}
+	var line []byte
+	if a.Format == AccessLogFormatJson {
+		var err error
+		line, err = json.Marshal(entry)
+		if err != nil {
+			slog.Error("Error marshalling access log entry", "error", err)
+			return
+		}
+	} else {
+		line = []byte(entry.Combined())
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	_, err := a.Writer.Write(append(line, '\n'))
+	if err != nil {
+		slog.Error("Error writing access log entry", "error", err)
+	}
+}
+
+func (e *AccessLogEntry) Combined() string {
+	host, _, err := net.SplitHostPort(e.RemoteAddr)
+	if err != nil {
+		host = e.RemoteAddr
+	}
+	waitType := string(e.WaitType)
+	if waitType == "" {
+		waitType = "-"
+	}
+	return fmt.Sprintf(`%s - - [%s] "%s %s %s" %d %d "%s" "%s" request_id=%s wait_type=%s wait_ms=%d activation=%t`,
+		host, e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Method, e.Uri, e.Protocol, e.StatusCode, e.Bytes,
+		orDash(e.Referer), orDash(e.UserAgent), e.RequestId, waitType, e.WaitDurationMs, e.ActivationTriggered)
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	bytes      int64
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	if r.statusCode == 0 {
+		r.statusCode = statusCode
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(data)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
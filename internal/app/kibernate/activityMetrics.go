@@ -0,0 +1,186 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const activityMetricsIntervalSecs = 15
+
+type ActivityMetricsSource struct {
+	Config     Config
+	Router     *Router
+	HttpClient *http.Client
+	Logger     *slog.Logger
+	counts     map[string]float64
+}
+
+func NewActivityMetricsSource(config Config, router *Router) *ActivityMetricsSource {
+	return &ActivityMetricsSource{
+		Config:     config,
+		Router:     router,
+		HttpClient: &http.Client{Timeout: activityMetricsIntervalSecs * time.Second},
+		Logger:     slog.Default().With("component", "activityMetrics"),
+	}
+}
+
+func (s *ActivityMetricsSource) Start(ctx context.Context) {
+	s.Logger.Info("Taking activity of awake targets from metrics", "url", s.Config.ActivityMetricsUrl, "metric", s.Config.ActivityMetricsName)
+	go s.ContinuouslyScrape(ctx)
+}
+
+func (s *ActivityMetricsSource) ContinuouslyScrape(ctx context.Context) {
+	ticker := time.NewTicker(activityMetricsIntervalSecs * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		counts, err := s.Scrape(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			s.Logger.Error("Error scraping activity metrics, considering all targets active", "url", s.Config.ActivityMetricsUrl, "error", err)
+			for _, target := range s.Router.Targets() {
+				target.Proxy.LastActivity = time.Now()
+			}
+			continue
+		}
+		s.Update(counts, time.Now())
+	}
+}
+
+func (s *ActivityMetricsSource) Scrape(ctx context.Context) (map[string]float64, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, s.Config.ActivityMetricsUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", "text/plain")
+	request.Header.Set("User-Agent", "kibernate")
+	response, err := s.HttpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, response.Body)
+		return nil, fmt.Errorf("unexpected status code %d", response.StatusCode)
+	}
+	return ParseMetricCounts(response.Body, s.Config.ActivityMetricsName, s.Config.ActivityMetricsNamespaceLabel, s.Config.ActivityMetricsServiceLabel)
+}
+
+func (s *ActivityMetricsSource) Update(counts map[string]float64, now time.Time) {
+	previous := s.counts
+	s.counts = counts
+	if previous == nil {
+		return
+	}
+	for _, target := range s.Router.Targets() {
+		key := target.Proxy.Config.Namespace + "/" + target.Proxy.Config.Service
+		count, ok := counts[key]
+		if !ok || count == previous[key] {
+			continue
+		}
+		s.Logger.Debug("Activity detected in metrics", "target", target.Key, "requests", count-previous[key])
+		target.Proxy.RecordActivity(now)
+	}
+}
+
+func ParseMetricCounts(reader io.Reader, name string, namespaceLabel string, serviceLabel string) (map[string]float64, error) {
+	counts := map[string]float64{}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") || !strings.HasPrefix(line, name) {
+			continue
+		}
+		rest := line[len(name):]
+		labels := map[string]string{}
+		if strings.HasPrefix(rest, "{") {
+			var err error
+			labels, rest, err = parseMetricLabels(rest[1:])
+			if err != nil {
+				return nil, fmt.Errorf("sample of %s: %s", name, err.Error())
+			}
+		} else if !strings.HasPrefix(rest, " ") && !strings.HasPrefix(rest, "\t") {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("sample of %s has no value", name)
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("sample of %s has invalid value '%s'", name, fields[0])
+		}
+		namespace, service := labels[namespaceLabel], labels[serviceLabel]
+		if namespace == "" || service == "" {
+			continue
+		}
+		counts[namespace+"/"+service] += value
+	}
+	return counts, scanner.Err()
+}
+
+func parseMetricLabels(text string) (map[string]string, string, error) {
+	labels := map[string]string{}
+	for {
+		text = strings.TrimLeft(text, " ,")
+		if strings.HasPrefix(text, "}") {
+			return labels, text[1:], nil
+		}
+		nameEnd := strings.Index(text, "=\"")
+		if nameEnd <= 0 {
+			return nil, "", errors.New("invalid labels")
+		}
+		name := strings.TrimSpace(text[:nameEnd])
+		text = text[nameEnd+2:]
+		var value strings.Builder
+		i := 0
+		for ; i < len(text) && text[i] != '"'; i++ {
+			if text[i] == '\\' && i+1 < len(text) {
+				i++
+				if text[i] == 'n' {
+					value.WriteByte('\n')
+				} else {
+					value.WriteByte(text[i])
+				}
+				continue
+			}
+			value.WriteByte(text[i])
+		}
+		if i == len(text) {
+			return nil, "", fmt.Errorf("unterminated value of label %s", name)
+		}
+		labels[name] = value.String()
+		text = text[i+1:]
+	}
+}
@@ -0,0 +1,94 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMetrics = `# HELP nginx_ingress_controller_requests The total number of client requests
+# TYPE nginx_ingress_controller_requests counter
+nginx_ingress_controller_requests{controller_class="k8s.io/ingress-nginx",host="web.example.com",ingress="web",namespace="apps",path="/",service="web",status="200"} 42
+nginx_ingress_controller_requests{host="web.example.com",ingress="web",namespace="apps",path="/",service="web",status="502"} 3
+nginx_ingress_controller_requests{ingress="api",namespace="apps",path="/a\"b\\c",service="api",status="200"} 7 1700000000000
+nginx_ingress_controller_requests{ingress="default",namespace="",service="",status="404"} 5
+nginx_ingress_controller_requests_total{namespace="apps",service="web"} 1000
+nginx_ingress_controller_request_size_count{namespace="apps",service="web"} 1000
+`
+
+func TestParseMetricCounts(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics string
+		want    map[string]float64
+		wantErr bool
+	}{
+		{"ingress-nginx", testMetrics, map[string]float64{"apps/web": 45, "apps/api": 7}, false},
+		{"empty", "", map[string]float64{}, false},
+		{"without labels", "nginx_ingress_controller_requests 12\n", map[string]float64{}, false},
+		{"unterminated label", `nginx_ingress_controller_requests{namespace="apps} 1`, nil, true},
+		{"invalid value", `nginx_ingress_controller_requests{namespace="apps",service="web"} many`, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseMetricCounts(strings.NewReader(test.metrics), "nginx_ingress_controller_requests", "namespace", "service")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseMetricCounts() error = %v, want error %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("ParseMetricCounts() = %v, want %v", got, test.want)
+			}
+			for key, want := range test.want {
+				if got[key] != want {
+					t.Errorf("ParseMetricCounts()[%s] = %v, want %v", key, got[key], want)
+				}
+			}
+		})
+	}
+}
+
+func TestActivityMetricsSourceUpdate(t *testing.T) {
+	web := &Proxy{Config: Config{Namespace: "apps", Service: "web"}}
+	api := &Proxy{Config: Config{Namespace: "apps", Service: "api"}}
+	router := &Router{targets: map[string]*RoutedTarget{
+		"apps/web:80": {Key: "apps/web:80", Proxy: web},
+		"apps/api:80": {Key: "apps/api:80", Proxy: api},
+	}}
+	source := NewActivityMetricsSource(Config{}, router)
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	source.Update(map[string]float64{"apps/web": 10, "apps/api": 5}, start)
+	if !web.LastActivity.IsZero() || !api.LastActivity.IsZero() {
+		t.Fatal("the first scrape is considered activity")
+	}
+	source.Update(map[string]float64{"apps/web": 12, "apps/api": 5}, start.Add(time.Minute))
+	if !web.LastActivity.Equal(start.Add(time.Minute)) || !api.LastActivity.IsZero() {
+		t.Errorf("last activity web = %v, api = %v, want only web active", web.LastActivity, api.LastActivity)
+	}
+	source.Update(map[string]float64{"apps/web": 1}, start.Add(2*time.Minute))
+	if !web.LastActivity.Equal(start.Add(2 * time.Minute)) {
+		t.Errorf("a reset counter is not considered activity, last activity = %v", web.LastActivity)
+	}
+	source.Update(map[string]float64{"apps/web": 1, "apps/api": 6}, start.Add(3*time.Minute))
+	if !api.LastActivity.Equal(start.Add(3 * time.Minute)) {
+		t.Errorf("a reappearing counter is not considered activity, last activity = %v", api.LastActivity)
+	}
+}
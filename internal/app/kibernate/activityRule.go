@@ -0,0 +1,137 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type ActivityRuleOutcome string
+
+const (
+	ActivityRuleOutcomeInclude ActivityRuleOutcome = "include"
+	ActivityRuleOutcomeExclude                     = "exclude"
+)
+
+type ActivityRule struct {
+	Outcome     ActivityRuleOutcome
+	PathMatch   *regexp.Regexp
+	Methods     []string
+	Headers     map[string]*regexp.Regexp
+	Query       map[string]*regexp.Regexp
+	Cookies     map[string]*regexp.Regexp
+	ClientCidrs []*net.IPNet
+}
+
+func (r *ActivityRule) Matches(request *http.Request, clientIp net.IP) bool {
+	if r.PathMatch != nil && !r.PathMatch.MatchString(request.URL.Path) {
+		return false
+	}
+	if len(r.Methods) > 0 {
+		methodMatches := false
+		for _, method := range r.Methods {
+			if strings.EqualFold(method, request.Method) {
+				methodMatches = true
+				break
+			}
+		}
+		if !methodMatches {
+			return false
+		}
+	}
+	for name, match := range r.Headers {
+		if !anyValueMatches(match, request.Header.Values(name)) {
+			return false
+		}
+	}
+	if len(r.Query) > 0 {
+		query := request.URL.Query()
+		for name, match := range r.Query {
+			if !anyValueMatches(match, query[name]) {
+				return false
+			}
+		}
+	}
+	for name, match := range r.Cookies {
+		cookie, err := request.Cookie(name)
+		if err != nil || !match.MatchString(cookie.Value) {
+			return false
+		}
+	}
+	if len(r.ClientCidrs) > 0 && !ipInNets(clientIp, r.ClientCidrs) {
+		return false
+	}
+	return true
+}
+
+func anyValueMatches(match *regexp.Regexp, values []string) bool {
+	for _, value := range values {
+		if match.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIp(request *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func isFromTrustedProxy(request *http.Request, trustedProxies []*net.IPNet) bool {
+	return ipInNets(remoteIp(request), trustedProxies)
+}
+
+func ClientIp(request *http.Request, trustedProxies []*net.IPNet) net.IP {
+	clientIp := remoteIp(request)
+	if !ipInNets(clientIp, trustedProxies) {
+		return clientIp
+	}
+	var forwardedFor []string
+	for _, header := range request.Header.Values("X-Forwarded-For") {
+		forwardedFor = append(forwardedFor, strings.Split(header, ",")...)
+	}
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		forwardedIp := net.ParseIP(strings.TrimSpace(forwardedFor[i]))
+		if forwardedIp == nil {
+			break
+		}
+		clientIp = forwardedIp
+		if !ipInNets(clientIp, trustedProxies) {
+			break
+		}
+	}
+	return clientIp
+}
@@ -0,0 +1,59 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestClientIp(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	trustedProxies := []*net.IPNet{trusted}
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		forwardedFor   []string
+		trustedProxies []*net.IPNet
+		want           string
+	}{
+		{"direct client", "203.0.113.7:1234", nil, trustedProxies, "203.0.113.7"},
+		{"remote address without port", "203.0.113.7", nil, trustedProxies, "203.0.113.7"},
+		{"untrusted proxy is ignored", "203.0.113.7:1234", []string{"198.51.100.1"}, trustedProxies, "203.0.113.7"},
+		{"no trusted proxies", "10.0.0.1:1234", []string{"198.51.100.1"}, nil, "10.0.0.1"},
+		{"trusted proxy", "10.0.0.1:1234", []string{"198.51.100.1"}, trustedProxies, "198.51.100.1"},
+		{"chain of trusted proxies", "10.0.0.1:1234", []string{"198.51.100.1, 10.0.0.2"}, trustedProxies, "198.51.100.1"},
+		{"spoofed entry before the client", "10.0.0.1:1234", []string{"192.0.2.9, 198.51.100.1"}, trustedProxies, "198.51.100.1"},
+		{"multiple headers", "10.0.0.1:1234", []string{"198.51.100.1", "10.0.0.2"}, trustedProxies, "198.51.100.1"},
+		{"invalid entry stops the walk", "10.0.0.1:1234", []string{"198.51.100.1, garbage, 10.0.0.2"}, trustedProxies, "10.0.0.2"},
+		{"only trusted proxies", "10.0.0.1:1234", []string{"10.0.0.2"}, trustedProxies, "10.0.0.2"},
+		{"ipv6 client", "[2001:db8::1]:1234", nil, trustedProxies, "2001:db8::1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := &http.Request{RemoteAddr: test.remoteAddr, Header: http.Header{}}
+			for _, forwardedFor := range test.forwardedFor {
+				request.Header.Add("X-Forwarded-For", forwardedFor)
+			}
+			got := ClientIp(request, test.trustedProxies)
+			if got.String() != test.want {
+				t.Errorf("ClientIp() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
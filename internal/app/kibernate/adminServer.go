@@ -0,0 +1,269 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type StatusResponse struct {
+	Key                  string                    `json:"key,omitempty"`
+	Routes               []string                  `json:"routes,omitempty"`
+	Namespace            string                    `json:"namespace"`
+	Deployment           string                    `json:"deployment"`
+	Status               DeploymentStatus          `json:"status"`
+	LastStatusChange     time.Time                 `json:"lastStatusChange"`
+	LastActivity         time.Time                 `json:"lastActivity"`
+	EndpointsReady       *bool                     `json:"endpointsReady,omitempty"`
+	TimedOutDependencies []string                  `json:"timedOutDependencies,omitempty"`
+	ReadinessProbe       *ReadinessProbeStatus     `json:"readinessProbe,omitempty"`
+	DeactivationPolicy   *DeactivationPolicyStatus `json:"deactivationPolicy,omitempty"`
+	Hpa                  *HpaStatus                `json:"hpa,omitempty"`
+	KedaActive           *bool                     `json:"kedaActive,omitempty"`
+	DryRun               *DryRunStatus             `json:"dryRun,omitempty"`
+	InFlightRequests     int                       `json:"inFlightRequests"`
+	Draining             bool                      `json:"draining"`
+}
+
+var (
+	ErrTargetNotFound  = errors.New("target not found")
+	ErrTargetAmbiguous = errors.New("target is ambiguous")
+)
+
+type AdminServer struct {
+	Config     Config
+	Proxy      *Proxy
+	Router     *Router
+	HttpServer *http.Server
+}
+
+func NewAdminServer(config Config, proxy *Proxy, router *Router) *AdminServer {
+	a := &AdminServer{Config: config, Proxy: proxy, Router: router}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", a.HandleStatus)
+	mux.HandleFunc("/wake", a.HandleWake)
+	mux.HandleFunc("/sleep", a.HandleSleep)
+	mux.HandleFunc("/metrics", a.HandleMetrics)
+	a.HttpServer = &http.Server{
+		Addr:              fmt.Sprintf("0.0.0.0:%d", config.AdminListenPort),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return a
+}
+
+func (a *AdminServer) Start() error {
+	slog.Info("Starting admin server", "port", a.Config.AdminListenPort)
+	if a.Config.AdminToken == "" {
+		slog.Info("Admin token is not set, wake and sleep are disabled")
+	}
+	return a.HttpServer.ListenAndServe()
+}
+
+func (a *AdminServer) GetStatus() StatusResponse {
+	return NewStatusResponse(a.Proxy)
+}
+
+func (a *AdminServer) GetTargetStatuses() []StatusResponse {
+	statuses := []StatusResponse{}
+	for _, target := range a.Router.Targets() {
+		statuses = append(statuses, NewTargetStatusResponse(target))
+	}
+	return statuses
+}
+
+func NewTargetStatusResponse(target *RoutedTarget) StatusResponse {
+	status := NewStatusResponse(target.Proxy)
+	status.Key = target.Key
+	for _, route := range target.Routes {
+		status.Routes = append(status.Routes, route.String())
+	}
+	return status
+}
+
+func (a *AdminServer) FindTarget(name string) (*Proxy, StatusResponse, error) {
+	if a.Router == nil {
+		if name != "" && name != a.Proxy.Config.Deployment && name != a.Proxy.Config.Namespace+"/"+a.Proxy.Config.Deployment {
+			return nil, StatusResponse{}, fmt.Errorf("%w: %s", ErrTargetNotFound, name)
+		}
+		return a.Proxy, NewStatusResponse(a.Proxy), nil
+	}
+	var matches []*RoutedTarget
+	for _, target := range a.Router.Targets() {
+		if target.Key == name {
+			return target.Proxy, NewTargetStatusResponse(target), nil
+		}
+		config := target.Proxy.Config
+		if name == "" || name == config.Deployment || name == config.Namespace+"/"+config.Deployment {
+			matches = append(matches, target)
+		}
+	}
+	if len(matches) == 0 {
+		return nil, StatusResponse{}, fmt.Errorf("%w: %s", ErrTargetNotFound, name)
+	}
+	if len(matches) > 1 {
+		return nil, StatusResponse{}, fmt.Errorf("%w: '%s' matches %d targets, use the target key", ErrTargetAmbiguous, name, len(matches))
+	}
+	return matches[0].Proxy, NewTargetStatusResponse(matches[0]), nil
+}
+
+func NewStatusResponse(proxy *Proxy) StatusResponse {
+	deployment := proxy.Deployment
+	status := StatusResponse{
+		Namespace:        proxy.Config.Namespace,
+		Deployment:       proxy.Config.Deployment,
+		Status:           deployment.EffectiveStatus(),
+		LastStatusChange: deployment.LastStatusChange,
+		LastActivity:     proxy.LastActivity,
+		InFlightRequests: proxy.InFlight.Count(),
+		Draining:         proxy.InFlight.IsDraining(),
+	}
+	if proxy.Config.ReadinessEndpointSlices {
+		endpointsReady := deployment.AreEndpointsReady()
+		status.EndpointsReady = &endpointsReady
+	}
+	status.TimedOutDependencies = deployment.TimedOutDependencies()
+	if deployment.ReadinessProbe != nil {
+		readinessProbeStatus := deployment.ReadinessProbe.GetStatus()
+		status.ReadinessProbe = &readinessProbeStatus
+	}
+	if deployment.Hpa != nil {
+		if hpaStatus := deployment.Hpa.GetStatus(); hpaStatus.Name != "" || hpaStatus.Blocked != "" || hpaStatus.LastError != "" {
+			status.Hpa = &hpaStatus
+		}
+	}
+	if deployment.Keda != nil {
+		kedaActive := deployment.Keda.IsActiveState()
+		status.KedaActive = &kedaActive
+	}
+	if deployment.DryRun != nil {
+		dryRunStatus := deployment.DryRun.GetStatus()
+		status.DryRun = &dryRunStatus
+	}
+	deactivationPolicyStatus := deployment.DeactivationPolicy.GetStatus()
+	status.DeactivationPolicy = &deactivationPolicyStatus
+	return status
+}
+
+func (a *AdminServer) HandleStatus(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	var response any
+	if a.Router != nil {
+		response = a.GetTargetStatuses()
+	} else {
+		response = a.GetStatus()
+	}
+	err := json.NewEncoder(writer).Encode(response)
+	if err != nil {
+		slog.Error("Error writing status response", "error", err)
+	}
+}
+
+func (a *AdminServer) HandleMetrics(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	statuses := []StatusResponse{}
+	if a.Router != nil {
+		statuses = a.GetTargetStatuses()
+	} else {
+		statuses = append(statuses, a.GetStatus())
+	}
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	err := WriteMetrics(writer, statuses)
+	if err != nil {
+		slog.Error("Error writing metrics response", "error", err)
+	}
+}
+
+func (a *AdminServer) HandleWake(writer http.ResponseWriter, request *http.Request) {
+	a.HandleTargetAction(writer, request, func(proxy *Proxy) error {
+		proxy.LastActivity = time.Now()
+		activated, err := proxy.Deployment.ActivateDeployment(context.Background(), ActivationTrigger{Reason: "admin"})
+		if activated {
+			proxy.Logger.Info("Activation triggered via admin API")
+		}
+		return err
+	})
+}
+
+func (a *AdminServer) HandleSleep(writer http.ResponseWriter, request *http.Request) {
+	a.HandleTargetAction(writer, request, func(proxy *Proxy) error {
+		proxy.Logger.Info("Deactivation requested via admin API", "status", proxy.Deployment.Status)
+		return proxy.DrainAndDeactivate(DeactivationTrigger{Reason: "admin", IdleDuration: time.Since(proxy.LastActivity)})
+	})
+}
+
+func (a *AdminServer) IsAuthorized(request *http.Request) bool {
+	token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(a.Config.AdminToken)) == 1
+}
+
+func (a *AdminServer) HandleTargetAction(writer http.ResponseWriter, request *http.Request, action func(proxy *Proxy) error) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.Config.AdminToken == "" {
+		http.Error(writer, "wake and sleep are disabled, set adminToken to enable them", http.StatusForbidden)
+		return
+	}
+	if !a.IsAuthorized(request) {
+		writer.Header().Set("WWW-Authenticate", `Bearer realm="kibernate"`)
+		http.Error(writer, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	target := request.URL.Query().Get("target")
+	proxy, _, err := a.FindTarget(target)
+	if errors.Is(err, ErrTargetNotFound) {
+		http.Error(writer, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrTargetAmbiguous) {
+		http.Error(writer, err.Error(), http.StatusConflict)
+		return
+	}
+	err = action(proxy)
+	if err != nil {
+		proxy.Logger.Error("Error handling admin request", "path", request.URL.Path, "error", err)
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, status, err := a.FindTarget(target)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(writer).Encode(status)
+	if err != nil {
+		slog.Error("Error writing status response", "error", err)
+	}
+}
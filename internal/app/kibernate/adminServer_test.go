@@ -0,0 +1,60 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminServerTargetActionAuthorization(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string
+		method        string
+		authorization string
+		want          int
+	}{
+		{"no token configured", "", http.MethodPost, "Bearer secret", http.StatusForbidden},
+		{"missing authorization", "secret", http.MethodPost, "", http.StatusUnauthorized},
+		{"wrong token", "secret", http.MethodPost, "Bearer wrong", http.StatusUnauthorized},
+		{"token prefix", "secret", http.MethodPost, "Bearer secre", http.StatusUnauthorized},
+		{"basic authorization", "secret", http.MethodPost, "Basic secret", http.StatusUnauthorized},
+		{"wrong method", "secret", http.MethodGet, "Bearer secret", http.StatusMethodNotAllowed},
+		{"valid token", "secret", http.MethodPost, "Bearer secret", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := NewAdminServer(Config{AdminToken: test.token}, nil, &Router{targets: map[string]*RoutedTarget{}})
+			for _, path := range []string{"/wake", "/sleep"} {
+				request := httptest.NewRequest(test.method, path+"?target=apps/web", nil)
+				if test.authorization != "" {
+					request.Header.Set("Authorization", test.authorization)
+				}
+				recorder := httptest.NewRecorder()
+				a.HttpServer.Handler.ServeHTTP(recorder, request)
+				if recorder.Code != test.want {
+					t.Errorf("%s %s answered %d, want %d", test.method, path, recorder.Code, test.want)
+				}
+				if recorder.Code == http.StatusUnauthorized && recorder.Header().Get("WWW-Authenticate") == "" {
+					t.Errorf("%s %s answered 401 without WWW-Authenticate", test.method, path)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"context"
+	"fmt"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AnnotatedKind string
+
+const (
+	AnnotatedKindDeployment AnnotatedKind = "deployment"
+	AnnotatedKindService                  = "service"
+)
+
+const (
+	annotationPrefix      = "kibernate.io/"
+	enabledAnnotation     = annotationPrefix + "enabled"
+	idleTimeoutAnnotation = annotationPrefix + "idle-timeout"
+	waitTypeAnnotation    = annotationPrefix + "wait-type"
+	servicePortAnnotation = annotationPrefix + "service-port"
+	serviceAnnotation     = annotationPrefix + "service"
+	deploymentAnnotation  = annotationPrefix + "deployment"
+	hostsAnnotation       = annotationPrefix + "hosts"
+)
+
+type AnnotationWatcher struct {
+	Config        Config
+	KubeClientSet kubernetes.Interface
+	Router        *Router
+	Logger        *slog.Logger
+	mutex         sync.Mutex
+	managed       map[string]bool
+}
+
+func NewAnnotationWatcher(config Config, clientSet kubernetes.Interface, router *Router) *AnnotationWatcher {
+	if config.AnnotatedKind == "" {
+		config.AnnotatedKind = AnnotatedKindDeployment
+	}
+	return &AnnotationWatcher{
+		Config:        config,
+		KubeClientSet: clientSet,
+		Router:        router,
+		Logger:        slog.Default().With("component", "annotations", "kind", config.AnnotatedKind),
+		managed:       map[string]bool{},
+	}
+}
+
+func (a *AnnotationWatcher) Start(ctx context.Context) {
+	for _, namespace := range WatchedNamespaces(a.Config) {
+		namespace := namespace
+		go func() {
+			for ctx.Err() == nil {
+				err := a.ContinuouslyReconcile(ctx, namespace)
+				if err != nil && ctx.Err() == nil {
+					a.Logger.Error("Error watching annotated workloads, retrying", "namespace", namespace, "error", err)
+				}
+				sleep(ctx, 5*time.Second)
+			}
+		}()
+	}
+}
+
+func (a *AnnotationWatcher) list(ctx context.Context, namespace string) ([]metav1.Object, string, error) {
+	var objects []metav1.Object
+	if a.Config.AnnotatedKind == AnnotatedKindService {
+		list, err := a.KubeClientSet.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, "", err
+		}
+		for i := range list.Items {
+			objects = append(objects, &list.Items[i])
+		}
+		return objects, list.ResourceVersion, nil
+	}
+	list, err := a.KubeClientSet.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, "", err
+	}
+	for i := range list.Items {
+		objects = append(objects, &list.Items[i])
+	}
+	return objects, list.ResourceVersion, nil
+}
+
+func (a *AnnotationWatcher) watch(ctx context.Context, namespace string, resourceVersion string) (watch.Interface, error) {
+	options := metav1.ListOptions{ResourceVersion: resourceVersion, Watch: true}
+	if a.Config.AnnotatedKind == AnnotatedKindService {
+		return a.KubeClientSet.CoreV1().Services(namespace).Watch(ctx, options)
+	}
+	return a.KubeClientSet.AppsV1().Deployments(namespace).Watch(ctx, options)
+}
+
+func (a *AnnotationWatcher) ContinuouslyReconcile(ctx context.Context, namespace string) error {
+	objects, resourceVersion, err := a.list(ctx, namespace)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, object := range objects {
+		seen[object.GetNamespace()+"/"+object.GetName()] = true
+		a.Reconcile(object)
+	}
+	a.mutex.Lock()
+	var stale []string
+	for key := range a.managed {
+		if IsKeyInNamespace(key, namespace) && !seen[key] {
+			stale = append(stale, key)
+		}
+	}
+	a.mutex.Unlock()
+	for _, key := range stale {
+		a.Remove(key)
+	}
+	watcher, err := a.watch(ctx, namespace, resourceVersion)
+	if err != nil {
+		return err
+	}
+	defer watcher.Stop()
+	for event := range watcher.ResultChan() {
+		object, err := meta.Accessor(event.Object)
+		if err != nil {
+			continue
+		}
+		switch event.Type {
+		case watch.Deleted:
+			a.Remove(object.GetNamespace() + "/" + object.GetName())
+		case watch.Added, watch.Modified:
+			a.Reconcile(object)
+		}
+	}
+	return nil
+}
+
+func (a *AnnotationWatcher) Reconcile(object metav1.Object) {
+	key := object.GetNamespace() + "/" + object.GetName()
+	if object.GetAnnotations()[enabledAnnotation] != "true" {
+		a.Remove(key)
+		return
+	}
+	config, routes, err := AnnotatedTargetConfig(a.Config, a.Config.AnnotatedKind, object.GetNamespace(), object.GetName(), object.GetAnnotations())
+	if err == nil {
+		err = a.Router.Upsert(key, AnnotationsRevision(object.GetAnnotations()), config, routes)
+	}
+	if err != nil {
+		a.Logger.Error("Error managing annotated workload", "workload", key, "error", err)
+		return
+	}
+	a.mutex.Lock()
+	a.managed[key] = true
+	a.mutex.Unlock()
+}
+
+func (a *AnnotationWatcher) Remove(key string) {
+	a.mutex.Lock()
+	delete(a.managed, key)
+	a.mutex.Unlock()
+	if a.Router.Remove(key) {
+		a.Logger.Info("Workload is no longer annotated, no longer serving it", "workload", key)
+	}
+}
+
+func AnnotationsRevision(annotations map[string]string) string {
+	var entries []string
+	for name, value := range annotations {
+		if strings.HasPrefix(name, annotationPrefix) {
+			entries = append(entries, name+"="+value)
+		}
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+func AnnotatedTargetConfig(base Config, kind AnnotatedKind, namespace string, name string, annotations map[string]string) (Config, []Route, error) {
+	config := NewTargetConfig(base, namespace)
+	if kind == AnnotatedKindService {
+		config.Service = name
+		config.Deployment = name
+		if deployment := annotations[deploymentAnnotation]; deployment != "" {
+			config.Deployment = deployment
+		}
+	} else {
+		config.Deployment = name
+		config.Service = name
+		if service := annotations[serviceAnnotation]; service != "" {
+			config.Service = service
+		}
+	}
+	err := ApplyTargetAnnotations(&config, annotations)
+	if err != nil {
+		return config, nil, err
+	}
+	if servicePort := annotations[servicePortAnnotation]; servicePort != "" {
+		port, err := strconv.ParseUint(servicePort, 10, 16)
+		if err != nil || port == 0 {
+			return config, nil, fmt.Errorf("%s: invalid port '%s'", servicePortAnnotation, servicePort)
+		}
+		config.ServicePort = uint16(port)
+	}
+	routes := ServiceRoutes(config.Service, namespace)
+	if hosts := annotations[hostsAnnotation]; hosts != "" {
+		routes = nil
+		for _, host := range strings.Split(hosts, ",") {
+			if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+				routes = append(routes, Route{Host: host})
+			}
+		}
+	}
+	return config, routes, nil
+}
+
+func ApplyTargetAnnotations(config *Config, annotations map[string]string) error {
+	if idleTimeout := annotations[idleTimeoutAnnotation]; idleTimeout != "" {
+		idleTimeoutSecs, err := ParseSeconds(idleTimeout)
+		if err != nil {
+			return fmt.Errorf("%s: %s", idleTimeoutAnnotation, err.Error())
+		}
+		config.IdleTimeoutSecs = idleTimeoutSecs
+	}
+	if waitType := annotations[waitTypeAnnotation]; waitType != "" {
+		config.DefaultWaitType = WaitType(waitType)
+		if !IsValidWaitType(config.DefaultWaitType) {
+			return fmt.Errorf("%s: invalid wait type '%s'", waitTypeAnnotation, waitType)
+		}
+	}
+	return nil
+}
+
+func ParseSeconds(value string) (uint16, error) {
+	if secs, err := strconv.ParseUint(value, 10, 16); err == nil {
+		return uint16(secs), nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 || duration > 65535*time.Second {
+		return 0, fmt.Errorf("'%s' must be a number of seconds or a duration like 10m", value)
+	}
+	return uint16(duration.Seconds()), nil
+}
@@ -0,0 +1,181 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAnnotatedTargetConfig(t *testing.T) {
+	tests := []struct {
+		name            string
+		kind            AnnotatedKind
+		annotations     map[string]string
+		wantDeployment  string
+		wantService     string
+		wantPort        uint16
+		wantIdleTimeout uint16
+		wantWaitType    WaitType
+		wantHosts       []string
+		wantErr         bool
+	}{
+		{
+			name:            "deployment defaults",
+			kind:            AnnotatedKindDeployment,
+			wantDeployment:  "web",
+			wantService:     "web",
+			wantPort:        80,
+			wantIdleTimeout: 600,
+			wantWaitType:    WaitTypeNone,
+			wantHosts:       []string{"web", "web.apps", "web.apps.svc", "web.apps.svc.cluster.local"},
+		},
+		{
+			name: "deployment with overrides",
+			kind: AnnotatedKindDeployment,
+			annotations: map[string]string{
+				serviceAnnotation:     "frontend",
+				servicePortAnnotation: "8080",
+				idleTimeoutAnnotation: "15m",
+				waitTypeAnnotation:    "loading",
+				hostsAnnotation:       " WWW.Example.com, ,api.example.com",
+			},
+			wantDeployment:  "web",
+			wantService:     "frontend",
+			wantPort:        8080,
+			wantIdleTimeout: 900,
+			wantWaitType:    WaitTypeLoading,
+			wantHosts:       []string{"www.example.com", "api.example.com"},
+		},
+		{
+			name:            "service with deployment",
+			kind:            AnnotatedKindService,
+			annotations:     map[string]string{deploymentAnnotation: "web-v2", idleTimeoutAnnotation: "120"},
+			wantDeployment:  "web-v2",
+			wantService:     "web",
+			wantPort:        80,
+			wantIdleTimeout: 120,
+			wantWaitType:    WaitTypeNone,
+			wantHosts:       []string{"web", "web.apps", "web.apps.svc", "web.apps.svc.cluster.local"},
+		},
+		{name: "invalid idle timeout", kind: AnnotatedKindDeployment, annotations: map[string]string{idleTimeoutAnnotation: "soon"}, wantErr: true},
+		{name: "idle timeout out of range", kind: AnnotatedKindDeployment, annotations: map[string]string{idleTimeoutAnnotation: "24h"}, wantErr: true},
+		{name: "invalid wait type", kind: AnnotatedKindDeployment, annotations: map[string]string{waitTypeAnnotation: "spinner"}, wantErr: true},
+		{name: "invalid service port", kind: AnnotatedKindDeployment, annotations: map[string]string{servicePortAnnotation: "http"}, wantErr: true},
+		{name: "zero service port", kind: AnnotatedKindDeployment, annotations: map[string]string{servicePortAnnotation: "0"}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, routes, err := AnnotatedTargetConfig(newTestConfig(), test.kind, "apps", "web", test.annotations)
+			if test.wantErr {
+				if err == nil {
+					t.Error("got no error, want one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if config.Namespace != "apps" || config.Deployment != test.wantDeployment || config.Service != test.wantService || config.ServicePort != test.wantPort {
+				t.Errorf("got target %s/%s via service %s:%d, want apps/%s via %s:%d", config.Namespace, config.Deployment, config.Service, config.ServicePort, test.wantDeployment, test.wantService, test.wantPort)
+			}
+			if config.IdleTimeoutSecs != test.wantIdleTimeout || config.DefaultWaitType != test.wantWaitType {
+				t.Errorf("got idle timeout %d and wait type %s, want %d and %s", config.IdleTimeoutSecs, config.DefaultWaitType, test.wantIdleTimeout, test.wantWaitType)
+			}
+			var hosts []string
+			for _, route := range routes {
+				hosts = append(hosts, route.Host)
+			}
+			if !slices.Equal(hosts, test.wantHosts) {
+				t.Errorf("got hosts %v, want %v", hosts, test.wantHosts)
+			}
+		})
+	}
+}
+
+func TestAnnotationsRevision(t *testing.T) {
+	a := AnnotationsRevision(map[string]string{enabledAnnotation: "true", idleTimeoutAnnotation: "10m", "deployment.kubernetes.io/revision": "3"})
+	b := AnnotationsRevision(map[string]string{idleTimeoutAnnotation: "10m", enabledAnnotation: "true", "deployment.kubernetes.io/revision": "4"})
+	if a != b {
+		t.Errorf("revision changed with unrelated annotations: %q != %q", a, b)
+	}
+	if c := AnnotationsRevision(map[string]string{enabledAnnotation: "true", idleTimeoutAnnotation: "20m"}); c == a {
+		t.Error("revision did not change with a kibernate annotation")
+	}
+}
+
+func newTestAnnotatedDeployment(name string, annotations map[string]string) *appsv1.Deployment {
+	deployment := newTestDeployment(name, 1)
+	deployment.Annotations = annotations
+	return deployment
+}
+
+func waitForTarget(t *testing.T, router *Router, key string, present bool) {
+	for deadline := time.Now().Add(5 * time.Second); (router.Target(key) != nil) != present; {
+		if time.Now().After(deadline) {
+			t.Fatalf("target %s present = %v, want %v", key, !present, present)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAnnotationWatcherAddsAndRemovesTargets(t *testing.T) {
+	enabled := map[string]string{enabledAnnotation: "true"}
+	client := kubefake.NewSimpleClientset(
+		newTestAnnotatedDeployment("web", enabled),
+		newTestAnnotatedDeployment("api", map[string]string{idleTimeoutAnnotation: "10m"}),
+	)
+	watcher := watch.NewFake()
+	client.PrependWatchReactor("deployments", k8stesting.DefaultWatchReactor(watcher, nil))
+	config := newTestConfig()
+	config.Mode = ModeAnnotations
+	router, err := NewRouter(config, client)
+	if err != nil {
+		t.Fatalf("creating router: %v", err)
+	}
+	a := NewAnnotationWatcher(config, client, router)
+	a.managed["apps/gone"] = true
+	router.targets["apps/gone"] = &RoutedTarget{Key: "apps/gone", Proxy: &Proxy{cancelWaiting: func() {}}}
+	done := make(chan error, 1)
+	go func() {
+		done <- a.ContinuouslyReconcile(context.Background(), "apps")
+	}()
+	waitForTarget(t, router, "apps/web", true)
+	waitForTarget(t, router, "apps/gone", false)
+	if router.Target("apps/api") != nil {
+		t.Error("deployment without the enabled annotation is served")
+	}
+	watcher.Modify(newTestAnnotatedDeployment("api", map[string]string{enabledAnnotation: "true", idleTimeoutAnnotation: "10m"}))
+	waitForTarget(t, router, "apps/api", true)
+	if idleTimeout := router.Target("apps/api").Proxy.Config.IdleTimeoutSecs; idleTimeout != 600 {
+		t.Errorf("got idle timeout %d, want 600", idleTimeout)
+	}
+	watcher.Modify(newTestAnnotatedDeployment("web", map[string]string{enabledAnnotation: "false"}))
+	waitForTarget(t, router, "apps/web", false)
+	watcher.Delete(newTestAnnotatedDeployment("api", enabled))
+	waitForTarget(t, router, "apps/api", false)
+	watcher.Stop()
+	if err := <-done; err != nil {
+		t.Errorf("reconciling: %v", err)
+	}
+}
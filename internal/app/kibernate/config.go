@@ -17,43 +17,188 @@
 package kibernate
 
 import (
+	"fmt"
+	"net"
+	"net/url"
 	"regexp"
+	"slices"
+	"strings"
 )
 
 type WaitType string
 
 const (
-	WaitTypeConnect WaitType = "connect"
-	WaitTypeLoading          = "loading"
-	WaitTypeNone             = "none"
+	WaitTypeConnect  WaitType = "connect"
+	WaitTypeLoading           = "loading"
+	WaitTypeNone              = "none"
+	WaitTypeRedirect          = "redirect"
+	WaitTypeApi               = "api"
 )
 
+var fromToUTCRegexp = regexp.MustCompile(`^\d\d:\d\d-\d\d:\d\d$`)
+
+func IsValidWaitType(waitType WaitType) bool {
+	switch waitType {
+	case WaitTypeConnect, WaitTypeLoading, WaitTypeNone, WaitTypeRedirect, WaitTypeApi:
+		return true
+	}
+	return false
+}
+
 type Config struct {
-	Namespace                     string
-	Service                       string
-	Deployment                    string
-	ListenPort                    uint16
-	ServicePort                   uint16
-	IdleTimeoutSecs               uint16
-	DefaultWaitType               WaitType
-	ActivityPathMatch             *regexp.Regexp
-	ActivityPathExclude           *regexp.Regexp
-	ActivityUserAgentMatch        *regexp.Regexp
-	ActivityUserAgentExclude      *regexp.Regexp
-	WaitNonePathMatch             *regexp.Regexp
-	WaitNonePathExclude           *regexp.Regexp
-	WaitConnectPathMatch          *regexp.Regexp
-	WaitConnectPathExclude        *regexp.Regexp
-	WaitLoadingPathMatch          *regexp.Regexp
-	WaitLoadingPathExclude        *regexp.Regexp
-	UptimeMonitorUserAgentMatch   *regexp.Regexp
-	UptimeMonitorUserAgentExclude *regexp.Regexp
-	UptimeMonitorResponseCode     uint16
-	UptimeMonitorResponseMessage  string
-	NoDeactivationMoFrFromToUTC   []string
-	NoDeactivationSatFromToUTC    []string
-	NoDeactivationSunFromToUTC    []string
-	NoDeactivationAutostart       bool
-	ReadinessProbePath            string
-	ReadinessTimeoutSecs          uint16
+	Mode                           Mode
+	WatchNamespaces                []string
+	ResourceName                   string
+	ProxyImage                     string
+	AnnotatedKind                  AnnotatedKind
+	GatewayApiVersion              string
+	GatewayRewriteBackendRefs      bool
+	GatewayService                 string
+	GatewayServicePort             uint16
+	ActivityMetricsUrl             string
+	ActivityMetricsName            string
+	ActivityMetricsNamespaceLabel  string
+	ActivityMetricsServiceLabel    string
+	Namespace                      string
+	Service                        string
+	Deployment                     string
+	ListenPort                     uint16
+	ServicePort                    uint16
+	IdleTimeoutSecs                uint16
+	MinUptimeSecs                  uint16
+	NoIdleDeactivation             bool
+	IdleBackoffWindowSecs          uint16
+	IdleBackoffMaxSecs             uint16
+	MaxDeactivationsPerHour        uint16
+	DrainTimeoutSecs               uint16
+	HpaMode                        HpaMode
+	ScalingMode                    ScalingMode
+	KedaListenPort                 uint16
+	DryRun                         bool
+	DefaultWaitType                WaitType
+	ActivityPathMatch              *regexp.Regexp
+	ActivityPathExclude            *regexp.Regexp
+	ActivityUserAgentMatch         *regexp.Regexp
+	ActivityUserAgentExclude       *regexp.Regexp
+	ActivityRules                  []ActivityRule
+	TrustedProxyCidrs              []*net.IPNet
+	WaitTypeRules                  []WaitTypeRule
+	CustomWaitTypeHandlers         []CustomWaitTypeHandler
+	RedirectUrl                    string
+	RedirectQueryParameter         string
+	RedirectStatusCode             uint16
+	LoadingConfigMap               string
+	LoadingConfigMapKey            string
+	LoadingFile                    string
+	LoadingInline                  string
+	LoadingTemplates               bool
+	ApiStatusCode                  uint16
+	ApiRetryAfterDefaultSecs       uint16
+	UptimeMonitorUserAgentMatch    *regexp.Regexp
+	UptimeMonitorUserAgentExclude  *regexp.Regexp
+	UptimeMonitorResponseCode      uint16
+	UptimeMonitorResponseMessage   string
+	UptimeMonitorRules             []UptimeMonitorRule
+	NoDeactivationMoFrFromToUTC    []string
+	NoDeactivationSatFromToUTC     []string
+	NoDeactivationSunFromToUTC     []string
+	NoDeactivationAutostart        bool
+	ReadinessProbePath             string
+	ReadinessTimeoutSecs           uint16
+	ReadinessProbeType             ReadinessProbeType
+	ReadinessProbeMethod           string
+	ReadinessProbeHeaders          map[string]string
+	ReadinessProbeHost             string
+	ReadinessProbeStatusCodes      []StatusCodeRange
+	ReadinessProbeBodyMatch        *regexp.Regexp
+	ReadinessProbeJsonPath         string
+	ReadinessProbeJsonMatch        *regexp.Regexp
+	ReadinessProbeGrpcService      string
+	ReadinessProbeSuccessThreshold uint16
+	ReadinessProbeFailureThreshold uint16
+	ReadinessEndpointSlices        bool
+	Dependencies                   []Dependency
+	DependencyTimeoutSecs          uint16
+	WebhookUrls                    []string
+	WebhookFormat                  WebhookFormat
+	WebhookSecret                  string
+	WebhookMaxRetries              uint16
+	WebhookTimeoutSecs             uint16
+	WebhookDeadLetterFile          string
+	AdminListenPort                uint16
+	AdminToken                     string
+	ShutdownTimeoutSecs            uint16
+	ShutdownWaitType               WaitType
+	LogLevel                       string
+	LogFormat                      LogFormat
+	AccessLogFormat                AccessLogFormat
+	AccessLogFile                  string
+	TracingOtlpEndpoint            string
+	TracingOtlpInsecure            bool
+	TracingSampleRatio             float64
+	PrewarmEnabled                 bool
+	PrewarmConfigMap               string
+	PrewarmLeadSecs                uint16
+	PrewarmConfidence              float64
+	PrewarmMaxPerDay               uint16
+}
+
+func (c Config) ServiceHost() string {
+	if c.Namespace == "" {
+		return c.Service
+	}
+	return c.Service + "." + c.Namespace
+}
+
+func NewTargetConfig(base Config, namespace string) Config {
+	config := base
+	config.ActivityRules = slices.Clip(config.ActivityRules)
+	config.UptimeMonitorRules = slices.Clip(config.UptimeMonitorRules)
+	config.TrustedProxyCidrs = slices.Clip(config.TrustedProxyCidrs)
+	config.WaitTypeRules = slices.Clip(config.WaitTypeRules)
+	config.CustomWaitTypeHandlers = slices.Clip(config.CustomWaitTypeHandlers)
+	config.Dependencies = slices.Clip(config.Dependencies)
+	config.PrewarmConfigMap = ""
+	config.Namespace = namespace
+	return config
+}
+
+func ParseFromToUTC(fromTo string) ([]string, error) {
+	if !fromToUTCRegexp.MatchString(fromTo) {
+		return nil, fmt.Errorf("'%s' must be in the format HH:MM-HH:MM", fromTo)
+	}
+	return strings.SplitN(fromTo, "-", 2), nil
+}
+
+func ParseDependency(dependency string) (Dependency, error) {
+	kindName := strings.SplitN(strings.TrimSpace(dependency), "/", 2)
+	if len(kindName) != 2 || kindName[1] == "" {
+		return Dependency{}, fmt.Errorf("dependency '%s' must be in the format kind/name", dependency)
+	}
+	kind := WorkloadKind(kindName[0])
+	if kind != WorkloadKindDeployment && kind != WorkloadKindStatefulSet {
+		return Dependency{}, fmt.Errorf("dependency kind must be %s or %s", WorkloadKindDeployment, WorkloadKindStatefulSet)
+	}
+	return Dependency{Kind: kind, Name: kindName[1]}, nil
+}
+
+type StatusCodeRange struct {
+	From int
+	To   int
+}
+
+type CustomWaitTypeHandler struct {
+	Name     string
+	Upstream *url.URL
+}
+
+func (c Config) HasCustomWaitTypeHandler(name string) bool {
+	return slices.ContainsFunc(c.CustomWaitTypeHandlers, func(handler CustomWaitTypeHandler) bool {
+		return handler.Name == name
+	})
+}
+
+type Dependency struct {
+	Kind WorkloadKind
+	Name string
 }
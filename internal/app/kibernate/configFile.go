@@ -0,0 +1,257 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sigs.k8s.io/yaml"
+	"strings"
+	"text/template"
+)
+
+type ConfigFile struct {
+	UptimeMonitorRules []UptimeMonitorRuleSpec `json:"uptimeMonitorRules,omitempty"`
+	ActivityRules      []ActivityRuleSpec      `json:"activityRules,omitempty"`
+	TrustedProxyCidrs  []string                `json:"trustedProxyCidrs,omitempty"`
+	WaitTypeRules      []WaitTypeRuleSpec      `json:"waitTypeRules,omitempty"`
+	WaitTypeHandlers   []WaitTypeHandlerSpec   `json:"waitTypeHandlers,omitempty"`
+}
+
+type WaitTypeRuleSpec struct {
+	When     string `json:"when"`
+	WaitType string `json:"waitType,omitempty"`
+	Handler  string `json:"handler,omitempty"`
+}
+
+type WaitTypeHandlerSpec struct {
+	Name     string `json:"name"`
+	Upstream string `json:"upstream"`
+}
+
+type UptimeMonitorRuleSpec struct {
+	PathMatch        string            `json:"pathMatch,omitempty"`
+	PathExclude      string            `json:"pathExclude,omitempty"`
+	UserAgentMatch   string            `json:"userAgentMatch,omitempty"`
+	UserAgentExclude string            `json:"userAgentExclude,omitempty"`
+	Statuses         []string          `json:"statuses,omitempty"`
+	ResponseCode     uint16            `json:"responseCode,omitempty"`
+	Headers          map[string]string `json:"headers,omitempty"`
+	Body             string            `json:"body,omitempty"`
+}
+
+type ActivityRuleSpec struct {
+	Outcome     string            `json:"outcome"`
+	PathMatch   string            `json:"pathMatch,omitempty"`
+	Methods     []string          `json:"methods,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Query       map[string]string `json:"query,omitempty"`
+	Cookies     map[string]string `json:"cookies,omitempty"`
+	ClientCidrs []string          `json:"clientCidrs,omitempty"`
+}
+
+func LoadConfigFile(path string, config *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var configFile ConfigFile
+	err = yaml.UnmarshalStrict(data, &configFile)
+	if err != nil {
+		return fmt.Errorf("error parsing config file %s: %s", path, err.Error())
+	}
+	return configFile.ApplyTo(config)
+}
+
+func (c *ConfigFile) ApplyTo(config *Config) error {
+	for i, ruleSpec := range c.UptimeMonitorRules {
+		rule, err := ruleSpec.Compile()
+		if err != nil {
+			return fmt.Errorf("uptimeMonitorRules[%d]: %s", i, err.Error())
+		}
+		config.UptimeMonitorRules = append(config.UptimeMonitorRules, rule)
+	}
+	for i, ruleSpec := range c.ActivityRules {
+		rule, err := ruleSpec.Compile()
+		if err != nil {
+			return fmt.Errorf("activityRules[%d]: %s", i, err.Error())
+		}
+		config.ActivityRules = append(config.ActivityRules, rule)
+	}
+	for i, handlerSpec := range c.WaitTypeHandlers {
+		handler, err := handlerSpec.Compile()
+		if err != nil {
+			return fmt.Errorf("waitTypeHandlers[%d]: %s", i, err.Error())
+		}
+		if config.HasCustomWaitTypeHandler(handler.Name) {
+			return fmt.Errorf("waitTypeHandlers[%d]: handler '%s' is defined more than once", i, handler.Name)
+		}
+		config.CustomWaitTypeHandlers = append(config.CustomWaitTypeHandlers, handler)
+	}
+	var waitTypeRules []WaitTypeRule
+	for i, ruleSpec := range c.WaitTypeRules {
+		if ruleSpec.When == "" || (ruleSpec.WaitType == "") == (ruleSpec.Handler == "") {
+			return fmt.Errorf("waitTypeRules[%d]: when and either waitType or handler must be set", i)
+		}
+		var rule WaitTypeRule
+		var err error
+		if ruleSpec.Handler != "" {
+			if !config.HasCustomWaitTypeHandler(ruleSpec.Handler) {
+				return fmt.Errorf("waitTypeRules[%d]: handler '%s' is not defined in waitTypeHandlers", i, ruleSpec.Handler)
+			}
+			rule, err = NewHandlerWaitTypeRule(ruleSpec.When, ruleSpec.Handler)
+		} else {
+			rule, err = NewWaitTypeRule(ruleSpec.When, WaitType(ruleSpec.WaitType))
+		}
+		if err != nil {
+			return fmt.Errorf("waitTypeRules[%d]: %s", i, err.Error())
+		}
+		waitTypeRules = append(waitTypeRules, rule)
+	}
+	config.WaitTypeRules = append(waitTypeRules, config.WaitTypeRules...)
+	trustedProxyCidrs, err := ParseCidrs(c.TrustedProxyCidrs)
+	if err != nil {
+		return fmt.Errorf("trustedProxyCidrs: %s", err.Error())
+	}
+	config.TrustedProxyCidrs = append(config.TrustedProxyCidrs, trustedProxyCidrs...)
+	return nil
+}
+
+func (s *WaitTypeHandlerSpec) Compile() (CustomWaitTypeHandler, error) {
+	if s.Name == "" || s.Upstream == "" {
+		return CustomWaitTypeHandler{}, errors.New("name and upstream must be set")
+	}
+	if IsValidWaitType(WaitType(s.Name)) {
+		return CustomWaitTypeHandler{}, fmt.Errorf("name '%s' is a built-in wait type", s.Name)
+	}
+	upstream, err := url.Parse(s.Upstream)
+	if err != nil {
+		return CustomWaitTypeHandler{}, fmt.Errorf("invalid upstream: %s", err.Error())
+	}
+	if (upstream.Scheme != "http" && upstream.Scheme != "https") || upstream.Host == "" {
+		return CustomWaitTypeHandler{}, fmt.Errorf("upstream '%s' must be an absolute http or https URL", s.Upstream)
+	}
+	return CustomWaitTypeHandler{Name: s.Name, Upstream: upstream}, nil
+}
+
+func (s *UptimeMonitorRuleSpec) Compile() (UptimeMonitorRule, error) {
+	var rule UptimeMonitorRule
+	var err error
+	if s.PathMatch == "" && s.UserAgentMatch == "" {
+		return rule, errors.New("pathMatch or userAgentMatch must be set")
+	}
+	if s.ResponseCode != 0 && (s.ResponseCode < 100 || s.ResponseCode > 599) {
+		return rule, fmt.Errorf("invalid responseCode %d", s.ResponseCode)
+	}
+	rule.ResponseCode = s.ResponseCode
+	if rule.PathMatch, err = compileOptionalRegexp("pathMatch", s.PathMatch); err != nil {
+		return rule, err
+	}
+	if rule.PathExclude, err = compileOptionalRegexp("pathExclude", s.PathExclude); err != nil {
+		return rule, err
+	}
+	if rule.UserAgentMatch, err = compileOptionalRegexp("userAgentMatch", s.UserAgentMatch); err != nil {
+		return rule, err
+	}
+	if rule.UserAgentExclude, err = compileOptionalRegexp("userAgentExclude", s.UserAgentExclude); err != nil {
+		return rule, err
+	}
+	for _, status := range s.Statuses {
+		deploymentStatus := DeploymentStatus(status)
+		if !IsValidDeploymentStatus(deploymentStatus) {
+			return rule, fmt.Errorf("invalid status '%s'", status)
+		}
+		rule.Statuses = append(rule.Statuses, deploymentStatus)
+	}
+	rule.Headers = map[string]*template.Template{}
+	for name, value := range s.Headers {
+		rule.Headers[name], err = template.New(name).Parse(value)
+		if err != nil {
+			return rule, fmt.Errorf("invalid template for header %s: %s", name, err.Error())
+		}
+	}
+	rule.Body, err = template.New("body").Parse(s.Body)
+	if err != nil {
+		return rule, fmt.Errorf("invalid body template: %s", err.Error())
+	}
+	return rule, nil
+}
+
+func (s *ActivityRuleSpec) Compile() (ActivityRule, error) {
+	var rule ActivityRule
+	var err error
+	rule.Outcome = ActivityRuleOutcome(s.Outcome)
+	if rule.Outcome != ActivityRuleOutcomeInclude && rule.Outcome != ActivityRuleOutcomeExclude {
+		return rule, fmt.Errorf("outcome must be %s or %s", ActivityRuleOutcomeInclude, ActivityRuleOutcomeExclude)
+	}
+	if rule.PathMatch, err = compileOptionalRegexp("pathMatch", s.PathMatch); err != nil {
+		return rule, err
+	}
+	rule.Methods = s.Methods
+	if rule.Headers, err = compileRegexpMap("headers", s.Headers); err != nil {
+		return rule, err
+	}
+	if rule.Query, err = compileRegexpMap("query", s.Query); err != nil {
+		return rule, err
+	}
+	if rule.Cookies, err = compileRegexpMap("cookies", s.Cookies); err != nil {
+		return rule, err
+	}
+	if rule.ClientCidrs, err = ParseCidrs(s.ClientCidrs); err != nil {
+		return rule, fmt.Errorf("clientCidrs: %s", err.Error())
+	}
+	return rule, nil
+}
+
+func ParseCidrs(cidrs []string) ([]*net.IPNet, error) {
+	var ipNets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+func compileRegexpMap(name string, expressions map[string]string) (map[string]*regexp.Regexp, error) {
+	compiled := map[string]*regexp.Regexp{}
+	for key, expression := range expressions {
+		var err error
+		compiled[key], err = regexp.Compile(expression)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s expression for %s: %s", name, key, err.Error())
+		}
+	}
+	return compiled, nil
+}
+
+func compileOptionalRegexp(name string, expression string) (*regexp.Regexp, error) {
+	if expression == "" {
+		return nil, nil
+	}
+	compiled, err := regexp.Compile(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", name, err.Error())
+	}
+	return compiled, nil
+}
@@ -0,0 +1,221 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+)
+
+type LintSeverity string
+
+const (
+	LintSeverityError   LintSeverity = "error"
+	LintSeverityWarning              = "warning"
+)
+
+const maxLintSamplesPerExpression = 32
+
+var lintCommonPaths = []string{"/", "/index.html", "/favicon.ico", "/api/", "/static/main.js", "/healthz"}
+
+var waitTypeRulePathExpression = regexp.MustCompile(`path matches ("(?:[^"\\]|\\.)*")`)
+
+type LintFinding struct {
+	Severity LintSeverity `json:"severity"`
+	Message  string       `json:"message"`
+}
+
+func LintConfig(config Config) []LintFinding {
+	var findings []LintFinding
+	addFinding := func(severity LintSeverity, format string, args ...any) {
+		findings = append(findings, LintFinding{Severity: severity, Message: fmt.Sprintf(format, args...)})
+	}
+	if !IsValidWaitType(config.DefaultWaitType) {
+		addFinding(LintSeverityError, "default wait type '%s' is invalid", config.DefaultWaitType)
+	}
+	if config.ShutdownWaitType == WaitTypeConnect {
+		addFinding(LintSeverityError, "shutdown wait type must not be 'connect'")
+	} else if config.ShutdownWaitType != "" && !IsValidWaitType(config.ShutdownWaitType) {
+		addFinding(LintSeverityError, "shutdown wait type '%s' is invalid", config.ShutdownWaitType)
+	}
+	redirectReachable := config.DefaultWaitType == WaitTypeRedirect || config.ShutdownWaitType == WaitTypeRedirect
+	for _, rule := range config.WaitTypeRules {
+		if rule.Handler != "" {
+			if !config.HasCustomWaitTypeHandler(rule.Handler) {
+				addFinding(LintSeverityError, "handler '%s' of rule '%s' is not defined", rule.Handler, rule.When)
+			}
+		} else if !IsValidWaitType(rule.WaitType) {
+			addFinding(LintSeverityError, "wait type '%s' of rule '%s' is invalid", rule.WaitType, rule.When)
+		}
+		redirectReachable = redirectReachable || rule.WaitType == WaitTypeRedirect
+	}
+	if redirectReachable && config.RedirectUrl == "" {
+		addFinding(LintSeverityError, "wait type redirect is used, but redirectUrl is not set")
+	}
+	for _, overlap := range WaitTypeRuleOverlaps(config.WaitTypeRules) {
+		addFinding(LintSeverityWarning, "%s", overlap)
+	}
+	for i, rule := range config.ActivityRules {
+		if i < len(config.ActivityRules)-1 && rule.PathMatch == nil && len(rule.Methods) == 0 && len(rule.Headers) == 0 && len(rule.Query) == 0 && len(rule.Cookies) == 0 && len(rule.ClientCidrs) == 0 {
+			addFinding(LintSeverityWarning, "activityRules[%d] matches every request, the %d rules after it are never evaluated", i, len(config.ActivityRules)-i-1)
+		}
+	}
+	if len(config.ActivityRules) == 0 && (config.ActivityPathMatch == nil || config.ActivityUserAgentMatch == nil) {
+		addFinding(LintSeverityWarning, "no request is considered activity, the deployment is deactivated after the idle timeout regardless of traffic")
+	}
+	if config.MinUptimeSecs > config.IdleTimeoutSecs {
+		addFinding(LintSeverityWarning, "minUptimeSecs (%d) exceeds idleTimeoutSecs (%d), idle deployments stay activated for minUptimeSecs", config.MinUptimeSecs, config.IdleTimeoutSecs)
+	}
+	if config.NoDeactivationAutostart && config.NoDeactivationMoFrFromToUTC == nil && config.NoDeactivationSatFromToUTC == nil && config.NoDeactivationSunFromToUTC == nil {
+		addFinding(LintSeverityWarning, "noDeactivationAutostart has no effect without a no-deactivation time range")
+	}
+	for i, rule := range config.UptimeMonitorRules {
+		for _, status := range rule.Statuses {
+			if status == DeploymentStatusReady {
+				addFinding(LintSeverityWarning, "uptimeMonitorRules[%d] answers while the deployment is ready, such requests never reach the deployment", i)
+			}
+		}
+	}
+	return findings
+}
+
+func WaitTypeRuleOverlaps(rules []WaitTypeRule) []string {
+	paths := append([]string{}, lintCommonPaths...)
+	for _, rule := range rules {
+		for _, expression := range WaitTypeRulePathExpressions(rule) {
+			paths = append(paths, SamplePaths(expression)...)
+		}
+	}
+	var overlaps []string
+	reported := map[[2]int]bool{}
+	for _, path := range paths {
+		request := &http.Request{Method: http.MethodGet, URL: &url.URL{Path: path}, Header: http.Header{}}
+		first := -1
+		for i, rule := range rules {
+			matches, err := rule.Matches(request)
+			if err != nil || !matches {
+				continue
+			}
+			if first == -1 {
+				first = i
+				continue
+			}
+			pair := [2]int{first, i}
+			if rules[first].WaitType == rule.WaitType || reported[pair] {
+				continue
+			}
+			reported[pair] = true
+			overlaps = append(overlaps, fmt.Sprintf("wait type rules '%s' (%s) and '%s' (%s) overlap, e.g. on path %s, the first one wins", rules[first].When, rules[first].WaitType, rule.When, rule.WaitType, path))
+		}
+	}
+	return overlaps
+}
+
+func WaitTypeRulePathExpressions(rule WaitTypeRule) []string {
+	var expressions []string
+	for _, match := range waitTypeRulePathExpression.FindAllStringSubmatch(rule.When, -1) {
+		expression, err := strconv.Unquote(match[1])
+		if err == nil {
+			expressions = append(expressions, expression)
+		}
+	}
+	return expressions
+}
+
+func SamplePaths(expression string) []string {
+	parsed, err := syntax.Parse(expression, syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	var paths []string
+	for _, sample := range regexpSamples(parsed.Simplify()) {
+		if !strings.HasPrefix(sample, "/") {
+			sample = "/" + sample
+		}
+		paths = append(paths, sample)
+	}
+	return paths
+}
+
+func regexpSamples(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return []string{string(re.Rune)}
+	case syntax.OpCharClass:
+		return []string{string(charClassSample(re.Rune))}
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return []string{"x"}
+	case syntax.OpCapture, syntax.OpPlus:
+		return regexpSamples(re.Sub[0])
+	case syntax.OpStar, syntax.OpQuest:
+		return append([]string{""}, regexpSamples(re.Sub[0])...)
+	case syntax.OpRepeat:
+		var samples []string
+		if re.Min == 0 {
+			samples = append(samples, "")
+		}
+		for _, sample := range regexpSamples(re.Sub[0]) {
+			samples = append(samples, strings.Repeat(sample, max(re.Min, 1)))
+		}
+		return samples
+	case syntax.OpAlternate:
+		var samples []string
+		for _, sub := range re.Sub {
+			samples = append(samples, regexpSamples(sub)...)
+		}
+		return capSamples(samples)
+	case syntax.OpConcat:
+		samples := []string{""}
+		for _, sub := range re.Sub {
+			var concatenated []string
+			for _, prefix := range samples {
+				for _, suffix := range regexpSamples(sub) {
+					concatenated = append(concatenated, prefix+suffix)
+				}
+			}
+			samples = capSamples(concatenated)
+		}
+		return samples
+	}
+	return []string{""}
+}
+
+func charClassSample(ranges []rune) rune {
+	for _, preferred := range []rune{'a', '0', 'A', '-'} {
+		for i := 0; i+1 < len(ranges); i += 2 {
+			if ranges[i] <= preferred && preferred <= ranges[i+1] {
+				return preferred
+			}
+		}
+	}
+	if len(ranges) == 0 {
+		return 'x'
+	}
+	return ranges[0]
+}
+
+func capSamples(samples []string) []string {
+	if len(samples) > maxLintSamplesPerExpression {
+		return samples[:maxLintSamplesPerExpression]
+	}
+	return samples
+}
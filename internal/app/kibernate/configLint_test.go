@@ -0,0 +1,84 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWaitTypeRuleOverlaps(t *testing.T) {
+	pathRule := func(pathMatch string, pathExclude string, waitType WaitType) WaitTypeRule {
+		rule, err := NewPathWaitTypeRule(pathMatch, pathExclude, waitType)
+		if err != nil {
+			t.Fatalf("NewPathWaitTypeRule(%q) error = %v", pathMatch, err)
+		}
+		return rule
+	}
+	expressionRule := func(when string, waitType WaitType) WaitTypeRule {
+		rule, err := NewWaitTypeRule(when, waitType)
+		if err != nil {
+			t.Fatalf("NewWaitTypeRule(%q) error = %v", when, err)
+		}
+		return rule
+	}
+	tests := []struct {
+		name  string
+		rules []WaitTypeRule
+		want  []string
+	}{
+		{"no rules", nil, nil},
+		{"disjoint paths", []WaitTypeRule{pathRule("^/api/", "", WaitTypeApi), pathRule("^/static/", "", WaitTypeNone)}, nil},
+		{"same wait type", []WaitTypeRule{pathRule("^/api/", "", WaitTypeApi), pathRule("^/api/v[0-9]+/", "", WaitTypeApi)}, nil},
+		{"nested paths", []WaitTypeRule{pathRule("^/api/", "", WaitTypeApi), pathRule("^/api/(users|groups)", "", WaitTypeLoading)}, []string{"path /api/users"}},
+		{"excluded path", []WaitTypeRule{pathRule("^/api/", "^/api/users", WaitTypeApi), pathRule("^/api/users", "", WaitTypeLoading)}, nil},
+		{"expression rule", []WaitTypeRule{expressionRule(`method == "GET"`, WaitTypeLoading), pathRule("^/healthz$", "", WaitTypeNone)}, []string{"path /healthz"}},
+		{"unrelated expression rule", []WaitTypeRule{expressionRule(`method == "POST"`, WaitTypeApi), pathRule("^/", "", WaitTypeLoading)}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := WaitTypeRuleOverlaps(test.rules)
+			if len(got) != len(test.want) {
+				t.Fatalf("WaitTypeRuleOverlaps() = %q, want %d overlaps", got, len(test.want))
+			}
+			for i, want := range test.want {
+				if !strings.Contains(got[i], want) {
+					t.Errorf("overlap %q does not mention %q", got[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestSamplePaths(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       []string
+	}{
+		{"^/api/", []string{"/api/"}},
+		{"^/(api|static)$", []string{"/api", "/static"}},
+		{"^/v[0-9]+/", []string{"/v0/"}},
+		{"static", []string{"/static"}},
+		{"(", nil},
+	}
+	for _, test := range tests {
+		got := SamplePaths(test.expression)
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("SamplePaths(%q) = %q, want %q", test.expression, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type acceptEntry struct {
+	value   string
+	quality float64
+}
+
+func parseAcceptHeader(header string) []acceptEntry {
+	var entries []acceptEntry
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		value := strings.ToLower(strings.TrimSpace(params[0]))
+		if value == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			nameValue := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(nameValue) == 2 && strings.TrimSpace(nameValue[0]) == "q" {
+				q, err := strconv.ParseFloat(strings.TrimSpace(nameValue[1]), 64)
+				if err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			entries = append(entries, acceptEntry{value: value, quality: quality})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].quality > entries[j].quality
+	})
+	return entries
+}
+
+func NegotiateContentType(accept string, offers []string) string {
+	for _, entry := range parseAcceptHeader(accept) {
+		for _, offer := range offers {
+			if entry.value == offer || entry.value == "*/*" || (strings.HasSuffix(entry.value, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(entry.value, "*"))) {
+				return offer
+			}
+		}
+	}
+	return ""
+}
+
+func NegotiateLanguage(acceptLanguage string, available []string) string {
+	for _, entry := range parseAcceptHeader(acceptLanguage) {
+		for _, language := range available {
+			if entry.value == language {
+				return language
+			}
+		}
+		primary := strings.SplitN(entry.value, "-", 2)[0]
+		for _, language := range available {
+			if primary == language || strings.HasPrefix(language, primary+"-") {
+				return language
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,70 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"testing"
+)
+
+func TestNegotiateContentType(t *testing.T) {
+	offers := []string{"text/html", "application/json"}
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"text/html", "text/html"},
+		{"application/json", "application/json"},
+		{"Application/JSON", "application/json"},
+		{"*/*", "text/html"},
+		{"application/*", "application/json"},
+		{"text/html;q=0.5, application/json", "application/json"},
+		{"text/html;q=0.9, application/json;q=0.9", "text/html"},
+		{"application/json;q=0, */*;q=0.1", "text/html"},
+		{"image/png", ""},
+		{"text/plain, image/*;q=0.8", ""},
+		{"text/html;level=1;q=0.2, application/json;q=0.4", "application/json"},
+		{"application/json;q=invalid, text/html;q=0.5", "application/json"},
+	}
+	for _, test := range tests {
+		if got := NegotiateContentType(test.accept, offers); got != test.want {
+			t.Errorf("NegotiateContentType(%q) = %q, want %q", test.accept, got, test.want)
+		}
+	}
+}
+
+func TestNegotiateLanguage(t *testing.T) {
+	available := []string{"en", "de", "pt-br"}
+	tests := []struct {
+		acceptLanguage string
+		want           string
+	}{
+		{"", ""},
+		{"de", "de"},
+		{"de-AT", "de"},
+		{"fr, de;q=0.5", "de"},
+		{"en;q=0.1, de;q=0.8", "de"},
+		{"pt", "pt-br"},
+		{"PT-BR", "pt-br"},
+		{"fr", ""},
+	}
+	for _, test := range tests {
+		if got := NegotiateLanguage(test.acceptLanguage, available); got != test.want {
+			t.Errorf("NegotiateLanguage(%q) = %q, want %q", test.acceptLanguage, got, test.want)
+		}
+	}
+}
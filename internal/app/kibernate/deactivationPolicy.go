@@ -0,0 +1,117 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"sync"
+	"time"
+)
+
+const maxIdleBackoffLevel = 10
+
+type DeactivationPolicyStatus struct {
+	EffectiveIdleTimeoutSecs uint32    `json:"effectiveIdleTimeoutSecs"`
+	IdleBackoffLevel         int       `json:"idleBackoffLevel"`
+	DeactivationsLastHour    int       `json:"deactivationsLastHour"`
+	LastActivation           time.Time `json:"lastActivation"`
+	LastDeactivation         time.Time `json:"lastDeactivation"`
+}
+
+type DeactivationPolicy struct {
+	Config           Config
+	mutex            sync.Mutex
+	backoffLevel     int
+	lastActivation   time.Time
+	lastDeactivation time.Time
+	deactivations    []time.Time
+}
+
+func NewDeactivationPolicy(config Config) *DeactivationPolicy {
+	return &DeactivationPolicy{Config: config}
+}
+
+func (d *DeactivationPolicy) RecordActivation(now time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.Config.IdleBackoffWindowSecs > 0 && !d.lastDeactivation.IsZero() {
+		if now.Sub(d.lastDeactivation) < time.Duration(d.Config.IdleBackoffWindowSecs)*time.Second {
+			if d.backoffLevel < maxIdleBackoffLevel {
+				d.backoffLevel++
+			}
+		} else if d.backoffLevel > 0 {
+			d.backoffLevel--
+		}
+	}
+	d.lastActivation = now
+}
+
+func (d *DeactivationPolicy) RecordDeactivation(now time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.lastDeactivation = now
+	d.deactivations = append(d.pruneDeactivations(now), now)
+}
+
+func (d *DeactivationPolicy) pruneDeactivations(now time.Time) []time.Time {
+	recent := d.deactivations[:0]
+	for _, deactivation := range d.deactivations {
+		if now.Sub(deactivation) < time.Hour {
+			recent = append(recent, deactivation)
+		}
+	}
+	d.deactivations = recent
+	return recent
+}
+
+func (d *DeactivationPolicy) EffectiveIdleTimeout() time.Duration {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.effectiveIdleTimeout()
+}
+
+func (d *DeactivationPolicy) effectiveIdleTimeout() time.Duration {
+	idleTimeout := time.Duration(d.Config.IdleTimeoutSecs) * time.Second << d.backoffLevel
+	maxIdleTimeout := time.Duration(d.Config.IdleBackoffMaxSecs) * time.Second
+	if d.backoffLevel > 0 && maxIdleTimeout > 0 && idleTimeout > maxIdleTimeout {
+		return maxIdleTimeout
+	}
+	return idleTimeout
+}
+
+func (d *DeactivationPolicy) AllowsDeactivation(now time.Time) (bool, string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.Config.MinUptimeSecs > 0 && !d.lastActivation.IsZero() && now.Sub(d.lastActivation) < time.Duration(d.Config.MinUptimeSecs)*time.Second {
+		return false, "minimum uptime not reached"
+	}
+	if d.Config.MaxDeactivationsPerHour > 0 && len(d.pruneDeactivations(now)) >= int(d.Config.MaxDeactivationsPerHour) {
+		return false, "maximum deactivations per hour reached"
+	}
+	return true, ""
+}
+
+func (d *DeactivationPolicy) GetStatus() DeactivationPolicyStatus {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return DeactivationPolicyStatus{
+		EffectiveIdleTimeoutSecs: uint32(d.effectiveIdleTimeout().Seconds()),
+		IdleBackoffLevel:         d.backoffLevel,
+		DeactivationsLastHour:    len(d.pruneDeactivations(time.Now())),
+		LastActivation:           d.lastActivation,
+		LastDeactivation:         d.lastDeactivation,
+	}
+}
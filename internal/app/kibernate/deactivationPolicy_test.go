@@ -0,0 +1,87 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeactivationPolicyEffectiveIdleTimeout(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		config      Config
+		activations []time.Duration
+		want        time.Duration
+	}{
+		{"no back-off", Config{IdleTimeoutSecs: 600}, []time.Duration{time.Minute, 2 * time.Minute}, 10 * time.Minute},
+		{"reactivated within window", Config{IdleTimeoutSecs: 600, IdleBackoffWindowSecs: 300, IdleBackoffMaxSecs: 3600}, []time.Duration{time.Minute}, 20 * time.Minute},
+		{"reactivated twice within window", Config{IdleTimeoutSecs: 600, IdleBackoffWindowSecs: 300, IdleBackoffMaxSecs: 3600}, []time.Duration{time.Minute, time.Minute}, 40 * time.Minute},
+		{"capped at maximum", Config{IdleTimeoutSecs: 600, IdleBackoffWindowSecs: 300, IdleBackoffMaxSecs: 3600}, []time.Duration{time.Minute, time.Minute, time.Minute}, time.Hour},
+		{"uncapped without maximum", Config{IdleTimeoutSecs: 600, IdleBackoffWindowSecs: 300}, []time.Duration{time.Minute, time.Minute, time.Minute}, 80 * time.Minute},
+		{"relaxed after window", Config{IdleTimeoutSecs: 600, IdleBackoffWindowSecs: 300, IdleBackoffMaxSecs: 3600}, []time.Duration{time.Minute, time.Minute, 10 * time.Minute}, 20 * time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy := NewDeactivationPolicy(test.config)
+			now := start
+			policy.RecordActivation(now)
+			for _, sinceDeactivation := range test.activations {
+				now = now.Add(time.Hour)
+				policy.RecordDeactivation(now)
+				now = now.Add(sinceDeactivation)
+				policy.RecordActivation(now)
+			}
+			if got := policy.EffectiveIdleTimeout(); got != test.want {
+				t.Errorf("EffectiveIdleTimeout() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDeactivationPolicyAllowsDeactivation(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		config        Config
+		deactivations []time.Duration
+		activation    time.Duration
+		now           time.Duration
+		want          bool
+		wantReason    string
+	}{
+		{"unrestricted", Config{}, nil, 0, time.Second, true, ""},
+		{"minimum uptime not reached", Config{MinUptimeSecs: 300}, nil, 0, time.Minute, false, "minimum uptime not reached"},
+		{"minimum uptime reached", Config{MinUptimeSecs: 300}, nil, 0, 5 * time.Minute, true, ""},
+		{"maximum deactivations reached", Config{MaxDeactivationsPerHour: 2}, []time.Duration{10 * time.Minute, 20 * time.Minute}, 0, 30 * time.Minute, false, "maximum deactivations per hour reached"},
+		{"deactivations older than an hour", Config{MaxDeactivationsPerHour: 2}, []time.Duration{10 * time.Minute, 20 * time.Minute}, 0, 75 * time.Minute, true, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy := NewDeactivationPolicy(test.config)
+			for _, deactivation := range test.deactivations {
+				policy.RecordDeactivation(start.Add(deactivation))
+			}
+			policy.RecordActivation(start.Add(test.activation))
+			got, reason := policy.AllowsDeactivation(start.Add(test.now))
+			if got != test.want || reason != test.wantReason {
+				t.Errorf("AllowsDeactivation() = %v, %q, want %v, %q", got, reason, test.want, test.wantReason)
+			}
+		})
+	}
+}
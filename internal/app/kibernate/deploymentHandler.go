@@ -20,13 +20,19 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	appsv1 "k8s.io/api/apps/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
-	"log"
-	"net/http"
-	"net/url"
+	"log/slog"
+	"math"
+	"os"
+	"slices"
+	"sync"
 	"time"
 )
 
@@ -40,47 +46,141 @@ const (
 	DeploymenStatusDeactivated                     = "deactivated"
 )
 
+func IsValidDeploymentStatus(status DeploymentStatus) bool {
+	switch status {
+	case DeploymentStatusReady, DeploymentStatusPossiblyReady, DeploymentStatusActivating, DeploymentStatusDeactivating, DeploymenStatusDeactivated:
+		return true
+	}
+	return false
+}
+
+const maxColdStartSamples = 10
+
 type DeploymentHandler struct {
-	Config           Config
-	Status           DeploymentStatus
-	LastStatusChange time.Time
-	KubeClientSet    *kubernetes.Clientset
-	HostHeader       string
+	Config                Config
+	Status                DeploymentStatus
+	LastStatusChange      time.Time
+	KubeClientSet         kubernetes.Interface
+	HostHeader            string
+	Workload              *WorkloadHandler
+	Dependencies          []*WorkloadHandler
+	groupStateMutex       sync.Mutex
+	groupSequenceMutex    sync.Mutex
+	groupActivating       bool
+	groupCancel           context.CancelFunc
+	timedOutDependencies  []string
+	ReadinessProbe        *ReadinessProbe
+	probeMutex            sync.Mutex
+	probeCancel           context.CancelFunc
+	endpointsMutex        sync.Mutex
+	endpointsReady        bool
+	endpointSlicesReady   map[string]bool
+	endpointPortName      string
+	coldStartMutex        sync.Mutex
+	coldStartDurations    []time.Duration
+	activationStartTime   time.Time
+	Notifier              *WebhookNotifier
+	LastActivationTrigger *ActivationTrigger
+	Logger                *slog.Logger
+	DeactivationPolicy    *DeactivationPolicy
+	Hpa                   *HpaHandler
+	Keda                  *KedaScaler
+	DryRun                *DryRunRecorder
+	BeforeDeactivation    func() error
+	deactivationMutex     sync.Mutex
+	deactivationPending   bool
+	traceMutex            sync.Mutex
+	activationContext     context.Context
+	phaseSpan             trace.Span
 }
 
-func NewDeploymentHandler(config Config) (*DeploymentHandler, error) {
-	clientConfig, err := rest.InClusterConfig()
-	if err != nil {
-		log.Printf("Error creating in-cluster config: %s", err.Error())
-		return nil, err
+func NewDeploymentHandler(config Config, clientSet kubernetes.Interface) (*DeploymentHandler, error) {
+	logger := TargetLogger(config)
+	var err error
+	d := &DeploymentHandler{Config: config, KubeClientSet: clientSet, Logger: logger, Notifier: NewWebhookNotifier(config), DeactivationPolicy: NewDeactivationPolicy(config)}
+	if config.DryRun {
+		d.DryRun = NewDryRunRecorder(config)
 	}
-	clientSet, err := kubernetes.NewForConfig(clientConfig)
+	d.Workload, err = NewWorkloadHandler(config.Namespace, WorkloadKindDeployment, config.Deployment, clientSet)
 	if err != nil {
-		log.Printf("Error creating client set: %s", err.Error())
+		d.Logger.Error("Error creating workload handler", "error", err)
 		return nil, err
 	}
-	d := &DeploymentHandler{Config: config, KubeClientSet: clientSet}
+	if config.ScalingMode == ScalingModeKeda {
+		specReplicas, _, _, err := d.Workload.GetReplicas()
+		if err != nil {
+			d.Logger.Error("Error getting replicas", "error", err)
+			return nil, err
+		}
+		d.Keda = NewKedaScaler(config, specReplicas > 0)
+	} else {
+		d.Hpa = NewHpaHandler(config, clientSet, d.Workload)
+		d.Hpa.Detect()
+	}
+	for _, dependency := range config.Dependencies {
+		dependencyHandler, err := NewWorkloadHandler(config.Namespace, dependency.Kind, dependency.Name, clientSet)
+		if err != nil {
+			d.Logger.Error("Error creating dependency handler", "error", err)
+			return nil, err
+		}
+		d.Dependencies = append(d.Dependencies, dependencyHandler)
+	}
+	if IsReadinessProbeConfigured(config) {
+		d.ReadinessProbe, err = NewReadinessProbe(config)
+		if err != nil {
+			d.Logger.Error("Error creating readiness probe", "error", err)
+			return nil, err
+		}
+	}
+	if config.ReadinessEndpointSlices {
+		_, err = d.SyncEndpointSlices()
+		if err != nil {
+			d.Logger.Error("Error syncing endpoint slices", "error", err)
+			return nil, err
+		}
+	}
 	err = d.UpdateStatus(nil)
 	if err != nil {
-		log.Printf("Error updating deployment status: %s", err.Error())
+		d.Logger.Error("Error updating deployment status", "error", err)
 		return nil, err
 	}
+	if d.DryRun != nil {
+		d.Logger.Warn("Dry run, the deployment is never scaled and requests are always proxied", "status", d.Status)
+	}
+	return d, nil
+}
+
+func (d *DeploymentHandler) Start(ctx context.Context) {
+	d.Notifier.Start(ctx)
+	if d.Config.ReadinessEndpointSlices {
+		go func() {
+			for ctx.Err() == nil {
+				err := d.ContinuouslyUpdateEndpointsStatus(ctx)
+				if err != nil && ctx.Err() == nil {
+					d.Logger.Error("Error continuously updating endpoints status", "error", err)
+					os.Exit(1)
+				}
+				sleep(ctx, 5*time.Second)
+			}
+		}()
+	}
 	go func() {
-		for {
-			err := d.ContinuouslyUpdateStatus()
-			if err != nil {
-				log.Fatalf("Error continuously updating deployment status: %s", err.Error())
+		for ctx.Err() == nil {
+			err := d.ContinuouslyUpdateStatus(ctx)
+			if err != nil && ctx.Err() == nil {
+				d.Logger.Error("Error continuously updating deployment status", "error", err)
+				os.Exit(1)
 			}
-			time.Sleep(5 * time.Second)
+			sleep(ctx, 5*time.Second)
 		}
 	}()
 	go func() {
-		err := d.ContinuouslyHandleNoDeactivationAutostart()
+		err := d.ContinuouslyHandleNoDeactivationAutostart(ctx)
 		if err != nil {
-			log.Fatalf("Error continuously handling noDeactivation autostart: %s", err.Error())
+			d.Logger.Error("Error continuously handling noDeactivation autostart", "error", err)
+			os.Exit(1)
 		}
 	}()
-	return d, nil
 }
 
 func (d *DeploymentHandler) UpdateStatus(dpl *appsv1.Deployment) error {
@@ -89,54 +189,55 @@ func (d *DeploymentHandler) UpdateStatus(dpl *appsv1.Deployment) error {
 		var err error
 		deployment, err = d.KubeClientSet.AppsV1().Deployments(d.Config.Namespace).Get(context.TODO(), d.Config.Deployment, metav1.GetOptions{})
 		if err != nil {
-			log.Printf("Error getting deployment: %s", err.Error())
+			d.Logger.Error("Error getting deployment", "error", err)
 			return err
 		}
 	} else {
 		deployment = dpl
 	}
 	if deployment.Status.ReadyReplicas > 0 && *deployment.Spec.Replicas > 0 {
-		if d.Config.ReadinessProbePath != "" && d.Status != DeploymentStatusPossiblyReady && d.Status != DeploymentStatusReady {
-			log.Println("Deployment is possibly ready")
+		if d.IsActivatingGroup() {
+			d.Logger.Debug("Deployment is ready, waiting for dependencies")
+			d.SetStatus(DeploymentStatusActivating)
+		} else if d.DryRun == nil && !d.AreDependenciesReady() {
+			d.Logger.Debug("Deployment is ready, but its dependencies are not, activating dependencies")
+			d.SetStatus(DeploymentStatusActivating)
+			d.StartGroupActivation()
+		} else if d.Config.ReadinessEndpointSlices && !d.AreEndpointsReady() {
+			d.Logger.Debug("Deployment is ready, waiting for ready service endpoints")
+			d.SetStatus(DeploymentStatusActivating)
+		} else if d.ReadinessProbe != nil && d.Status != DeploymentStatusPossiblyReady && d.Status != DeploymentStatusReady {
+			d.Logger.Debug("Deployment is possibly ready")
 			d.SetStatus(DeploymentStatusPossiblyReady)
+			ctx := d.newProbeContext()
 			go func() {
-				targetBaseUrl, err := url.Parse(fmt.Sprintf("http://%s:%d", d.Config.Service, d.Config.ServicePort))
-				if err != nil {
-					log.Printf("Readiness Probe: Error parsing target base URL: %s", err.Error())
-					return
+				switch d.ReadinessProbe.WaitForReady(ctx, d.HostHeader) {
+				case ReadinessProbeOutcomeSucceeded, ReadinessProbeOutcomeTimedOut:
+					d.SetStatus(DeploymentStatusReady)
+				case ReadinessProbeOutcomeFailed:
+					d.Logger.Warn("Deployment failed its readiness probe, keeping it not ready until its next status change")
+					d.SetStatus(DeploymentStatusActivating)
 				}
-				readinessCheckStartTime := time.Now()
-				for d.Config.ReadinessTimeoutSecs == 0 || time.Since(readinessCheckStartTime).Seconds() < float64(d.Config.ReadinessTimeoutSecs) {
-					httpClient := &http.Client{
-						Timeout: 5 * time.Second,
-					}
-					req, err := http.NewRequest("GET", targetBaseUrl.String()+d.Config.ReadinessProbePath, nil)
-					if err != nil {
-						log.Printf("Readiness Probe: Error creating request: %s", err.Error())
-					}
-					if d.HostHeader != "" {
-						req.Header.Set("Host", d.HostHeader)
-					}
-					resp, err := httpClient.Do(req)
-					if err == nil && resp.StatusCode == 200 {
-						break
-					}
-					time.Sleep(1 * time.Second)
-				}
-				d.SetStatus(DeploymentStatusReady)
 			}()
 		} else {
-			log.Println("Deployment is ready")
+			d.Logger.Debug("Deployment is ready")
 			d.SetStatus(DeploymentStatusReady)
 		}
 	} else if deployment.Status.Replicas > 0 && *deployment.Spec.Replicas == 0 {
-		log.Println("Deployment is deactivating")
+		d.cancelProbe()
+		d.Logger.Debug("Deployment is deactivating")
 		d.SetStatus(DeploymentStatusDeactivating)
 	} else if deployment.Status.Replicas == 0 && *deployment.Spec.Replicas == 0 {
-		log.Println("Deployment is deactivated")
-		d.SetStatus(DeploymenStatusDeactivated)
+		d.cancelProbe()
+		if d.IsActivatingGroup() {
+			d.Logger.Debug("Deployment is deactivated, waiting for dependencies to be activated")
+			d.SetStatus(DeploymentStatusActivating)
+		} else {
+			d.Logger.Debug("Deployment is deactivated")
+			d.SetStatus(DeploymenStatusDeactivated)
+		}
 	} else if deployment.Status.ReadyReplicas == 0 && *deployment.Spec.Replicas > 0 {
-		log.Println("Deployment is activating")
+		d.Logger.Debug("Deployment is activating")
 		d.SetStatus(DeploymentStatusActivating)
 	} else {
 		return errors.New("unexpected deployment status")
@@ -144,25 +245,170 @@ func (d *DeploymentHandler) UpdateStatus(dpl *appsv1.Deployment) error {
 	return nil
 }
 
+func (d *DeploymentHandler) newProbeContext() context.Context {
+	d.probeMutex.Lock()
+	defer d.probeMutex.Unlock()
+	if d.probeCancel != nil {
+		d.probeCancel()
+	}
+	var ctx context.Context
+	ctx, d.probeCancel = context.WithCancel(d.StatusPhaseContext())
+	return ctx
+}
+
+func (d *DeploymentHandler) cancelProbe() {
+	d.probeMutex.Lock()
+	defer d.probeMutex.Unlock()
+	if d.probeCancel != nil {
+		d.probeCancel()
+		d.probeCancel = nil
+	}
+}
+
+func (d *DeploymentHandler) EffectiveStatus() DeploymentStatus {
+	if d.DryRun != nil && d.DryRun.IsAsleep() {
+		return DeploymenStatusDeactivated
+	}
+	return d.Status
+}
+
 func (d *DeploymentHandler) SetStatus(status DeploymentStatus) {
 	if d.Status != status {
-		log.Printf("Deployment status changed from %s to %s", d.Status, status)
+		d.Logger.Info("Deployment status changed", "from", d.Status, "status", status)
+		if d.Status != "" {
+			event := LifecycleEvent{
+				Type:           LifecycleEventStatusChanged,
+				PreviousStatus: d.Status,
+				Status:         status,
+			}
+			if d.LastActivationTrigger != nil && status != DeploymentStatusDeactivating && status != DeploymenStatusDeactivated {
+				event.Reason = d.LastActivationTrigger.Reason
+				event.Request = d.LastActivationTrigger.Request
+			}
+			d.Notifier.Notify(event)
+		}
+		if status == DeploymenStatusDeactivated {
+			d.LastActivationTrigger = nil
+		}
 		d.Status = status
 		d.LastStatusChange = time.Now()
+		d.RecordColdStart(status)
+		d.TraceStatusPhase(status)
+	}
+}
+
+func (d *DeploymentHandler) TraceStatusPhase(status DeploymentStatus) {
+	d.traceMutex.Lock()
+	defer d.traceMutex.Unlock()
+	if d.phaseSpan != nil {
+		d.phaseSpan.End()
+		d.phaseSpan = nil
+	}
+	if d.activationContext == nil {
+		return
+	}
+	if status == DeploymentStatusActivating || status == DeploymentStatusPossiblyReady {
+		_, d.phaseSpan = Tracer().Start(d.activationContext, "kibernate.status."+string(status), trace.WithAttributes(
+			attribute.String("kibernate.deployment.status", string(status)),
+		))
+	} else {
+		d.activationContext = nil
+	}
+}
+
+func (d *DeploymentHandler) StatusPhaseContext() context.Context {
+	d.traceMutex.Lock()
+	defer d.traceMutex.Unlock()
+	if d.phaseSpan == nil {
+		return context.Background()
+	}
+	return trace.ContextWithSpan(context.Background(), d.phaseSpan)
+}
+
+func (d *DeploymentHandler) SetActivationContext(ctx context.Context) {
+	d.traceMutex.Lock()
+	defer d.traceMutex.Unlock()
+	d.activationContext = DetachedSpanContext(ctx)
+}
+
+func (d *DeploymentHandler) RecordColdStart(status DeploymentStatus) {
+	d.coldStartMutex.Lock()
+	defer d.coldStartMutex.Unlock()
+	switch status {
+	case DeploymentStatusActivating:
+		if d.activationStartTime.IsZero() {
+			d.activationStartTime = time.Now()
+		}
+	case DeploymentStatusReady:
+		if !d.activationStartTime.IsZero() {
+			d.coldStartDurations = append(d.coldStartDurations, time.Since(d.activationStartTime))
+			if len(d.coldStartDurations) > maxColdStartSamples {
+				d.coldStartDurations = d.coldStartDurations[len(d.coldStartDurations)-maxColdStartSamples:]
+			}
+			d.activationStartTime = time.Time{}
+		}
+	case DeploymentStatusDeactivating, DeploymenStatusDeactivated:
+		d.activationStartTime = time.Time{}
+	}
+}
+
+func (d *DeploymentHandler) ExpectedColdStartDuration() (time.Duration, bool) {
+	d.coldStartMutex.Lock()
+	defer d.coldStartMutex.Unlock()
+	if len(d.coldStartDurations) == 0 {
+		return 0, false
+	}
+	var total time.Duration
+	for _, duration := range d.coldStartDurations {
+		total += duration
+	}
+	return total / time.Duration(len(d.coldStartDurations)), true
+}
+
+func (d *DeploymentHandler) ActivatingSince() time.Duration {
+	d.coldStartMutex.Lock()
+	defer d.coldStartMutex.Unlock()
+	if d.activationStartTime.IsZero() {
+		return 0
+	}
+	return time.Since(d.activationStartTime)
+}
+
+func (d *DeploymentHandler) ExpectedRemainingColdStart() (time.Duration, bool) {
+	expected, ok := d.ExpectedColdStartDuration()
+	if !ok {
+		return 0, false
 	}
+	remaining := expected - d.ActivatingSince()
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining, true
 }
 
-func (d *DeploymentHandler) ContinuouslyUpdateStatus() error {
+func (d *DeploymentHandler) RetryAfterSeconds(defaultSecs uint16) int {
+	remaining, ok := d.ExpectedRemainingColdStart()
+	if !ok {
+		return int(defaultSecs)
+	}
+	retryAfterSeconds := int(math.Ceil(remaining.Seconds()))
+	if retryAfterSeconds < 1 {
+		retryAfterSeconds = 1
+	}
+	return retryAfterSeconds
+}
+
+func (d *DeploymentHandler) ContinuouslyUpdateStatus(ctx context.Context) error {
 	err := d.UpdateStatus(nil)
 	if err != nil {
 		return err
 	}
-	deploymentWatcher, err := d.KubeClientSet.AppsV1().Deployments(d.Config.Namespace).Watch(context.TODO(), metav1.ListOptions{
+	deploymentWatcher, err := d.KubeClientSet.AppsV1().Deployments(d.Config.Namespace).Watch(ctx, metav1.ListOptions{
 		FieldSelector: "metadata.name=" + d.Config.Deployment,
 		Watch:         true,
 	})
 	if err != nil {
-		log.Printf("Error creating deployment watcher: %s", err.Error())
+		d.Logger.Error("Error creating deployment watcher", "error", err)
 		return err
 	}
 	defer deploymentWatcher.Stop()
@@ -170,12 +416,12 @@ func (d *DeploymentHandler) ContinuouslyUpdateStatus() error {
 		if event.Type == "MODIFIED" {
 			deployment := event.Object.(*appsv1.Deployment)
 			if err != nil {
-				log.Printf("Error converting event object to deployment: %s", err.Error())
+				d.Logger.Error("Error converting event object to deployment", "error", err)
 				return err
 			}
 			err := d.UpdateStatus(deployment)
 			if err != nil {
-				log.Printf("Error updating deployment status: %s", err.Error())
+				d.Logger.Error("Error updating deployment status", "error", err)
 				return err
 			}
 		}
@@ -183,64 +429,409 @@ func (d *DeploymentHandler) ContinuouslyUpdateStatus() error {
 	return nil
 }
 
-func (d *DeploymentHandler) WaitForReady() {
-	for range time.Tick(250 * time.Millisecond) {
-		if d.Status == DeploymentStatusReady {
+func (d *DeploymentHandler) SyncEndpointSlices() (string, error) {
+	service, err := d.KubeClientSet.CoreV1().Services(d.Config.Namespace).Get(context.TODO(), d.Config.Service, metav1.GetOptions{})
+	if err != nil {
+		d.Logger.Error("Error getting service", "error", err)
+		return "", err
+	}
+	portFound := false
+	for _, port := range service.Spec.Ports {
+		if port.Port == int32(d.Config.ServicePort) {
+			d.endpointPortName = port.Name
+			portFound = true
 			break
 		}
 	}
+	if !portFound {
+		return "", fmt.Errorf("service %s has no port %d", d.Config.Service, d.Config.ServicePort)
+	}
+	endpointSlices, err := d.KubeClientSet.DiscoveryV1().EndpointSlices(d.Config.Namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: discoveryv1.LabelServiceName + "=" + d.Config.Service,
+	})
+	if err != nil {
+		d.Logger.Error("Error listing endpoint slices", "error", err)
+		return "", err
+	}
+	endpointSlicesReady := map[string]bool{}
+	for i := range endpointSlices.Items {
+		endpointSlicesReady[endpointSlices.Items[i].Name] = d.HasReadyEndpoint(&endpointSlices.Items[i])
+	}
+	d.endpointsMutex.Lock()
+	d.endpointSlicesReady = endpointSlicesReady
+	d.endpointsReady = d.anyEndpointSliceReady()
+	d.endpointsMutex.Unlock()
+	return endpointSlices.ResourceVersion, nil
 }
 
-func (d *DeploymentHandler) ActivateDeployment() error {
-	if d.Status == DeploymentStatusReady || d.Status == DeploymentStatusActivating {
-		return nil
-	}
-	scale, err := d.KubeClientSet.AppsV1().Deployments(d.Config.Namespace).GetScale(context.TODO(), d.Config.Deployment, metav1.GetOptions{})
+func (d *DeploymentHandler) ContinuouslyUpdateEndpointsStatus(ctx context.Context) error {
+	endpointsReady := d.AreEndpointsReady()
+	resourceVersion, err := d.SyncEndpointSlices()
 	if err != nil {
-		log.Printf("Error getting deployment scale: %s", err.Error())
 		return err
 	}
-	if scale.Spec.Replicas < 1 {
-		scale.Spec.Replicas = 1
-		_, err := d.KubeClientSet.AppsV1().Deployments(d.Config.Namespace).UpdateScale(context.TODO(), d.Config.Deployment, scale, metav1.UpdateOptions{})
+	if d.AreEndpointsReady() != endpointsReady {
+		err = d.UpdateStatus(nil)
 		if err != nil {
-			log.Printf("Error updating deployment scale: %s", err.Error())
-			return err
+			d.Logger.Error("Error updating deployment status", "error", err)
 		}
-		d.SetStatus(DeploymentStatusActivating)
+	}
+	endpointSliceWatcher, err := d.KubeClientSet.DiscoveryV1().EndpointSlices(d.Config.Namespace).Watch(ctx, metav1.ListOptions{
+		LabelSelector:   discoveryv1.LabelServiceName + "=" + d.Config.Service,
+		ResourceVersion: resourceVersion,
+		Watch:           true,
+	})
+	if err != nil {
+		d.Logger.Error("Error creating endpoint slice watcher", "error", err)
+		return err
+	}
+	defer endpointSliceWatcher.Stop()
+	for event := range endpointSliceWatcher.ResultChan() {
+		endpointSlice, ok := event.Object.(*discoveryv1.EndpointSlice)
+		if !ok {
+			continue
+		}
+		d.UpdateEndpointSlice(endpointSlice, event.Type == watch.Deleted)
 	}
 	return nil
 }
 
-func (d *DeploymentHandler) DeactivateDeployment() error {
+func (d *DeploymentHandler) UpdateEndpointSlice(endpointSlice *discoveryv1.EndpointSlice, deleted bool) {
+	ready := !deleted && d.HasReadyEndpoint(endpointSlice)
+	d.endpointsMutex.Lock()
+	if deleted {
+		delete(d.endpointSlicesReady, endpointSlice.Name)
+	} else {
+		d.endpointSlicesReady[endpointSlice.Name] = ready
+	}
+	anyReady := d.anyEndpointSliceReady()
+	d.endpointsMutex.Unlock()
+	d.SetEndpointsReady(anyReady)
+}
+
+func (d *DeploymentHandler) HasReadyEndpoint(endpointSlice *discoveryv1.EndpointSlice) bool {
+	portFound := false
+	for _, port := range endpointSlice.Ports {
+		if (port.Name == nil && d.endpointPortName == "") || (port.Name != nil && *port.Name == d.endpointPortName) {
+			portFound = true
+			break
+		}
+	}
+	if !portFound {
+		return false
+	}
+	for _, endpoint := range endpointSlice.Endpoints {
+		if endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *DeploymentHandler) anyEndpointSliceReady() bool {
+	for _, ready := range d.endpointSlicesReady {
+		if ready {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *DeploymentHandler) AreEndpointsReady() bool {
+	d.endpointsMutex.Lock()
+	defer d.endpointsMutex.Unlock()
+	return d.endpointsReady
+}
+
+func (d *DeploymentHandler) SetEndpointsReady(ready bool) {
+	d.endpointsMutex.Lock()
+	previous := d.endpointsReady
+	d.endpointsReady = ready
+	d.endpointsMutex.Unlock()
+	if previous == ready {
+		return
+	}
+	d.Logger.Info("Service endpoints readiness changed", "from", previous, "endpointsReady", ready, "status", d.Status)
+	err := d.UpdateStatus(nil)
+	if err != nil {
+		d.Logger.Error("Error updating deployment status", "error", err)
+	}
+}
+
+func (d *DeploymentHandler) WaitForReady(ctx context.Context) bool {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for d.Status != DeploymentStatusReady {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+func (d *DeploymentHandler) ActivateDeployment(ctx context.Context, trigger ActivationTrigger) (bool, error) {
+	if d.DryRun != nil {
+		coldStart, ok := d.ExpectedColdStartDuration()
+		if !ok {
+			coldStart = time.Duration(d.Config.ApiRetryAfterDefaultSecs) * time.Second
+		}
+		activated := d.DryRun.RecordActivation(trigger, coldStart)
+		if activated {
+			d.DeactivationPolicy.RecordActivation(time.Now())
+		}
+		return activated, nil
+	}
+	if d.Status == DeploymentStatusReady || d.Status == DeploymentStatusActivating {
+		return false, nil
+	}
+	ctx, span := Tracer().Start(ctx, "kibernate.activate", trace.WithAttributes(
+		attribute.String("kibernate.activation.reason", trigger.Reason),
+		attribute.String("kibernate.deployment.status", string(d.Status)),
+	))
+	defer span.End()
+	if len(d.Dependencies) > 0 {
+		span.SetAttributes(attribute.Bool("kibernate.activation.triggered", true), attribute.Int("kibernate.activation.dependencies", len(d.Dependencies)))
+		d.SetActivationContext(ctx)
+		d.DeactivationPolicy.RecordActivation(time.Now())
+		d.RecordActivationTrigger(trigger)
+		d.SetStatus(DeploymentStatusActivating)
+		d.StartGroupActivation()
+		return true, nil
+	}
+	activated, err := d.ActivateWorkload()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return false, err
+	}
+	span.SetAttributes(attribute.Bool("kibernate.activation.triggered", activated))
+	if activated {
+		d.SetActivationContext(ctx)
+		d.DeactivationPolicy.RecordActivation(time.Now())
+		d.RecordActivationTrigger(trigger)
+		d.SetStatus(DeploymentStatusActivating)
+	}
+	return activated, nil
+}
+
+func (d *DeploymentHandler) RecordActivationTrigger(trigger ActivationTrigger) {
+	d.LastActivationTrigger = &trigger
+	d.Notifier.Notify(LifecycleEvent{
+		Type:    LifecycleEventActivationTriggered,
+		Reason:  trigger.Reason,
+		Status:  d.Status,
+		Request: trigger.Request,
+	})
+}
+
+func (d *DeploymentHandler) DeactivateDeployment(trigger DeactivationTrigger) error {
+	if d.DryRun != nil {
+		if d.DryRun.RecordDeactivation(trigger) {
+			d.DeactivationPolicy.RecordDeactivation(time.Now())
+		}
+		return nil
+	}
 	if d.Status == DeploymenStatusDeactivated || d.Status == DeploymentStatusDeactivating {
 		return nil
 	}
-	scale, err := d.KubeClientSet.AppsV1().Deployments(d.Config.Namespace).GetScale(context.TODO(), d.Config.Deployment, metav1.GetOptions{})
+	if d.BeforeDeactivation != nil {
+		d.setDeactivationPending(true)
+		defer d.setDeactivationPending(false)
+		err := d.BeforeDeactivation()
+		if err != nil {
+			d.Logger.Error("Error preparing deactivation, postponing it", "error", err)
+			return nil
+		}
+	}
+	deactivated, err := d.DeactivateWorkload()
 	if err != nil {
-		log.Printf("Error getting deployment scale: %s", err.Error())
 		return err
 	}
-	if scale.Spec.Replicas > 0 {
-		scale.Spec.Replicas = 0
-		_, err := d.KubeClientSet.AppsV1().Deployments(d.Config.Namespace).UpdateScale(context.TODO(), d.Config.Deployment, scale, metav1.UpdateOptions{})
+	if deactivated {
+		d.DeactivationPolicy.RecordDeactivation(time.Now())
+		d.Notifier.Notify(LifecycleEvent{
+			Type:        LifecycleEventDeactivationDecided,
+			Reason:      trigger.Reason,
+			Status:      d.Status,
+			IdleSeconds: trigger.IdleDuration.Seconds(),
+		})
+		d.SetStatus(DeploymentStatusDeactivating)
+		if len(d.Dependencies) > 0 {
+			go d.DeactivateDependencies(d.newGroupContext())
+		}
+	}
+	return nil
+}
+
+func (d *DeploymentHandler) IsDeactivationPending() bool {
+	d.deactivationMutex.Lock()
+	defer d.deactivationMutex.Unlock()
+	return d.deactivationPending
+}
+
+func (d *DeploymentHandler) setDeactivationPending(pending bool) {
+	d.deactivationMutex.Lock()
+	defer d.deactivationMutex.Unlock()
+	d.deactivationPending = pending
+}
+
+func (d *DeploymentHandler) IsActivatingGroup() bool {
+	d.groupStateMutex.Lock()
+	defer d.groupStateMutex.Unlock()
+	return d.groupActivating
+}
+
+func (d *DeploymentHandler) AreDependenciesReady() bool {
+	for _, dependency := range d.Dependencies {
+		ready, err := dependency.IsReady()
+		if err != nil {
+			d.Logger.Error("Error checking readiness of dependency", "dependency", dependency.String(), "error", err)
+			return false
+		}
+		if !ready {
+			return false
+		}
+	}
+	d.setTimedOutDependencies(nil)
+	return true
+}
+
+func (d *DeploymentHandler) TimedOutDependencies() []string {
+	d.groupStateMutex.Lock()
+	defer d.groupStateMutex.Unlock()
+	return slices.Clone(d.timedOutDependencies)
+}
+
+func (d *DeploymentHandler) setTimedOutDependencies(dependencies []string) {
+	d.groupStateMutex.Lock()
+	defer d.groupStateMutex.Unlock()
+	d.timedOutDependencies = dependencies
+}
+
+func (d *DeploymentHandler) newGroupContext() context.Context {
+	d.groupStateMutex.Lock()
+	defer d.groupStateMutex.Unlock()
+	if d.groupCancel != nil {
+		d.groupCancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d.groupCancel = cancel
+	return ctx
+}
+
+func (d *DeploymentHandler) StartGroupActivation() {
+	d.groupStateMutex.Lock()
+	if d.groupActivating {
+		d.groupStateMutex.Unlock()
+		return
+	}
+	d.groupActivating = true
+	d.groupStateMutex.Unlock()
+	ctx := d.newGroupContext()
+	go func() {
+		d.groupSequenceMutex.Lock()
+		err := d.ActivateGroup(ctx)
+		d.groupSequenceMutex.Unlock()
+		if errors.Is(err, context.Canceled) {
+			d.Logger.Info("Deployment is being deactivated again, aborted activation of dependencies")
+		} else if err != nil {
+			d.Logger.Error("Error activating deployment group", "error", err)
+		}
+		d.groupStateMutex.Lock()
+		d.groupActivating = false
+		d.groupStateMutex.Unlock()
+		err = d.UpdateStatus(nil)
+		if err != nil {
+			d.Logger.Error("Error updating deployment status", "error", err)
+		}
+	}()
+}
+
+func (d *DeploymentHandler) ActivateGroup(ctx context.Context) error {
+	var timedOut []string
+	for _, dependency := range d.Dependencies {
+		d.Logger.Info("Activating dependency", "dependency", dependency.String())
+		_, err := dependency.Activate()
 		if err != nil {
-			log.Printf("Error updating deployment scale: %s", err.Error())
 			return err
 		}
-		d.SetStatus(DeploymentStatusDeactivating)
+		if !dependency.WaitFor(ctx, dependency.IsReady, d.Config.DependencyTimeoutSecs) {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			d.Logger.Warn("Dependency did not become ready in time, keeping the deployment not ready until it is", "dependency", dependency.String(), "timeoutSecs", d.Config.DependencyTimeoutSecs)
+			timedOut = append(timedOut, dependency.String())
+		}
 	}
-	return nil
+	d.setTimedOutDependencies(timedOut)
+	d.Logger.Info("Activating deployment after its dependencies")
+	_, err := d.ActivateWorkload()
+	return err
 }
 
-func (d *DeploymentHandler) ContinuouslyHandleNoDeactivationAutostart() error {
+func (d *DeploymentHandler) ActivateWorkload() (bool, error) {
+	if d.Keda != nil {
+		return d.Keda.SetActive(true), nil
+	}
+	err := d.Hpa.RestoreForActivation()
+	if err != nil {
+		d.Logger.Error("Error restoring horizontal pod autoscaler", "error", err)
+		return false, err
+	}
+	return d.Workload.Activate()
+}
+
+func (d *DeploymentHandler) DeactivateWorkload() (bool, error) {
+	if d.Keda != nil {
+		return d.Keda.SetActive(false), nil
+	}
+	err := d.Hpa.PrepareDeactivation()
+	if errors.Is(err, ErrHibernationBlocked) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return d.Workload.Deactivate()
+}
+
+func (d *DeploymentHandler) DeactivateDependencies(ctx context.Context) {
+	d.groupSequenceMutex.Lock()
+	defer d.groupSequenceMutex.Unlock()
+	d.Workload.WaitFor(ctx, d.Workload.IsDeactivated, d.Config.DependencyTimeoutSecs)
+	for i := len(d.Dependencies) - 1; i >= 0; i-- {
+		if ctx.Err() != nil {
+			d.Logger.Info("Deployment is being activated again, aborting deactivation of dependencies")
+			return
+		}
+		dependency := d.Dependencies[i]
+		d.Logger.Info("Deactivating dependency", "dependency", dependency.String())
+		_, err := dependency.Deactivate()
+		if err != nil {
+			d.Logger.Error("Error deactivating dependency", "dependency", dependency.String(), "error", err)
+			return
+		}
+		dependency.WaitFor(ctx, dependency.IsDeactivated, d.Config.DependencyTimeoutSecs)
+	}
+}
+
+func (d *DeploymentHandler) ContinuouslyHandleNoDeactivationAutostart(ctx context.Context) error {
 	if d.Config.NoDeactivationAutostart {
 		loc, err := time.LoadLocation("UTC")
 		if err != nil {
 			return err
 		}
-		for range time.Tick(30 * time.Second) {
-			if d.Status == DeploymenStatusDeactivated {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+			if d.EffectiveStatus() == DeploymenStatusDeactivated {
 				now := time.Now().UTC()
 				nowTime, err := time.ParseInLocation("15:04", now.Format("15:04"), loc)
 				if err != nil {
@@ -256,7 +847,7 @@ func (d *DeploymentHandler) ContinuouslyHandleNoDeactivationAutostart() error {
 						return err
 					}
 					if fromTime.Before(nowTime) && toTime.After(nowTime) {
-						err = d.ActivateDeployment()
+						_, err = d.ActivateDeployment(context.Background(), ActivationTrigger{Reason: "noDeactivationAutostart"})
 						if err != nil {
 							return err
 						}
@@ -271,7 +862,7 @@ func (d *DeploymentHandler) ContinuouslyHandleNoDeactivationAutostart() error {
 						return err
 					}
 					if fromTime.Before(nowTime) && toTime.After(nowTime) {
-						err = d.ActivateDeployment()
+						_, err = d.ActivateDeployment(context.Background(), ActivationTrigger{Reason: "noDeactivationAutostart"})
 						if err != nil {
 							return err
 						}
@@ -286,7 +877,7 @@ func (d *DeploymentHandler) ContinuouslyHandleNoDeactivationAutostart() error {
 						return err
 					}
 					if fromTime.Before(nowTime) && toTime.After(nowTime) {
-						err = d.ActivateDeployment()
+						_, err = d.ActivateDeployment(context.Background(), ActivationTrigger{Reason: "noDeactivationAutostart"})
 						if err != nil {
 							return err
 						}
@@ -0,0 +1,285 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testWorkloads struct {
+	client *kubefake.Clientset
+	stuck  map[string]bool
+	mutex  sync.Mutex
+	scaled []string
+}
+
+func newTestWorkloads(objects ...runtime.Object) *testWorkloads {
+	w := &testWorkloads{client: kubefake.NewSimpleClientset(objects...), stuck: map[string]bool{}}
+	for _, resource := range []string{"deployments", "statefulsets"} {
+		w.client.PrependReactor("get", resource, w.getScale)
+		w.client.PrependReactor("update", resource, w.updateScale)
+	}
+	return w
+}
+
+func newTestDeployment(name string, replicas int32) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: name},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+		Status:     appsv1.DeploymentStatus{Replicas: replicas, ReadyReplicas: replicas},
+	}
+}
+
+func newTestStatefulSet(name string, replicas int32) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: name},
+		Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+		Status:     appsv1.StatefulSetStatus{Replicas: replicas, ReadyReplicas: replicas},
+	}
+}
+
+func (w *testWorkloads) getScale(action k8stesting.Action) (bool, runtime.Object, error) {
+	if action.GetSubresource() != "scale" {
+		return false, nil, nil
+	}
+	object, err := w.client.Tracker().Get(action.GetResource(), action.GetNamespace(), action.(k8stesting.GetAction).GetName())
+	if err != nil {
+		return true, nil, err
+	}
+	scale := &autoscalingv1.Scale{ObjectMeta: metav1.ObjectMeta{Namespace: action.GetNamespace(), Name: action.(k8stesting.GetAction).GetName()}}
+	switch workload := object.(type) {
+	case *appsv1.Deployment:
+		scale.Spec.Replicas = *workload.Spec.Replicas
+	case *appsv1.StatefulSet:
+		scale.Spec.Replicas = *workload.Spec.Replicas
+	}
+	return true, scale, nil
+}
+
+func (w *testWorkloads) updateScale(action k8stesting.Action) (bool, runtime.Object, error) {
+	if action.GetSubresource() != "scale" {
+		return false, nil, nil
+	}
+	scale := action.(k8stesting.UpdateAction).GetObject().(*autoscalingv1.Scale)
+	key := strings.TrimSuffix(action.GetResource().Resource, "s") + "/" + scale.Name
+	object, err := w.client.Tracker().Get(action.GetResource(), action.GetNamespace(), scale.Name)
+	if err != nil {
+		return true, nil, err
+	}
+	replicas := scale.Spec.Replicas
+	switch workload := object.(type) {
+	case *appsv1.Deployment:
+		workload.Spec.Replicas = &replicas
+		if !w.stuck[key] {
+			workload.Status.Replicas, workload.Status.ReadyReplicas = replicas, replicas
+		}
+	case *appsv1.StatefulSet:
+		workload.Spec.Replicas = &replicas
+		if !w.stuck[key] {
+			workload.Status.Replicas, workload.Status.ReadyReplicas = replicas, replicas
+		}
+	}
+	err = w.client.Tracker().Update(action.GetResource(), object, action.GetNamespace())
+	if err != nil {
+		return true, nil, err
+	}
+	w.mutex.Lock()
+	w.scaled = append(w.scaled, key)
+	w.mutex.Unlock()
+	return true, scale, nil
+}
+
+func (w *testWorkloads) Scaled() []string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return slices.Clone(w.scaled)
+}
+
+func newTestDependencyHandler(t *testing.T, w *testWorkloads, timeoutSecs uint16) *DeploymentHandler {
+	config := newTestConfig()
+	config.Deployment = "app"
+	config.Dependencies = []Dependency{{Kind: WorkloadKindStatefulSet, Name: "redis"}, {Kind: WorkloadKindDeployment, Name: "worker"}}
+	config.DependencyTimeoutSecs = timeoutSecs
+	d, err := NewDeploymentHandler(config, w.client)
+	if err != nil {
+		t.Fatalf("creating deployment handler: %v", err)
+	}
+	return d
+}
+
+func TestActivateGroupActivatesDependenciesFirst(t *testing.T) {
+	w := newTestWorkloads(newTestDeployment("app", 0), newTestStatefulSet("redis", 0), newTestDeployment("worker", 0))
+	d := newTestDependencyHandler(t, w, 5)
+	err := d.ActivateGroup(context.Background())
+	if err != nil {
+		t.Fatalf("activating group: %v", err)
+	}
+	want := []string{"statefulset/redis", "deployment/worker", "deployment/app"}
+	if got := w.Scaled(); !slices.Equal(got, want) {
+		t.Errorf("scaled %v, want %v", got, want)
+	}
+	if !d.AreDependenciesReady() {
+		t.Error("dependencies are not ready")
+	}
+}
+
+func TestActivateGroupKeepsTimedOutDependenciesNotReady(t *testing.T) {
+	w := newTestWorkloads(newTestDeployment("app", 0), newTestStatefulSet("redis", 0), newTestDeployment("worker", 0))
+	w.stuck["statefulset/redis"] = true
+	d := newTestDependencyHandler(t, w, 1)
+	err := d.ActivateGroup(context.Background())
+	if err != nil {
+		t.Fatalf("activating group: %v", err)
+	}
+	if got := d.TimedOutDependencies(); !slices.Equal(got, []string{"statefulset/redis"}) {
+		t.Errorf("timed out dependencies are %v, want [statefulset/redis]", got)
+	}
+	if d.AreDependenciesReady() {
+		t.Error("a timed out dependency is considered ready")
+	}
+	err = d.UpdateStatus(nil)
+	if err != nil {
+		t.Fatalf("updating status: %v", err)
+	}
+	if d.Status == DeploymentStatusReady {
+		t.Error("deployment is ready although a dependency is not")
+	}
+}
+
+func TestDeactivateDependenciesInReverseOrder(t *testing.T) {
+	w := newTestWorkloads(newTestDeployment("app", 0), newTestStatefulSet("redis", 1), newTestDeployment("worker", 1))
+	d := newTestDependencyHandler(t, w, 5)
+	d.DeactivateDependencies(context.Background())
+	want := []string{"deployment/worker", "statefulset/redis"}
+	if got := w.Scaled(); !slices.Equal(got, want) {
+		t.Errorf("scaled %v, want %v", got, want)
+	}
+}
+
+func TestDeactivateDependenciesStopsWhenCancelled(t *testing.T) {
+	w := newTestWorkloads(newTestDeployment("app", 1), newTestStatefulSet("redis", 1), newTestDeployment("worker", 1))
+	d := newTestDependencyHandler(t, w, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.DeactivateDependencies(ctx)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deactivation of dependencies keeps waiting for the deployment after being cancelled")
+	}
+	if got := w.Scaled(); len(got) > 0 {
+		t.Errorf("scaled %v after being cancelled", got)
+	}
+}
+
+func TestDeactivateDeploymentLeavesDependenciesWhenNotDeactivated(t *testing.T) {
+	w := newTestWorkloads(newTestDeployment("app", 0), newTestStatefulSet("redis", 1), newTestDeployment("worker", 1))
+	d := newTestDependencyHandler(t, w, 0)
+	d.Status = DeploymentStatusReady
+	err := d.DeactivateDeployment(DeactivationTrigger{Reason: "idle"})
+	if err != nil {
+		t.Fatalf("deactivating deployment: %v", err)
+	}
+	d.groupStateMutex.Lock()
+	started := d.groupCancel != nil
+	d.groupStateMutex.Unlock()
+	if started {
+		t.Error("dependencies are deactivated although the deployment was not")
+	}
+}
+
+func newTestEndpointSlice(name string, portName string, ready bool) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: name, Labels: map[string]string{discoveryv1.LabelServiceName: "web"}},
+		Ports:      []discoveryv1.EndpointPort{{Name: &portName}},
+		Endpoints:  []discoveryv1.Endpoint{{Conditions: discoveryv1.EndpointConditions{Ready: &ready}}},
+	}
+}
+
+func TestEndpointSliceWatchUpdatesReadiness(t *testing.T) {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "web"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 80}}},
+	}
+	w := newTestWorkloads(newTestDeployment("web", 1), service)
+	watchers := make(chan *watch.FakeWatcher, 1)
+	w.client.PrependWatchReactor("endpointslices", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		watcher := watch.NewFake()
+		watchers <- watcher
+		return true, watcher, nil
+	})
+	config := newTestConfig()
+	config.Deployment = "web"
+	config.Service = "web"
+	config.ReadinessEndpointSlices = true
+	d, err := NewDeploymentHandler(config, w.client)
+	if err != nil {
+		t.Fatalf("creating deployment handler: %v", err)
+	}
+	if d.AreEndpointsReady() {
+		t.Fatal("endpoints are ready without endpoint slices")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = d.ContinuouslyUpdateEndpointsStatus(ctx)
+	}()
+	go func() {
+		for ctx.Err() == nil {
+			d.AreEndpointsReady()
+		}
+	}()
+	watcher := <-watchers
+	waitForEndpointsReady := func(want bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for d.AreEndpointsReady() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("endpoints ready is %v, want %v", !want, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	watcher.Add(newTestEndpointSlice("web-metrics", "metrics", true))
+	watcher.Add(newTestEndpointSlice("web-a", "http", false))
+	waitForEndpointsReady(false)
+	watcher.Modify(newTestEndpointSlice("web-a", "http", true))
+	waitForEndpointsReady(true)
+	watcher.Add(newTestEndpointSlice("web-b", "http", true))
+	watcher.Delete(newTestEndpointSlice("web-a", "http", true))
+	waitForEndpointsReady(true)
+	watcher.Delete(newTestEndpointSlice("web-b", "http", true))
+	waitForEndpointsReady(false)
+}
@@ -0,0 +1,123 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const maxDryRunDecisions = 20
+
+type DryRunDecision struct {
+	Time        time.Time        `json:"time"`
+	Action      string           `json:"action"`
+	Reason      string           `json:"reason"`
+	IdleSeconds float64          `json:"idleSeconds,omitempty"`
+	Request     *RequestMetadata `json:"request,omitempty"`
+}
+
+type DryRunStatus struct {
+	Asleep            bool             `json:"asleep"`
+	AsleepSince       time.Time        `json:"asleepSince"`
+	AsleepSeconds     float64          `json:"asleepSeconds"`
+	Activations       uint64           `json:"activations"`
+	Deactivations     uint64           `json:"deactivations"`
+	ColdStartRequests uint64           `json:"coldStartRequests"`
+	Decisions         []DryRunDecision `json:"decisions"`
+}
+
+type DryRunRecorder struct {
+	Logger       *slog.Logger
+	mutex        sync.Mutex
+	status       DryRunStatus
+	wakingUntil  time.Time
+	asleepBefore time.Duration
+}
+
+func NewDryRunRecorder(config Config) *DryRunRecorder {
+	return &DryRunRecorder{
+		Logger: TargetLogger(config).With("component", "dryRun"),
+		status: DryRunStatus{Decisions: []DryRunDecision{}},
+	}
+}
+
+func (r *DryRunRecorder) IsAsleep() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.status.Asleep
+}
+
+func (r *DryRunRecorder) RecordActivation(trigger ActivationTrigger, coldStart time.Duration) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	if !r.status.Asleep {
+		if trigger.Request != nil && now.Before(r.wakingUntil) {
+			r.status.ColdStartRequests++
+			r.Logger.Info("Dry run: request would have waited for activation", "path", trigger.Request.Path, "remainingSecs", r.wakingUntil.Sub(now).Seconds())
+		}
+		return false
+	}
+	asleep := now.Sub(r.status.AsleepSince)
+	r.asleepBefore += asleep
+	r.status.Asleep = false
+	r.status.AsleepSince = time.Time{}
+	r.status.Activations++
+	r.wakingUntil = now.Add(coldStart)
+	if trigger.Request != nil {
+		r.status.ColdStartRequests++
+	}
+	r.record(DryRunDecision{Time: now, Action: "activate", Reason: trigger.Reason, Request: trigger.Request})
+	r.Logger.Info("Dry run: would activate deployment", "reason", trigger.Reason, "asleepSecs", asleep.Seconds(), "expectedColdStartSecs", coldStart.Seconds())
+	return true
+}
+
+func (r *DryRunRecorder) RecordDeactivation(trigger DeactivationTrigger) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.status.Asleep {
+		return false
+	}
+	now := time.Now()
+	r.status.Asleep = true
+	r.status.AsleepSince = now
+	r.status.Deactivations++
+	r.record(DryRunDecision{Time: now, Action: "deactivate", Reason: trigger.Reason, IdleSeconds: trigger.IdleDuration.Seconds()})
+	r.Logger.Info("Dry run: would deactivate deployment", "reason", trigger.Reason, "idleSeconds", trigger.IdleDuration.Seconds())
+	return true
+}
+
+func (r *DryRunRecorder) record(decision DryRunDecision) {
+	r.status.Decisions = append(r.status.Decisions, decision)
+	if len(r.status.Decisions) > maxDryRunDecisions {
+		r.status.Decisions = r.status.Decisions[len(r.status.Decisions)-maxDryRunDecisions:]
+	}
+}
+
+func (r *DryRunRecorder) GetStatus() DryRunStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	status := r.status
+	status.Decisions = append([]DryRunDecision{}, r.status.Decisions...)
+	status.AsleepSeconds = r.asleepBefore.Seconds()
+	if status.Asleep {
+		status.AsleepSeconds += time.Since(status.AsleepSince).Seconds()
+	}
+	return status
+}
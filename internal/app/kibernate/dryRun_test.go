@@ -0,0 +1,109 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestDryRunReportsEffectiveStatus(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = io.WriteString(writer, "app")
+	}))
+	defer upstream.Close()
+	config := Config{
+		Namespace:                    "apps",
+		Deployment:                   "web",
+		DryRun:                       true,
+		UptimeMonitorUserAgentMatch:  regexp.MustCompile("Pingdom"),
+		UptimeMonitorResponseCode:    200,
+		UptimeMonitorResponseMessage: "monitor",
+	}
+	targetBaseUrl, _ := url.Parse(upstream.URL)
+	deployment := &DeploymentHandler{Config: config, Status: DeploymentStatusReady, DryRun: NewDryRunRecorder(config), DeactivationPolicy: NewDeactivationPolicy(config), Logger: TargetLogger(config)}
+	proxy := &Proxy{Config: config, TargetBaseUrl: targetBaseUrl, Deployment: deployment, InFlight: NewInFlightTracker(), Logger: TargetLogger(config)}
+	proxy.UptimeMonitorHandler = NewUptimeMonitorHandler(config, proxy, deployment)
+	monitorRequest := func() string {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Set("User-Agent", "Pingdom.com_bot")
+		recorder := httptest.NewRecorder()
+		if !proxy.UptimeMonitorHandler.Handle(recorder, request) {
+			t.Fatal("uptime monitor request not handled")
+		}
+		return strings.TrimSpace(recorder.Body.String())
+	}
+	if body := monitorRequest(); body != "app" {
+		t.Errorf("uptime monitor request while awake answered %q, want it proxied", body)
+	}
+	err := deployment.DeactivateDeployment(DeactivationTrigger{Reason: "idle"})
+	if err != nil {
+		t.Fatalf("deactivating: %v", err)
+	}
+	if deployment.Status != DeploymentStatusReady {
+		t.Fatalf("dry run changed the real status to %q", deployment.Status)
+	}
+	if body := monitorRequest(); body != "monitor" {
+		t.Errorf("uptime monitor request while simulated asleep answered %q, want monitor", body)
+	}
+	status := NewStatusResponse(proxy)
+	if status.Status != DeploymenStatusDeactivated || status.DryRun == nil || !status.DryRun.Asleep {
+		t.Errorf("status = %q, dry run = %+v, want deactivated and asleep", status.Status, status.DryRun)
+	}
+	var metrics bytes.Buffer
+	err = WriteMetrics(&metrics, []StatusResponse{status})
+	if err != nil {
+		t.Fatalf("writing metrics: %v", err)
+	}
+	if !strings.Contains(metrics.String(), `status="deactivated"} 1`) || !strings.Contains(metrics.String(), `status="ready"} 0`) {
+		t.Errorf("metrics do not report the simulated status:\n%s", metrics.String())
+	}
+}
+
+func TestDryRunUnmatchedUptimeMonitorRequestsAreProxied(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = io.WriteString(writer, "app")
+	}))
+	defer upstream.Close()
+	config := Config{
+		DryRun: true,
+		UptimeMonitorRules: []UptimeMonitorRule{{
+			UserAgentMatch: regexp.MustCompile("Pingdom"),
+			Statuses:       []DeploymentStatus{DeploymentStatusActivating},
+			ResponseCode:   200,
+			RawBody:        "monitor",
+		}},
+	}
+	targetBaseUrl, _ := url.Parse(upstream.URL)
+	deployment := &DeploymentHandler{Config: config, Status: DeploymentStatusReady, DryRun: NewDryRunRecorder(config), DeactivationPolicy: NewDeactivationPolicy(config), Logger: TargetLogger(config)}
+	proxy := &Proxy{Config: config, TargetBaseUrl: targetBaseUrl, Deployment: deployment, InFlight: NewInFlightTracker(), Logger: TargetLogger(config)}
+	proxy.UptimeMonitorHandler = NewUptimeMonitorHandler(config, proxy, deployment)
+	_ = deployment.DeactivateDeployment(DeactivationTrigger{Reason: "idle"})
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("User-Agent", "Pingdom.com_bot")
+	recorder := httptest.NewRecorder()
+	proxy.UptimeMonitorHandler.Handle(recorder, request)
+	if recorder.Code != http.StatusOK || strings.TrimSpace(recorder.Body.String()) != "app" {
+		t.Errorf("unmatched uptime monitor request in dry run answered %d %q, want it proxied", recorder.Code, recorder.Body.String())
+	}
+}
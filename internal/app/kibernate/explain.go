@@ -0,0 +1,125 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+type Explanation struct {
+	Method        string           `json:"method"`
+	Path          string           `json:"path"`
+	UserAgent     string           `json:"userAgent"`
+	Status        DeploymentStatus `json:"status"`
+	UptimeMonitor string           `json:"uptimeMonitor,omitempty"`
+	Activity      bool             `json:"activity"`
+	ActivityRule  string           `json:"activityRule,omitempty"`
+	WaitType      WaitType         `json:"waitType,omitempty"`
+	WaitTypeRule  string           `json:"waitTypeRule,omitempty"`
+	RuleErrors    []string         `json:"ruleErrors,omitempty"`
+	Outcome       string           `json:"outcome"`
+}
+
+func Explain(config Config, request *http.Request, status DeploymentStatus) Explanation {
+	explanation := Explanation{
+		Method:    request.Method,
+		Path:      request.URL.Path,
+		UserAgent: request.Header.Get("User-Agent"),
+		Status:    status,
+	}
+	explanation.UptimeMonitor, explanation.Outcome = ExplainUptimeMonitor(config, request, status)
+	if explanation.UptimeMonitor != "" {
+		return explanation
+	}
+	explanation.Activity, explanation.ActivityRule = ExplainActivity(config, request)
+	if status == DeploymentStatusReady {
+		explanation.Outcome = "proxied"
+		return explanation
+	}
+	explanation.WaitType, explanation.WaitTypeRule, explanation.RuleErrors = ExplainWaitType(config, request)
+	if config.HasCustomWaitTypeHandler(string(explanation.WaitType)) {
+		explanation.Outcome = fmt.Sprintf("activates the deployment and waits with handler %s", explanation.WaitType)
+	} else {
+		explanation.Outcome = fmt.Sprintf("activates the deployment and waits with wait type %s", explanation.WaitType)
+	}
+	return explanation
+}
+
+func ExplainUptimeMonitor(config Config, request *http.Request, status DeploymentStatus) (string, string) {
+	matchingRule := ""
+	for i, rule := range NewUptimeMonitorHandler(config, nil, nil).Rules {
+		if !rule.MatchesRequest(request) {
+			continue
+		}
+		name := fmt.Sprintf("uptimeMonitorRules[%d]", i)
+		if i >= len(config.UptimeMonitorRules) {
+			name = "uptimeMonitorUserAgentMatch"
+		}
+		if rule.MatchesStatus(status) {
+			return name, "answered by kibernate as uptime monitor request"
+		}
+		if matchingRule == "" {
+			matchingRule = name
+		}
+	}
+	if matchingRule == "" {
+		return "", ""
+	}
+	if status == DeploymentStatusReady {
+		return matchingRule, "proxied as uptime monitor request"
+	}
+	return matchingRule, "answered with 503 as uptime monitor request, no rule matches the status"
+}
+
+func ExplainActivity(config Config, request *http.Request) (bool, string) {
+	if len(config.ActivityRules) > 0 {
+		clientIp := ClientIp(request, config.TrustedProxyCidrs)
+		for i, rule := range config.ActivityRules {
+			if rule.Matches(request, clientIp) {
+				return rule.Outcome == ActivityRuleOutcomeInclude, fmt.Sprintf("activityRules[%d] (%s)", i, rule.Outcome)
+			}
+		}
+	}
+	if !isConsideredActivity(config.ActivityPathMatch, config.ActivityPathExclude, request.URL.Path) {
+		return false, "activityPathMatch/activityPathExclude"
+	}
+	if !isConsideredActivity(config.ActivityUserAgentMatch, config.ActivityUserAgentExclude, request.Header.Get("User-Agent")) {
+		return false, "activityUserAgentMatch/activityUserAgentExclude"
+	}
+	return true, "activityPathMatch and activityUserAgentMatch"
+}
+
+func ExplainWaitType(config Config, request *http.Request) (WaitType, string, []string) {
+	var ruleErrors []string
+	for _, rule := range config.WaitTypeRules {
+		matches, err := rule.Matches(request)
+		if err != nil {
+			ruleErrors = append(ruleErrors, fmt.Sprintf("error evaluating wait type rule '%s', skipping it: %s", rule.When, err.Error()))
+			continue
+		}
+		if matches {
+			return rule.WaitType, rule.When, ruleErrors
+		}
+	}
+	return config.DefaultWaitType, "defaultWaitType", ruleErrors
+}
+
+func isConsideredActivity(match *regexp.Regexp, exclude *regexp.Regexp, value string) bool {
+	return match != nil && match.MatchString(value) && (exclude == nil || !exclude.MatchString(value))
+}
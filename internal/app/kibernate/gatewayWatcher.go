@@ -0,0 +1,507 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"log/slog"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gatewayGroup                      = "gateway.networking.k8s.io"
+	originalBackendRefsAnnotation     = annotationPrefix + "original-backend-refs"
+	gatewayRewriteIntervalSecs        = 2
+	gatewayPathMatchExact             = "Exact"
+	gatewayPathMatchRegularExpression = "RegularExpression"
+)
+
+type HttpRouteObject struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              HttpRouteSpec `json:"spec"`
+}
+
+type HttpRouteSpec struct {
+	Hostnames []string        `json:"hostnames,omitempty"`
+	Rules     []HttpRouteRule `json:"rules,omitempty"`
+}
+
+type HttpRouteRule struct {
+	Matches     []HttpRouteMatch `json:"matches,omitempty"`
+	BackendRefs []HttpBackendRef `json:"backendRefs,omitempty"`
+}
+
+type HttpRouteMatch struct {
+	Path *HttpPathMatch `json:"path,omitempty"`
+}
+
+type HttpPathMatch struct {
+	Type  string `json:"type,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+type HttpBackendRef struct {
+	Group     string `json:"group,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+	Port      int32  `json:"port,omitempty"`
+}
+
+type gatewayRoute struct {
+	namespace  string
+	name       string
+	ruleTarget []string
+}
+
+type GatewayWatcher struct {
+	Config        Config
+	DynamicClient dynamic.Interface
+	KubeClientSet kubernetes.Interface
+	Router        *Router
+	Routes        *RouteTable
+	Logger        *slog.Logger
+	mutex         sync.Mutex
+	httpRoutes    map[string]*gatewayRoute
+}
+
+func NewGatewayWatcher(config Config, dynamicClient dynamic.Interface, clientSet kubernetes.Interface, router *Router) *GatewayWatcher {
+	if config.GatewayApiVersion == "" {
+		config.GatewayApiVersion = "v1"
+	}
+	g := &GatewayWatcher{
+		Config:        config,
+		DynamicClient: dynamicClient,
+		KubeClientSet: clientSet,
+		Router:        router,
+		Routes:        NewRouteTable(router),
+		Logger:        slog.Default().With("component", "gateway"),
+		httpRoutes:    map[string]*gatewayRoute{},
+	}
+	if config.GatewayRewriteBackendRefs {
+		newProxy := router.NewProxy
+		router.NewProxy = func(config Config) (*Proxy, error) {
+			proxy, err := newProxy(config)
+			if err != nil {
+				return nil, err
+			}
+			targetKey := gatewayBackendKey(config.Namespace, config.Service, config.ServicePort)
+			proxy.Deployment.BeforeDeactivation = func() error {
+				return g.RewriteTargetBackendRefs(targetKey)
+			}
+			return proxy, nil
+		}
+	}
+	return g
+}
+
+func gatewayBackendKey(namespace string, service string, port uint16) string {
+	return fmt.Sprintf("%s/%s:%d", namespace, service, port)
+}
+
+func (g *GatewayWatcher) Start(ctx context.Context) {
+	if g.Config.GatewayRewriteBackendRefs {
+		if g.Config.ActivityMetricsUrl == "" {
+			g.Logger.Warn("Awake targets are not proxied while backend refs are rewritten and activityMetricsUrl is not set, targets are never deactivated for being idle")
+		} else {
+			NewActivityMetricsSource(g.Config, g.Router).Start(ctx)
+		}
+		go g.ContinuouslyRewriteBackendRefs(ctx)
+	}
+	for _, namespace := range WatchedNamespaces(g.Config) {
+		namespace := namespace
+		go func() {
+			for ctx.Err() == nil {
+				err := g.ContinuouslyReconcile(ctx, namespace)
+				if err != nil && ctx.Err() == nil {
+					g.Logger.Error("Error watching HTTP routes, retrying", "namespace", namespace, "error", err)
+				}
+				sleep(ctx, 5*time.Second)
+			}
+		}()
+	}
+}
+
+func (g *GatewayWatcher) resources(namespace string) dynamic.ResourceInterface {
+	return g.DynamicClient.Resource(schema.GroupVersionResource{Group: gatewayGroup, Version: g.Config.GatewayApiVersion, Resource: "httproutes"}).Namespace(namespace)
+}
+
+func (g *GatewayWatcher) ContinuouslyReconcile(ctx context.Context, namespace string) error {
+	list, err := g.resources(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for i := range list.Items {
+		seen[list.Items[i].GetNamespace()+"/"+list.Items[i].GetName()] = true
+		g.Reconcile(ctx, &list.Items[i])
+	}
+	g.mutex.Lock()
+	for key := range g.httpRoutes {
+		if IsKeyInNamespace(key, namespace) && !seen[key] {
+			delete(g.httpRoutes, key)
+		}
+	}
+	g.mutex.Unlock()
+	g.Routes.RemoveStaleSources(namespace, seen)
+	watcher, err := g.resources(namespace).Watch(ctx, metav1.ListOptions{ResourceVersion: list.GetResourceVersion(), Watch: true})
+	if err != nil {
+		return err
+	}
+	defer watcher.Stop()
+	for event := range watcher.ResultChan() {
+		object, ok := event.Object.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		switch event.Type {
+		case watch.Deleted:
+			g.Remove(object.GetNamespace() + "/" + object.GetName())
+		case watch.Added, watch.Modified:
+			g.Reconcile(ctx, object)
+		}
+	}
+	return nil
+}
+
+func (g *GatewayWatcher) Remove(key string) {
+	g.mutex.Lock()
+	delete(g.httpRoutes, key)
+	g.mutex.Unlock()
+	g.Routes.SetBackends(key, nil)
+}
+
+func (g *GatewayWatcher) Reconcile(ctx context.Context, object *unstructured.Unstructured) {
+	key := object.GetNamespace() + "/" + object.GetName()
+	if object.GetAnnotations()[enabledAnnotation] != "true" {
+		g.Remove(key)
+		if _, ok := object.GetAnnotations()[originalBackendRefsAnnotation]; ok {
+			err := g.RestoreBackendRefs(ctx, object.GetNamespace(), object.GetName())
+			if err != nil {
+				g.Logger.Error("Error restoring HTTP route backend refs", "httpRoute", key, "error", err)
+			}
+		}
+		return
+	}
+	httpRoute, err := HttpRouteFromUnstructured(object)
+	if err != nil {
+		g.Logger.Error("Error reading HTTP route", "httpRoute", key, "error", err)
+		return
+	}
+	hostnames := httpRoute.Spec.Hostnames
+	if len(hostnames) == 0 {
+		hostnames = []string{""}
+	}
+	backends := map[string]*RoutedBackend{}
+	route := &gatewayRoute{namespace: httpRoute.Namespace, name: httpRoute.Name, ruleTarget: make([]string, len(httpRoute.Spec.Rules))}
+	for i, rule := range httpRoute.Spec.Rules {
+		if len(rule.BackendRefs) == 0 {
+			continue
+		}
+		backend, err := g.ResolveBackend(ctx, httpRoute, rule.BackendRefs[0])
+		if err != nil {
+			g.Logger.Error("Error resolving HTTP route backend", "httpRoute", key, "rule", i, "error", err)
+			continue
+		}
+		if existing, ok := backends[backend.Key]; ok {
+			backend = existing
+		} else {
+			backends[backend.Key] = backend
+		}
+		if len(rule.BackendRefs) > 1 {
+			g.Logger.Warn("HTTP route rule has several backends, only the first one is hibernated", "httpRoute", key, "rule", i, "backend", backend.Key)
+		}
+		route.ruleTarget[i] = backend.Key
+		matches := rule.Matches
+		if len(matches) == 0 {
+			matches = []HttpRouteMatch{{}}
+		}
+		for _, hostname := range hostnames {
+			for _, match := range matches {
+				pathRoute := Route{Host: strings.ToLower(hostname), PathPrefix: "/"}
+				if match.Path != nil {
+					if match.Path.Type == gatewayPathMatchRegularExpression {
+						g.Logger.Warn("Regular expression path matches are not supported, matching all paths", "httpRoute", key, "rule", i, "path", match.Path.Value)
+					} else if match.Path.Value != "" {
+						pathRoute.PathPrefix = match.Path.Value
+						pathRoute.Exact = match.Path.Type == gatewayPathMatchExact
+					}
+				}
+				backend.Routes = append(backend.Routes, pathRoute)
+			}
+		}
+	}
+	g.mutex.Lock()
+	g.httpRoutes[key] = route
+	g.mutex.Unlock()
+	g.Routes.SetBackends(key, backends)
+}
+
+func (g *GatewayWatcher) ResolveBackend(ctx context.Context, httpRoute *HttpRouteObject, backendRef HttpBackendRef) (*RoutedBackend, error) {
+	if (backendRef.Group != "" && backendRef.Group != "core") || (backendRef.Kind != "" && backendRef.Kind != "Service") {
+		return nil, fmt.Errorf("backend %s is a %s/%s, only services are supported", backendRef.Name, backendRef.Group, backendRef.Kind)
+	}
+	if backendRef.Port == 0 {
+		return nil, fmt.Errorf("backend %s has no port", backendRef.Name)
+	}
+	namespace := httpRoute.Namespace
+	if backendRef.Namespace != "" {
+		namespace = backendRef.Namespace
+	}
+	service, err := g.KubeClientSet.CoreV1().Services(namespace).Get(ctx, backendRef.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	deployment, err := FindDeploymentForService(ctx, g.KubeClientSet, namespace, service.Spec.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("service %s: %s", service.Name, err.Error())
+	}
+	config := NewTargetConfig(g.Config, namespace)
+	config.Service = service.Name
+	config.ServicePort = uint16(backendRef.Port)
+	config.Deployment = deployment
+	config.NoIdleDeactivation = config.GatewayRewriteBackendRefs && config.ActivityMetricsUrl == ""
+	err = ApplyTargetAnnotations(&config, httpRoute.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	return &RoutedBackend{
+		Key:      gatewayBackendKey(namespace, service.Name, config.ServicePort),
+		Revision: deployment + "," + AnnotationsRevision(httpRoute.Annotations),
+		Config:   config,
+	}, nil
+}
+
+func HttpRouteFromUnstructured(object *unstructured.Unstructured) (*HttpRouteObject, error) {
+	object = object.DeepCopy()
+	err := RestoreOriginalBackendRefs(object)
+	if err != nil {
+		return nil, err
+	}
+	var httpRoute HttpRouteObject
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(object.UnstructuredContent(), &httpRoute)
+	if err != nil {
+		return nil, err
+	}
+	return &httpRoute, nil
+}
+
+func RestoreOriginalBackendRefs(object *unstructured.Unstructured) error {
+	original, ok := object.GetAnnotations()[originalBackendRefsAnnotation]
+	if !ok {
+		return nil
+	}
+	var originalBackendRefs []interface{}
+	err := json.Unmarshal([]byte(original), &originalBackendRefs)
+	if err != nil {
+		return fmt.Errorf("invalid %s annotation: %s", originalBackendRefsAnnotation, err.Error())
+	}
+	rules, _, err := unstructured.NestedSlice(object.Object, "spec", "rules")
+	if err != nil {
+		return err
+	}
+	for i := range rules {
+		rule, ok := rules[i].(map[string]interface{})
+		if !ok || i >= len(originalBackendRefs) || originalBackendRefs[i] == nil {
+			continue
+		}
+		rule["backendRefs"] = originalBackendRefs[i]
+	}
+	annotations := object.GetAnnotations()
+	delete(annotations, originalBackendRefsAnnotation)
+	object.SetAnnotations(annotations)
+	return unstructured.SetNestedSlice(object.Object, rules, "spec", "rules")
+}
+
+func (g *GatewayWatcher) ContinuouslyRewriteBackendRefs(ctx context.Context) {
+	ticker := time.NewTicker(gatewayRewriteIntervalSecs * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			g.RestoreAllBackendRefs()
+			return
+		case <-ticker.C:
+		}
+		g.mutex.Lock()
+		var keys []string
+		for key := range g.httpRoutes {
+			keys = append(keys, key)
+		}
+		g.mutex.Unlock()
+		sort.Strings(keys)
+		for _, key := range keys {
+			err := g.RewriteBackendRefs(ctx, key)
+			if err != nil {
+				g.Logger.Error("Error rewriting HTTP route backend refs", "httpRoute", key, "error", err)
+			}
+		}
+	}
+}
+
+func (g *GatewayWatcher) RestoreAllBackendRefs() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	g.mutex.Lock()
+	var routes []*gatewayRoute
+	for _, route := range g.httpRoutes {
+		routes = append(routes, route)
+	}
+	g.mutex.Unlock()
+	for _, route := range routes {
+		err := g.RestoreBackendRefs(ctx, route.namespace, route.name)
+		if err != nil {
+			g.Logger.Error("Error restoring HTTP route backend refs", "httpRoute", route.namespace+"/"+route.name, "error", err)
+		}
+	}
+}
+
+func (g *GatewayWatcher) RestoreBackendRefs(ctx context.Context, namespace string, name string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		object, err := g.resources(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if _, ok := object.GetAnnotations()[originalBackendRefsAnnotation]; !ok {
+			return nil
+		}
+		err = RestoreOriginalBackendRefs(object)
+		if err != nil {
+			return err
+		}
+		_, err = g.resources(namespace).Update(ctx, object, metav1.UpdateOptions{})
+		if err == nil {
+			g.Logger.Info("Restored HTTP route backend refs", "httpRoute", namespace+"/"+name)
+		}
+		return err
+	})
+}
+
+func (g *GatewayWatcher) kibernateBackendRef(namespace string) map[string]interface{} {
+	backendRef := map[string]interface{}{
+		"name": g.Config.GatewayService,
+		"port": int64(g.Config.GatewayServicePort),
+	}
+	if namespace != g.Config.Namespace {
+		backendRef["namespace"] = g.Config.Namespace
+	}
+	return backendRef
+}
+
+func (g *GatewayWatcher) RewriteTargetBackendRefs(targetKey string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	g.mutex.Lock()
+	var keys []string
+	for key, route := range g.httpRoutes {
+		if slices.Contains(route.ruleTarget, targetKey) {
+			keys = append(keys, key)
+		}
+	}
+	g.mutex.Unlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		err := g.RewriteBackendRefs(ctx, key)
+		if err != nil {
+			g.Logger.Error("Error rewriting HTTP route backend refs before deactivation", "httpRoute", key, "target", targetKey, "error", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *GatewayWatcher) RewriteBackendRefs(ctx context.Context, key string) error {
+	g.mutex.Lock()
+	route, ok := g.httpRoutes[key]
+	g.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	asleep := make([]bool, len(route.ruleTarget))
+	anyAsleep := false
+	for i, targetKey := range route.ruleTarget {
+		target := g.Router.Target(targetKey)
+		if targetKey != "" && target != nil && (target.Proxy.Deployment.Status != DeploymentStatusReady || target.Proxy.Deployment.IsDeactivationPending()) {
+			asleep[i] = true
+			anyAsleep = true
+		}
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		object, err := g.resources(route.namespace).Get(ctx, route.name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		desired := object.DeepCopy()
+		err = RestoreOriginalBackendRefs(desired)
+		if err != nil {
+			return err
+		}
+		if anyAsleep {
+			rules, _, err := unstructured.NestedSlice(desired.Object, "spec", "rules")
+			if err != nil {
+				return err
+			}
+			originalBackendRefs := make([]interface{}, len(rules))
+			for i := range rules {
+				rule, ok := rules[i].(map[string]interface{})
+				if !ok || i >= len(asleep) || !asleep[i] {
+					continue
+				}
+				originalBackendRefs[i] = rule["backendRefs"]
+				rule["backendRefs"] = []interface{}{g.kibernateBackendRef(route.namespace)}
+			}
+			original, err := json.Marshal(originalBackendRefs)
+			if err != nil {
+				return err
+			}
+			err = unstructured.SetNestedSlice(desired.Object, rules, "spec", "rules")
+			if err != nil {
+				return err
+			}
+			annotations := desired.GetAnnotations()
+			if annotations == nil {
+				annotations = map[string]string{}
+			}
+			annotations[originalBackendRefsAnnotation] = string(original)
+			desired.SetAnnotations(annotations)
+		}
+		if reflect.DeepEqual(object.Object["spec"], desired.Object["spec"]) && reflect.DeepEqual(object.GetAnnotations(), desired.GetAnnotations()) {
+			return nil
+		}
+		_, err = g.resources(route.namespace).Update(ctx, desired, metav1.UpdateOptions{})
+		if err == nil {
+			g.Logger.Info("Rewrote HTTP route backend refs", "httpRoute", key, "toKibernate", anyAsleep)
+		}
+		return err
+	})
+}
@@ -0,0 +1,141 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"testing"
+)
+
+var testHttpRouteResource = schema.GroupVersionResource{Group: gatewayGroup, Version: "v1", Resource: "httproutes"}
+
+func newTestHttpRoute() *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": gatewayGroup + "/v1",
+		"kind":       "HTTPRoute",
+		"metadata": map[string]interface{}{
+			"namespace":   "apps",
+			"name":        "web",
+			"annotations": map[string]interface{}{enabledAnnotation: "true"},
+		},
+		"spec": map[string]interface{}{
+			"hostnames": []interface{}{"web.example.com"},
+			"rules": []interface{}{
+				map[string]interface{}{
+					"backendRefs": []interface{}{map[string]interface{}{"name": "web", "port": int64(80)}},
+				},
+			},
+		},
+	}}
+}
+
+func testHttpRouteBackend(t *testing.T, dynamicClient *dynamicfake.FakeDynamicClient) string {
+	object, err := dynamicClient.Resource(testHttpRouteResource).Namespace("apps").Get(context.Background(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting HTTP route: %v", err)
+	}
+	rules, _, _ := unstructured.NestedSlice(object.Object, "spec", "rules")
+	backendRefs, _, _ := unstructured.NestedSlice(rules[0].(map[string]interface{}), "backendRefs")
+	name, _, _ := unstructured.NestedString(backendRefs[0].(map[string]interface{}), "name")
+	return name
+}
+
+func TestGatewayRewritesBackendRefsBeforeDeactivation(t *testing.T) {
+	replicas := int32(1)
+	kubeClient := kubefake.NewSimpleClientset(
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "web"},
+			Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "web"}},
+		},
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "web"},
+			Spec: appsv1.DeploymentSpec{
+				Replicas: &replicas,
+				Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}}},
+			},
+			Status: appsv1.DeploymentStatus{Replicas: 1, ReadyReplicas: 1},
+		},
+	)
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{testHttpRouteResource: "HTTPRouteList"}, newTestHttpRoute())
+	backendWhenScaled := ""
+	kubeClient.PrependReactor("get", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		return true, &autoscalingv1.Scale{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "web"}, Spec: autoscalingv1.ScaleSpec{Replicas: 1}}, nil
+	})
+	kubeClient.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		backendWhenScaled = testHttpRouteBackend(t, dynamicClient)
+		return true, action.(k8stesting.UpdateAction).GetObject(), nil
+	})
+	config := newTestConfig()
+	config.Mode = ModeGateway
+	config.GatewayRewriteBackendRefs = true
+	config.GatewayService = "kibernate"
+	config.GatewayServicePort = 8080
+	config.Namespace = "kibernate"
+	router, err := NewRouter(config, kubeClient)
+	if err != nil {
+		t.Fatalf("creating router: %v", err)
+	}
+	g := NewGatewayWatcher(config, dynamicClient, kubeClient, router)
+	g.Reconcile(context.Background(), newTestHttpRoute())
+	target := router.Target("apps/web:80")
+	if target == nil {
+		t.Fatal("router does not serve the HTTP route backend")
+	}
+	if !target.Proxy.Config.NoIdleDeactivation {
+		t.Error("target is idle-deactivated although its activity is not observed")
+	}
+	err = g.RewriteBackendRefs(context.Background(), "apps/web")
+	if err != nil {
+		t.Fatalf("rewriting backend refs: %v", err)
+	}
+	if backend := testHttpRouteBackend(t, dynamicClient); backend != "web" {
+		t.Fatalf("backend of an awake target = %q, want web", backend)
+	}
+	err = target.Proxy.Deployment.DeactivateDeployment(DeactivationTrigger{Reason: "admin"})
+	if err != nil {
+		t.Fatalf("deactivating: %v", err)
+	}
+	if backendWhenScaled != "kibernate" {
+		t.Errorf("backend when scaling to 0 = %q, want kibernate", backendWhenScaled)
+	}
+	if target.Proxy.Deployment.Status != DeploymentStatusDeactivating || target.Proxy.Deployment.IsDeactivationPending() {
+		t.Errorf("status = %q, deactivation pending = %v, want deactivating and not pending", target.Proxy.Deployment.Status, target.Proxy.Deployment.IsDeactivationPending())
+	}
+	err = g.RewriteBackendRefs(context.Background(), "apps/web")
+	if err != nil {
+		t.Fatalf("rewriting backend refs: %v", err)
+	}
+	if backend := testHttpRouteBackend(t, dynamicClient); backend != "kibernate" {
+		t.Errorf("backend of a deactivating target = %q, want kibernate", backend)
+	}
+}
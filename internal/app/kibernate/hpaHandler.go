@@ -0,0 +1,228 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type HpaMode string
+
+const (
+	HpaModeAnnotate HpaMode = "annotate"
+	HpaModePatch            = "patch"
+)
+
+const (
+	hpaHibernatedAnnotation          = "kibernate.io/hibernated"
+	hpaOriginalMinReplicasAnnotation = "kibernate.io/original-min-replicas"
+)
+
+var ErrHibernationBlocked = errors.New("hibernation is blocked by a horizontal pod autoscaler")
+
+type HpaStatus struct {
+	Name        string  `json:"name,omitempty"`
+	Mode        HpaMode `json:"mode"`
+	MinReplicas int32   `json:"minReplicas,omitempty"`
+	Hibernated  bool    `json:"hibernated"`
+	Blocked     string  `json:"blocked,omitempty"`
+	LastError   string  `json:"lastError,omitempty"`
+}
+
+type HpaHandler struct {
+	Config        Config
+	KubeClientSet kubernetes.Interface
+	Workload      *WorkloadHandler
+	Logger        *slog.Logger
+	status        HpaStatus
+	statusMutex   sync.Mutex
+}
+
+func NewHpaHandler(config Config, clientSet kubernetes.Interface, workload *WorkloadHandler) *HpaHandler {
+	h := &HpaHandler{
+		Config:        config,
+		KubeClientSet: clientSet,
+		Workload:      workload,
+		Logger:        TargetLogger(config).With("component", "hpa"),
+	}
+	if h.Config.HpaMode == "" {
+		h.Config.HpaMode = HpaModeAnnotate
+	}
+	h.status.Mode = h.Config.HpaMode
+	return h
+}
+
+func (h *HpaHandler) GetStatus() HpaStatus {
+	h.statusMutex.Lock()
+	defer h.statusMutex.Unlock()
+	return h.status
+}
+
+func (h *HpaHandler) setStatus(update func(status *HpaStatus)) {
+	h.statusMutex.Lock()
+	defer h.statusMutex.Unlock()
+	update(&h.status)
+}
+
+func (h *HpaHandler) Find() (*autoscalingv2.HorizontalPodAutoscaler, error) {
+	hpaList, err := h.KubeClientSet.AutoscalingV2().HorizontalPodAutoscalers(h.Workload.Namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var matches []autoscalingv2.HorizontalPodAutoscaler
+	for _, hpa := range hpaList.Items {
+		if strings.EqualFold(hpa.Spec.ScaleTargetRef.Kind, string(h.Workload.Kind)) && hpa.Spec.ScaleTargetRef.Name == h.Workload.Name {
+			matches = append(matches, hpa)
+		}
+	}
+	if len(matches) > 1 {
+		return nil, fmt.Errorf("%w: %d autoscalers target %s", ErrHibernationBlocked, len(matches), h.Workload)
+	}
+	if len(matches) == 0 {
+		h.setStatus(func(status *HpaStatus) {
+			*status = HpaStatus{Mode: h.Config.HpaMode}
+		})
+		return nil, nil
+	}
+	hpa := &matches[0]
+	h.setStatus(func(status *HpaStatus) {
+		status.Name = hpa.Name
+		status.Hibernated = hpa.Annotations[hpaHibernatedAnnotation] == "true"
+		if hpa.Spec.MinReplicas != nil {
+			status.MinReplicas = *hpa.Spec.MinReplicas
+		}
+	})
+	return hpa, nil
+}
+
+func (h *HpaHandler) Detect() {
+	hpa, err := h.Find()
+	if errors.Is(err, ErrHibernationBlocked) {
+		_ = h.block(err.Error())
+		return
+	}
+	if err != nil {
+		h.Logger.Warn("Error looking up horizontal pod autoscalers, assuming there is none", "error", err)
+		h.setStatus(func(status *HpaStatus) { status.LastError = err.Error() })
+		return
+	}
+	if hpa != nil {
+		h.Logger.Info("Workload is targeted by a horizontal pod autoscaler", "hpa", hpa.Name, "mode", h.Config.HpaMode)
+	}
+}
+
+func (h *HpaHandler) PrepareDeactivation() error {
+	hpa, err := h.Find()
+	if errors.Is(err, ErrHibernationBlocked) {
+		return h.block(err.Error())
+	}
+	if err != nil {
+		h.Logger.Warn("Error looking up horizontal pod autoscalers, assuming there is none", "error", err)
+		h.setStatus(func(status *HpaStatus) { status.LastError = err.Error() })
+		return nil
+	}
+	if hpa == nil {
+		return nil
+	}
+	if hpa.Annotations == nil {
+		hpa.Annotations = map[string]string{}
+	}
+	hpa.Annotations[hpaHibernatedAnnotation] = "true"
+	if h.Config.HpaMode == HpaModePatch {
+		if _, ok := hpa.Annotations[hpaOriginalMinReplicasAnnotation]; !ok {
+			minReplicas := int32(1)
+			if hpa.Spec.MinReplicas != nil {
+				minReplicas = *hpa.Spec.MinReplicas
+			}
+			hpa.Annotations[hpaOriginalMinReplicasAnnotation] = strconv.Itoa(int(minReplicas))
+		}
+		zero := int32(0)
+		hpa.Spec.MinReplicas = &zero
+	}
+	_, err = h.KubeClientSet.AutoscalingV2().HorizontalPodAutoscalers(hpa.Namespace).Update(context.TODO(), hpa, metav1.UpdateOptions{})
+	if apierrors.IsInvalid(err) && h.Config.HpaMode == HpaModePatch {
+		return h.block(fmt.Sprintf("autoscaler %s rejected minReplicas 0, is the HPAScaleToZero feature gate enabled? %s", hpa.Name, err.Error()))
+	}
+	if err != nil {
+		h.setStatus(func(status *HpaStatus) { status.LastError = err.Error() })
+		return err
+	}
+	h.Logger.Info("Prepared horizontal pod autoscaler for hibernation", "hpa", hpa.Name, "mode", h.Config.HpaMode)
+	h.setStatus(func(status *HpaStatus) {
+		status.Hibernated = true
+		status.Blocked = ""
+		status.LastError = ""
+	})
+	return nil
+}
+
+func (h *HpaHandler) block(reason string) error {
+	if h.GetStatus().Blocked != reason {
+		h.Logger.Warn("Hibernation is impossible", "reason", reason)
+	}
+	h.setStatus(func(status *HpaStatus) { status.Blocked = reason })
+	return ErrHibernationBlocked
+}
+
+func (h *HpaHandler) RestoreForActivation() error {
+	hpa, err := h.Find()
+	if errors.Is(err, ErrHibernationBlocked) {
+		return nil
+	}
+	if err != nil {
+		h.Logger.Warn("Error looking up horizontal pod autoscalers, assuming there is none", "error", err)
+		h.setStatus(func(status *HpaStatus) { status.LastError = err.Error() })
+		return nil
+	}
+	if hpa == nil || (hpa.Annotations[hpaHibernatedAnnotation] == "" && hpa.Annotations[hpaOriginalMinReplicasAnnotation] == "") {
+		return nil
+	}
+	if originalMinReplicas, ok := hpa.Annotations[hpaOriginalMinReplicasAnnotation]; ok {
+		minReplicas, err := strconv.Atoi(originalMinReplicas)
+		if err != nil {
+			return fmt.Errorf("invalid %s annotation on autoscaler %s: %s", hpaOriginalMinReplicasAnnotation, hpa.Name, err.Error())
+		}
+		restored := int32(minReplicas)
+		hpa.Spec.MinReplicas = &restored
+	}
+	delete(hpa.Annotations, hpaHibernatedAnnotation)
+	delete(hpa.Annotations, hpaOriginalMinReplicasAnnotation)
+	_, err = h.KubeClientSet.AutoscalingV2().HorizontalPodAutoscalers(hpa.Namespace).Update(context.TODO(), hpa, metav1.UpdateOptions{})
+	if err != nil {
+		h.setStatus(func(status *HpaStatus) { status.LastError = err.Error() })
+		return err
+	}
+	h.Logger.Info("Restored horizontal pod autoscaler after hibernation", "hpa", hpa.Name)
+	h.setStatus(func(status *HpaStatus) {
+		status.Hibernated = false
+		status.LastError = ""
+		if hpa.Spec.MinReplicas != nil {
+			status.MinReplicas = *hpa.Spec.MinReplicas
+		}
+	})
+	return nil
+}
@@ -0,0 +1,158 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"context"
+	"errors"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"testing"
+)
+
+func newTestHpa(name string, kind string, target string, minReplicas int32) *autoscalingv2.HorizontalPodAutoscaler {
+	return &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: name},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{Kind: kind, Name: target},
+			MinReplicas:    &minReplicas,
+			MaxReplicas:    10,
+		},
+	}
+}
+
+func newTestHpaHandler(mode HpaMode, objects ...runtime.Object) (*HpaHandler, *kubefake.Clientset) {
+	client := kubefake.NewSimpleClientset(objects...)
+	workload := &WorkloadHandler{Namespace: "apps", Kind: WorkloadKindDeployment, Name: "web", KubeClientSet: client}
+	return NewHpaHandler(Config{Namespace: "apps", Deployment: "web", HpaMode: mode}, client, workload), client
+}
+
+func getTestHpa(t *testing.T, client *kubefake.Clientset, name string) *autoscalingv2.HorizontalPodAutoscaler {
+	hpa, err := client.AutoscalingV2().HorizontalPodAutoscalers("apps").Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting autoscaler %s: %v", name, err)
+	}
+	return hpa
+}
+
+func TestHpaHandlerPreparesAndRestores(t *testing.T) {
+	tests := []struct {
+		mode                    HpaMode
+		hibernatedMinReplicas   int32
+		hibernatedOriginalValue string
+	}{
+		{mode: HpaModeAnnotate, hibernatedMinReplicas: 2},
+		{mode: HpaModePatch, hibernatedMinReplicas: 0, hibernatedOriginalValue: "2"},
+	}
+	for _, test := range tests {
+		t.Run(string(test.mode), func(t *testing.T) {
+			h, client := newTestHpaHandler(test.mode, newTestHpa("web", "Deployment", "web", 2), newTestHpa("worker", "Deployment", "worker", 3))
+			if err := h.PrepareDeactivation(); err != nil {
+				t.Fatalf("preparing deactivation: %v", err)
+			}
+			hpa := getTestHpa(t, client, "web")
+			if hpa.Annotations[hpaHibernatedAnnotation] != "true" {
+				t.Error("autoscaler is not annotated as hibernated")
+			}
+			if *hpa.Spec.MinReplicas != test.hibernatedMinReplicas {
+				t.Errorf("got minReplicas %d while hibernated, want %d", *hpa.Spec.MinReplicas, test.hibernatedMinReplicas)
+			}
+			if hpa.Annotations[hpaOriginalMinReplicasAnnotation] != test.hibernatedOriginalValue {
+				t.Errorf("got original minReplicas annotation %q, want %q", hpa.Annotations[hpaOriginalMinReplicasAnnotation], test.hibernatedOriginalValue)
+			}
+			if status := h.GetStatus(); !status.Hibernated || status.Name != "web" {
+				t.Errorf("got status %+v, want hibernated autoscaler web", status)
+			}
+			if other := getTestHpa(t, client, "worker"); len(other.Annotations) > 0 || *other.Spec.MinReplicas != 3 {
+				t.Error("autoscaler of another workload was changed")
+			}
+			if err := h.RestoreForActivation(); err != nil {
+				t.Fatalf("restoring for activation: %v", err)
+			}
+			hpa = getTestHpa(t, client, "web")
+			if len(hpa.Annotations) > 0 || *hpa.Spec.MinReplicas != 2 {
+				t.Errorf("got annotations %v and minReplicas %d after restore, want none and 2", hpa.Annotations, *hpa.Spec.MinReplicas)
+			}
+			if status := h.GetStatus(); status.Hibernated || status.MinReplicas != 2 {
+				t.Errorf("got status %+v, want restored autoscaler with minReplicas 2", status)
+			}
+		})
+	}
+}
+
+func TestHpaHandlerKeepsOriginalMinReplicasAcrossRepeatedDeactivations(t *testing.T) {
+	h, client := newTestHpaHandler(HpaModePatch, newTestHpa("web", "Deployment", "web", 2))
+	for i := 0; i < 2; i++ {
+		if err := h.PrepareDeactivation(); err != nil {
+			t.Fatalf("preparing deactivation: %v", err)
+		}
+	}
+	if err := h.RestoreForActivation(); err != nil {
+		t.Fatalf("restoring for activation: %v", err)
+	}
+	if hpa := getTestHpa(t, client, "web"); *hpa.Spec.MinReplicas != 2 {
+		t.Errorf("got minReplicas %d after restore, want 2", *hpa.Spec.MinReplicas)
+	}
+}
+
+func TestHpaHandlerWithoutAutoscaler(t *testing.T) {
+	h, _ := newTestHpaHandler(HpaModePatch, newTestHpa("worker", "Deployment", "worker", 3))
+	if err := h.PrepareDeactivation(); err != nil {
+		t.Errorf("preparing deactivation: %v", err)
+	}
+	if err := h.RestoreForActivation(); err != nil {
+		t.Errorf("restoring for activation: %v", err)
+	}
+	if status := h.GetStatus(); status.Name != "" || status.Hibernated || status.Blocked != "" {
+		t.Errorf("got status %+v, want no autoscaler", status)
+	}
+}
+
+func TestHpaHandlerBlocksHibernation(t *testing.T) {
+	t.Run("multiple autoscalers", func(t *testing.T) {
+		h, _ := newTestHpaHandler(HpaModeAnnotate, newTestHpa("web", "Deployment", "web", 2), newTestHpa("web-extra", "deployment", "web", 1))
+		if err := h.PrepareDeactivation(); !errors.Is(err, ErrHibernationBlocked) {
+			t.Fatalf("got %v, want %v", err, ErrHibernationBlocked)
+		}
+		if h.GetStatus().Blocked == "" {
+			t.Error("blocked reason is not reported")
+		}
+		if err := h.RestoreForActivation(); err != nil {
+			t.Errorf("restoring for activation: %v", err)
+		}
+	})
+	t.Run("scale to zero rejected", func(t *testing.T) {
+		h, client := newTestHpaHandler(HpaModePatch, newTestHpa("web", "Deployment", "web", 2))
+		client.PrependReactor("update", "horizontalpodautoscalers", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, apierrors.NewInvalid(schema.GroupKind{Group: "autoscaling", Kind: "HorizontalPodAutoscaler"}, "web", field.ErrorList{
+				field.Invalid(field.NewPath("spec", "minReplicas"), 0, "must be greater than or equal to 1"),
+			})
+		})
+		if err := h.PrepareDeactivation(); !errors.Is(err, ErrHibernationBlocked) {
+			t.Fatalf("got %v, want %v", err, ErrHibernationBlocked)
+		}
+		if status := h.GetStatus(); status.Blocked == "" || status.Hibernated {
+			t.Errorf("got status %+v, want blocked and not hibernated", status)
+		}
+	})
+}
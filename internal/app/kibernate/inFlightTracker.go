@@ -0,0 +1,105 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type InFlightTracker struct {
+	mutex       sync.Mutex
+	count       int
+	drainDone   chan struct{}
+	drainFailed bool
+}
+
+func NewInFlightTracker() *InFlightTracker {
+	return &InFlightTracker{}
+}
+
+func (t *InFlightTracker) Begin(ctx context.Context) bool {
+	for {
+		t.mutex.Lock()
+		if t.drainDone == nil {
+			t.count++
+			t.mutex.Unlock()
+			return true
+		}
+		drainDone := t.drainDone
+		t.mutex.Unlock()
+		select {
+		case <-drainDone:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (t *InFlightTracker) End() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.count--
+}
+
+func (t *InFlightTracker) Count() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.count
+}
+
+func (t *InFlightTracker) IsDraining() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.drainDone != nil
+}
+
+func (t *InFlightTracker) IsDrainPostponed() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.drainFailed && t.count == 0 {
+		t.drainFailed = false
+	}
+	return t.drainFailed
+}
+
+func (t *InFlightTracker) Drain(timeout time.Duration, then func() error) (bool, error) {
+	if t.IsDrainPostponed() {
+		return false, nil
+	}
+	t.mutex.Lock()
+	t.drainDone = make(chan struct{})
+	t.mutex.Unlock()
+	defer func() {
+		t.mutex.Lock()
+		close(t.drainDone)
+		t.drainDone = nil
+		t.mutex.Unlock()
+	}()
+	deadline := time.Now().Add(timeout)
+	for t.Count() > 0 {
+		if time.Now().After(deadline) {
+			t.mutex.Lock()
+			t.drainFailed = true
+			t.mutex.Unlock()
+			return false, nil
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	return true, then()
+}
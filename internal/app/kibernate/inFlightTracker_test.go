@@ -0,0 +1,135 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestInFlightTrackerDrainsBeforeDeactivating(t *testing.T) {
+	tracker := NewInFlightTracker()
+	tracker.Begin(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		tracker.End()
+	}()
+	called := false
+	drained, err := tracker.Drain(5*time.Second, func() error {
+		called = true
+		if tracker.Count() != 0 {
+			t.Errorf("deactivating with %d requests in flight", tracker.Count())
+		}
+		return nil
+	})
+	if !drained || err != nil || !called {
+		t.Errorf("got drained %v, err %v, called %v, want drained and deactivated", drained, err, called)
+	}
+	if tracker.IsDraining() {
+		t.Error("still draining after drain finished")
+	}
+}
+
+func TestInFlightTrackerReturnsDeactivationError(t *testing.T) {
+	tracker := NewInFlightTracker()
+	want := errors.New("scaling failed")
+	drained, err := tracker.Drain(time.Second, func() error {
+		return want
+	})
+	if !drained || !errors.Is(err, want) {
+		t.Errorf("got drained %v, err %v, want drained with %v", drained, err, want)
+	}
+}
+
+func TestInFlightTrackerPostponesAfterDrainTimeout(t *testing.T) {
+	tracker := NewInFlightTracker()
+	tracker.Begin(context.Background())
+	drained, err := tracker.Drain(100*time.Millisecond, func() error {
+		t.Error("deactivated although a request was still in flight")
+		return nil
+	})
+	if drained || err != nil {
+		t.Errorf("got drained %v, err %v, want not drained", drained, err)
+	}
+	if !tracker.IsDrainPostponed() {
+		t.Fatal("drain is not postponed after timing out")
+	}
+	drained, _ = tracker.Drain(time.Second, func() error {
+		t.Error("deactivated while the drain was postponed")
+		return nil
+	})
+	if drained {
+		t.Error("drained while the drain was postponed")
+	}
+	tracker.End()
+	if tracker.IsDrainPostponed() {
+		t.Error("drain is still postponed with no requests in flight")
+	}
+}
+
+func TestInFlightTrackerHoldsNewRequestsWhileDraining(t *testing.T) {
+	tracker := NewInFlightTracker()
+	deactivating := make(chan struct{})
+	release := make(chan struct{})
+	go tracker.Drain(time.Second, func() error {
+		close(deactivating)
+		<-release
+		return nil
+	})
+	<-deactivating
+	begun := make(chan bool, 1)
+	go func() {
+		begun <- tracker.Begin(context.Background())
+	}()
+	select {
+	case <-begun:
+		t.Fatal("request began while draining")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case ok := <-begun:
+		if !ok || tracker.Count() != 1 {
+			t.Errorf("got begun %v with %d in flight, want the held request to begin", ok, tracker.Count())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("held request did not begin after the drain finished")
+	}
+}
+
+func TestInFlightTrackerGivesUpOnCancelledRequestsWhileDraining(t *testing.T) {
+	tracker := NewInFlightTracker()
+	deactivating := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	go tracker.Drain(time.Second, func() error {
+		close(deactivating)
+		<-release
+		return nil
+	})
+	<-deactivating
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if tracker.Begin(ctx) {
+		t.Error("cancelled request began while draining")
+	}
+	if tracker.Count() != 0 {
+		t.Errorf("got %d in flight, want 0", tracker.Count())
+	}
+}
@@ -0,0 +1,199 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"context"
+	"fmt"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+type IngressWatcher struct {
+	Config        Config
+	KubeClientSet kubernetes.Interface
+	Router        *Router
+	Routes        *RouteTable
+	Logger        *slog.Logger
+}
+
+func NewIngressWatcher(config Config, clientSet kubernetes.Interface, router *Router) *IngressWatcher {
+	return &IngressWatcher{
+		Config:        config,
+		KubeClientSet: clientSet,
+		Router:        router,
+		Routes:        NewRouteTable(router),
+		Logger:        slog.Default().With("component", "ingress"),
+	}
+}
+
+func (w *IngressWatcher) Start(ctx context.Context) {
+	if w.Config.ActivityMetricsUrl == "" {
+		w.Logger.Warn("Awake targets are not proxied in ingress mode and activityMetricsUrl is not set, targets are never deactivated for being idle")
+	} else {
+		NewActivityMetricsSource(w.Config, w.Router).Start(ctx)
+	}
+	for _, namespace := range WatchedNamespaces(w.Config) {
+		namespace := namespace
+		go func() {
+			for ctx.Err() == nil {
+				err := w.ContinuouslyReconcile(ctx, namespace)
+				if err != nil && ctx.Err() == nil {
+					w.Logger.Error("Error watching ingresses, retrying", "namespace", namespace, "error", err)
+				}
+				sleep(ctx, 5*time.Second)
+			}
+		}()
+	}
+}
+
+func (w *IngressWatcher) ContinuouslyReconcile(ctx context.Context, namespace string) error {
+	ingresses, err := w.KubeClientSet.NetworkingV1().Ingresses(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for i := range ingresses.Items {
+		seen[ingresses.Items[i].Namespace+"/"+ingresses.Items[i].Name] = true
+		w.Reconcile(ctx, &ingresses.Items[i])
+	}
+	w.Routes.RemoveStaleSources(namespace, seen)
+	watcher, err := w.KubeClientSet.NetworkingV1().Ingresses(namespace).Watch(ctx, metav1.ListOptions{
+		ResourceVersion: ingresses.ResourceVersion,
+		Watch:           true,
+	})
+	if err != nil {
+		return err
+	}
+	defer watcher.Stop()
+	for event := range watcher.ResultChan() {
+		ingress, ok := event.Object.(*networkingv1.Ingress)
+		if !ok {
+			continue
+		}
+		switch event.Type {
+		case watch.Deleted:
+			w.Routes.SetBackends(ingress.Namespace+"/"+ingress.Name, nil)
+		case watch.Added, watch.Modified:
+			w.Reconcile(ctx, ingress)
+		}
+	}
+	return nil
+}
+
+func (w *IngressWatcher) Reconcile(ctx context.Context, ingress *networkingv1.Ingress) {
+	key := ingress.Namespace + "/" + ingress.Name
+	if ingress.Annotations[enabledAnnotation] != "true" {
+		w.Routes.SetBackends(key, nil)
+		return
+	}
+	backends := map[string]*RoutedBackend{}
+	addRoute := func(serviceBackend *networkingv1.IngressServiceBackend, route Route) {
+		if serviceBackend == nil {
+			return
+		}
+		backend, err := w.ResolveBackend(ctx, ingress, serviceBackend)
+		if err != nil {
+			w.Logger.Error("Error resolving ingress backend", "ingress", key, "service", serviceBackend.Name, "error", err)
+			return
+		}
+		if existing, ok := backends[backend.Key]; ok {
+			backend = existing
+		} else {
+			backends[backend.Key] = backend
+		}
+		backend.Routes = append(backend.Routes, route)
+	}
+	if ingress.Spec.DefaultBackend != nil {
+		addRoute(ingress.Spec.DefaultBackend.Service, Route{})
+	}
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			route := Route{Host: strings.ToLower(rule.Host), PathPrefix: path.Path}
+			if path.PathType != nil && *path.PathType == networkingv1.PathTypeExact {
+				route.Exact = true
+			}
+			addRoute(path.Backend.Service, route)
+		}
+	}
+	w.Routes.SetBackends(key, backends)
+}
+
+func (w *IngressWatcher) ResolveBackend(ctx context.Context, ingress *networkingv1.Ingress, serviceBackend *networkingv1.IngressServiceBackend) (*RoutedBackend, error) {
+	service, err := w.KubeClientSet.CoreV1().Services(ingress.Namespace).Get(ctx, serviceBackend.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	port := uint16(serviceBackend.Port.Number)
+	if serviceBackend.Port.Name != "" {
+		for _, servicePort := range service.Spec.Ports {
+			if servicePort.Name == serviceBackend.Port.Name {
+				port = uint16(servicePort.Port)
+			}
+		}
+	}
+	if port == 0 {
+		return nil, fmt.Errorf("service %s has no port %s", service.Name, serviceBackend.Port.Name)
+	}
+	deployment, err := FindDeploymentForService(ctx, w.KubeClientSet, ingress.Namespace, service.Spec.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("service %s: %s", service.Name, err.Error())
+	}
+	config := NewTargetConfig(w.Config, ingress.Namespace)
+	config.Service = service.Name
+	config.ServicePort = port
+	config.Deployment = deployment
+	config.NoIdleDeactivation = config.ActivityMetricsUrl == ""
+	err = ApplyTargetAnnotations(&config, ingress.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	return &RoutedBackend{
+		Key:      fmt.Sprintf("%s/%s:%d", ingress.Namespace, service.Name, port),
+		Revision: deployment + "," + AnnotationsRevision(ingress.Annotations),
+		Config:   config,
+	}, nil
+}
+
+func FindDeploymentForService(ctx context.Context, clientSet kubernetes.Interface, namespace string, selector map[string]string) (string, error) {
+	if len(selector) == 0 {
+		return "", fmt.Errorf("service has no selector")
+	}
+	deployments, err := clientSet.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return "", err
+	}
+	var matches []string
+	for _, deployment := range deployments.Items {
+		if labels.SelectorFromSet(selector).Matches(labels.Set(deployment.Spec.Template.Labels)) {
+			matches = append(matches, deployment.Name)
+		}
+	}
+	if len(matches) != 1 {
+		return "", fmt.Errorf("selector %s matches %d deployments, expected exactly one", labels.SelectorFromSet(selector), len(matches))
+	}
+	return matches[0], nil
+}
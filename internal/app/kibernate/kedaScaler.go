@@ -0,0 +1,140 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"context"
+	"fmt"
+	"github.com/kibernate/kibernate/internal/pkg/externalscaler"
+	"google.golang.org/grpc"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+type ScalingMode string
+
+const (
+	ScalingModeDirect ScalingMode = "direct"
+	ScalingModeKeda               = "keda"
+)
+
+const kedaMetricName = "kibernate-active"
+
+type KedaScaler struct {
+	externalscaler.UnimplementedExternalScalerServer
+	Config     Config
+	GrpcServer *grpc.Server
+	Logger     *slog.Logger
+	mutex      sync.Mutex
+	active     bool
+	streams    map[chan struct{}]struct{}
+}
+
+func NewKedaScaler(config Config, active bool) *KedaScaler {
+	k := &KedaScaler{
+		Config:  config,
+		Logger:  TargetLogger(config).With("component", "keda"),
+		active:  active,
+		streams: map[chan struct{}]struct{}{},
+	}
+	k.GrpcServer = grpc.NewServer()
+	externalscaler.RegisterExternalScalerServer(k.GrpcServer, k)
+	return k
+}
+
+func (k *KedaScaler) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", k.Config.KedaListenPort))
+	if err != nil {
+		return err
+	}
+	k.Logger.Info("Starting KEDA external scaler", "port", k.Config.KedaListenPort)
+	go func() {
+		<-ctx.Done()
+		k.GrpcServer.Stop()
+	}()
+	return k.GrpcServer.Serve(listener)
+}
+
+func (k *KedaScaler) IsActiveState() bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.active
+}
+
+func (k *KedaScaler) SetActive(active bool) bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.active == active {
+		return false
+	}
+	k.active = active
+	k.Logger.Info("Pushing activity state to KEDA", "active", active, "streams", len(k.streams))
+	for stream := range k.streams {
+		select {
+		case stream <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+func (k *KedaScaler) IsActive(ctx context.Context, ref *externalscaler.ScaledObjectRef) (*externalscaler.IsActiveResponse, error) {
+	return &externalscaler.IsActiveResponse{Result: k.IsActiveState()}, nil
+}
+
+func (k *KedaScaler) StreamIsActive(ref *externalscaler.ScaledObjectRef, server externalscaler.ExternalScaler_StreamIsActiveServer) error {
+	k.Logger.Debug("KEDA subscribed to activity state", "scaledObject", ref.Namespace+"/"+ref.Name)
+	stream := make(chan struct{}, 1)
+	k.mutex.Lock()
+	k.streams[stream] = struct{}{}
+	active := k.active
+	k.mutex.Unlock()
+	defer func() {
+		k.mutex.Lock()
+		delete(k.streams, stream)
+		k.mutex.Unlock()
+	}()
+	for {
+		err := server.Send(&externalscaler.IsActiveResponse{Result: active})
+		if err != nil {
+			return err
+		}
+		select {
+		case <-server.Context().Done():
+			return nil
+		case <-stream:
+			active = k.IsActiveState()
+		}
+	}
+}
+
+func (k *KedaScaler) GetMetricSpec(ctx context.Context, ref *externalscaler.ScaledObjectRef) (*externalscaler.GetMetricSpecResponse, error) {
+	return &externalscaler.GetMetricSpecResponse{
+		MetricSpecs: []*externalscaler.MetricSpec{{MetricName: kedaMetricName, TargetSize: 1}},
+	}, nil
+}
+
+func (k *KedaScaler) GetMetrics(ctx context.Context, request *externalscaler.GetMetricsRequest) (*externalscaler.GetMetricsResponse, error) {
+	value := int64(0)
+	if k.IsActiveState() {
+		value = 1
+	}
+	return &externalscaler.GetMetricsResponse{
+		MetricValues: []*externalscaler.MetricValue{{MetricName: kedaMetricName, MetricValue: value}},
+	}, nil
+}
@@ -0,0 +1,79 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"context"
+	"github.com/kibernate/kibernate/internal/pkg/externalscaler"
+	"google.golang.org/grpc"
+	"testing"
+	"time"
+)
+
+type testActiveStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent chan bool
+}
+
+func (s *testActiveStream) Send(response *externalscaler.IsActiveResponse) error {
+	s.sent <- response.Result
+	return nil
+}
+
+func (s *testActiveStream) Context() context.Context {
+	return s.ctx
+}
+
+func receiveActive(t *testing.T, stream *testActiveStream) bool {
+	select {
+	case active := <-stream.sent:
+		return active
+	case <-time.After(time.Second):
+		t.Fatal("no activity state was pushed")
+		return false
+	}
+}
+
+func TestKedaScalerPushesLatestActivityState(t *testing.T) {
+	k := NewKedaScaler(Config{Namespace: "apps", Deployment: "web"}, false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &testActiveStream{ctx: ctx, sent: make(chan bool)}
+	go k.StreamIsActive(&externalscaler.ScaledObjectRef{Namespace: "apps", Name: "web"}, stream)
+	for deadline := time.Now().Add(time.Second); ; {
+		k.mutex.Lock()
+		subscribed := len(k.streams) == 1
+		k.mutex.Unlock()
+		if subscribed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream did not subscribe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !k.SetActive(true) || !k.SetActive(false) {
+		t.Fatal("activity state did not change")
+	}
+	if receiveActive(t, stream) {
+		t.Fatal("got active as initial state, want inactive")
+	}
+	if receiveActive(t, stream) {
+		t.Error("got active after flipping back to inactive, want the latest inactive state")
+	}
+}
@@ -16,7 +16,18 @@
 
 package kibernate
 
-import "log"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
 
 func NewKibernate(config Config) *Kibernate {
 	return &Kibernate{config}
@@ -26,17 +37,131 @@ type Kibernate struct {
 	Config Config
 }
 
-func (k *Kibernate) Run() error {
-	log.Println("Starting kibernate")
-	proxy, err := NewProxy(k.Config)
+func (k *Kibernate) Run(ctx context.Context) error {
+	slog.Info("Starting kibernate", "mode", k.Config.Mode)
+	shutdownTracing, err := InitTracing(k.Config)
 	if err != nil {
-		log.Printf("Error creating proxy: %s", err.Error())
+		slog.Error("Error initializing tracing", "error", err)
 		return err
 	}
-	err = proxy.Start()
+	defer func() {
+		err := shutdownTracing(context.Background())
+		if err != nil {
+			slog.Error("Error shutting down tracing", "error", err)
+		}
+	}()
+	if k.Config.Mode != "" && k.Config.Mode != ModeSingle {
+		err = k.RunRouter(ctx)
+	} else {
+		err = k.RunProxy(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("Kibernate stopped")
+	return nil
+}
+
+func (k *Kibernate) RunProxy(ctx context.Context) error {
+	clientConfig, err := rest.InClusterConfig()
+	if err != nil {
+		slog.Error("Error creating in-cluster config", "error", err)
+		return err
+	}
+	clientSet, err := kubernetes.NewForConfig(clientConfig)
+	if err != nil {
+		slog.Error("Error creating client set", "error", err)
+		return err
+	}
+	proxy, err := NewProxy(k.Config, clientSet)
+	if err != nil {
+		slog.Error("Error creating proxy", "error", err)
+		return err
+	}
+	if adminServer := k.StartAdminServer(proxy, nil); adminServer != nil {
+		defer adminServer.HttpServer.Close()
+	}
+	if proxy.Deployment.Keda != nil {
+		go func() {
+			err := proxy.Deployment.Keda.Start(ctx)
+			if err != nil {
+				slog.Error("Error starting KEDA external scaler", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+	err = proxy.Start(ctx)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Error starting proxy", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (k *Kibernate) RunRouter(ctx context.Context) error {
+	clientConfig, err := rest.InClusterConfig()
+	if err != nil {
+		slog.Error("Error creating in-cluster config", "error", err)
+		return err
+	}
+	dynamicClient, err := dynamic.NewForConfig(clientConfig)
+	if err != nil {
+		slog.Error("Error creating dynamic client", "error", err)
+		return err
+	}
+	clientSet, err := kubernetes.NewForConfig(clientConfig)
+	if err != nil {
+		slog.Error("Error creating client set", "error", err)
+		return err
+	}
+	router, err := NewRouter(k.Config, clientSet)
 	if err != nil {
-		log.Printf("Error starting proxy: %s", err.Error())
+		slog.Error("Error creating router", "error", err)
+		return err
+	}
+	switch k.Config.Mode {
+	case ModeCrd:
+		NewKibernateController(k.Config, dynamicClient, clientSet, router).Start(ctx)
+	case ModeAnnotations:
+		NewAnnotationWatcher(k.Config, clientSet, router).Start(ctx)
+	case ModeIngress:
+		NewIngressWatcher(k.Config, clientSet, router).Start(ctx)
+	case ModeGateway:
+		NewGatewayWatcher(k.Config, dynamicClient, clientSet, router).Start(ctx)
+	default:
+		return fmt.Errorf("unknown mode '%s'", k.Config.Mode)
+	}
+	if adminServer := k.StartAdminServer(nil, router); adminServer != nil {
+		defer adminServer.HttpServer.Close()
+	}
+	err = router.Start(ctx)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Error starting router", "error", err)
 		return err
 	}
 	return nil
 }
+
+func (k *Kibernate) StartAdminServer(proxy *Proxy, router *Router) *AdminServer {
+	if k.Config.AdminListenPort == 0 {
+		return nil
+	}
+	adminServer := NewAdminServer(k.Config, proxy, router)
+	go func() {
+		err := adminServer.Start()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Error starting admin server", "error", err)
+			os.Exit(1)
+		}
+	}()
+	return adminServer
+}
+
+func sleep(ctx context.Context, duration time.Duration) {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,449 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"context"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"log/slog"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	KibernateConditionProxyDeployed = "ProxyDeployed"
+	kibernateStatusIntervalSecs     = 15
+	defaultProxyImage               = "ghcr.io/kibernate/kibernate:latest"
+	defaultProxyServiceAccount      = "kibernate"
+)
+
+type kibernateReconcileResult struct {
+	generation int64
+	proxyMode  KibernateProxyMode
+	err        error
+}
+
+type KibernateController struct {
+	Config        Config
+	DynamicClient dynamic.Interface
+	KubeClientSet kubernetes.Interface
+	Router        *Router
+	Logger        *slog.Logger
+	mutex         sync.Mutex
+	results       map[string]kibernateReconcileResult
+}
+
+func NewKibernateController(config Config, dynamicClient dynamic.Interface, clientSet kubernetes.Interface, router *Router) *KibernateController {
+	return &KibernateController{
+		Config:        config,
+		DynamicClient: dynamicClient,
+		KubeClientSet: clientSet,
+		Router:        router,
+		Logger:        slog.Default().With("component", "controller"),
+		results:       map[string]kibernateReconcileResult{},
+	}
+}
+
+func WatchedNamespaces(config Config) []string {
+	if len(config.WatchNamespaces) == 0 {
+		return []string{config.Namespace}
+	}
+	var namespaces []string
+	for _, namespace := range config.WatchNamespaces {
+		if namespace == "*" {
+			return []string{metav1.NamespaceAll}
+		}
+		namespaces = append(namespaces, namespace)
+	}
+	return namespaces
+}
+
+func IsKeyInNamespace(key string, namespace string) bool {
+	return namespace == metav1.NamespaceAll || strings.HasPrefix(key, namespace+"/")
+}
+
+func (c *KibernateController) Start(ctx context.Context) {
+	for _, namespace := range WatchedNamespaces(c.Config) {
+		namespace := namespace
+		go func() {
+			for ctx.Err() == nil {
+				err := c.ContinuouslyReconcile(ctx, namespace)
+				if err != nil && ctx.Err() == nil {
+					c.Logger.Error("Error watching Kibernate resources, retrying", "namespace", namespace, "error", err)
+				}
+				sleep(ctx, 5*time.Second)
+			}
+		}()
+	}
+	go c.ContinuouslyUpdateStatus(ctx)
+}
+
+func (c *KibernateController) resources(namespace string) dynamic.ResourceInterface {
+	return c.DynamicClient.Resource(KibernateGroupVersionResource).Namespace(namespace)
+}
+
+func (c *KibernateController) listOptions() metav1.ListOptions {
+	if c.Config.ResourceName != "" {
+		return metav1.ListOptions{FieldSelector: "metadata.name=" + c.Config.ResourceName}
+	}
+	return metav1.ListOptions{}
+}
+
+func (c *KibernateController) ContinuouslyReconcile(ctx context.Context, namespace string) error {
+	list, err := c.resources(namespace).List(ctx, c.listOptions())
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for i := range list.Items {
+		seen[list.Items[i].GetNamespace()+"/"+list.Items[i].GetName()] = true
+		c.Reconcile(ctx, &list.Items[i])
+	}
+	c.mutex.Lock()
+	var stale []string
+	for key := range c.results {
+		if IsKeyInNamespace(key, namespace) && !seen[key] {
+			stale = append(stale, key)
+		}
+	}
+	c.mutex.Unlock()
+	for _, key := range stale {
+		c.Remove(key)
+	}
+	options := c.listOptions()
+	options.ResourceVersion = list.GetResourceVersion()
+	options.Watch = true
+	watcher, err := c.resources(namespace).Watch(ctx, options)
+	if err != nil {
+		return err
+	}
+	defer watcher.Stop()
+	for event := range watcher.ResultChan() {
+		object, ok := event.Object.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		switch event.Type {
+		case watch.Deleted:
+			c.Remove(object.GetNamespace() + "/" + object.GetName())
+		case watch.Added, watch.Modified:
+			c.Reconcile(ctx, object)
+		}
+	}
+	return nil
+}
+
+func (c *KibernateController) Reconcile(ctx context.Context, object *unstructured.Unstructured) {
+	k, err := KibernateObjectFromUnstructured(object)
+	if err != nil {
+		c.Logger.Error("Error reading Kibernate resource", "error", err)
+		return
+	}
+	c.mutex.Lock()
+	previous, known := c.results[k.Key()]
+	c.mutex.Unlock()
+	if known && previous.err == nil && previous.generation == k.Generation && previous.proxyMode == k.ProxyMode() {
+		return
+	}
+	result := kibernateReconcileResult{generation: k.Generation, proxyMode: k.ProxyMode()}
+	config, err := k.TargetConfig(c.Config)
+	if k.ProxyMode() != KibernateProxyModeShared && k.ProxyMode() != KibernateProxyModeDedicated {
+		err = fmt.Errorf("invalid proxy.mode '%s'", k.ProxyMode())
+	} else if err == nil && c.Config.ResourceName == "" && k.ProxyMode() == KibernateProxyModeDedicated {
+		c.Router.Remove(k.Key())
+		err = c.ReconcileDedicatedProxy(ctx, k)
+	} else if err == nil {
+		if c.Config.ResourceName == "" {
+			err = c.DeleteDedicatedProxy(ctx, k)
+		}
+		if err == nil {
+			err = c.Router.Upsert(k.Key(), k.Revision(), config, c.routes(k))
+		}
+	}
+	if err != nil {
+		c.Logger.Error("Error reconciling Kibernate resource", "resource", k.Key(), "error", err)
+	} else {
+		c.Logger.Info("Reconciled Kibernate resource", "resource", k.Key(), "proxyMode", k.ProxyMode(), "generation", k.Generation)
+	}
+	result.err = err
+	c.mutex.Lock()
+	c.results[k.Key()] = result
+	c.mutex.Unlock()
+	err = c.UpdateResourceStatus(ctx, k.Namespace, k.Name)
+	if err != nil {
+		c.Logger.Error("Error updating Kibernate resource status", "resource", k.Key(), "error", err)
+	}
+}
+
+func (c *KibernateController) routes(k *KibernateObject) []Route {
+	if c.Config.ResourceName != "" {
+		return []Route{{}}
+	}
+	return k.Routes()
+}
+
+func (c *KibernateController) Remove(key string) {
+	c.mutex.Lock()
+	delete(c.results, key)
+	c.mutex.Unlock()
+	if c.Router.Remove(key) {
+		c.Logger.Info("Kibernate resource removed, no longer serving it", "resource", key)
+	}
+}
+
+func (c *KibernateController) ContinuouslyUpdateStatus(ctx context.Context) {
+	ticker := time.NewTicker(kibernateStatusIntervalSecs * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, key := range c.Router.Keys() {
+			namespaceName := strings.SplitN(key, "/", 2)
+			if len(namespaceName) != 2 {
+				continue
+			}
+			err := c.UpdateResourceStatus(ctx, namespaceName[0], namespaceName[1])
+			if err != nil && !apierrors.IsNotFound(err) {
+				c.Logger.Error("Error updating Kibernate resource status", "resource", key, "error", err)
+			}
+		}
+	}
+}
+
+func (c *KibernateController) UpdateResourceStatus(ctx context.Context, namespace string, name string) error {
+	key := namespace + "/" + name
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		object, err := c.resources(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		k, err := KibernateObjectFromUnstructured(object)
+		if err != nil {
+			return err
+		}
+		c.mutex.Lock()
+		result, reconciled := c.results[key]
+		c.mutex.Unlock()
+		if !reconciled || result.generation != k.Generation {
+			return nil
+		}
+		if result.proxyMode == KibernateProxyModeDedicated && c.Config.ResourceName == "" {
+			k.Status.ObservedGeneration = k.Generation
+			k.Status.Proxy = k.DedicatedProxyName()
+			condition := metav1.Condition{Type: KibernateConditionProxyDeployed, Status: metav1.ConditionTrue, Reason: "Deployed", Message: "Dedicated proxy " + k.DedicatedProxyName() + " is deployed", ObservedGeneration: k.Generation}
+			if result.err != nil {
+				condition.Status, condition.Reason, condition.Message = metav1.ConditionFalse, "Failed", result.err.Error()
+			}
+			meta.SetStatusCondition(&k.Status.Conditions, condition)
+		} else {
+			if c.Config.ResourceName != "" {
+				k.Status.Proxy = k.DedicatedProxyName()
+			} else {
+				k.Status.Proxy = string(KibernateProxyModeShared)
+				meta.RemoveStatusCondition(&k.Status.Conditions, KibernateConditionProxyDeployed)
+			}
+			k.Status.SetConfigured(k.Generation, result.err)
+			if target := c.Router.Target(key); target != nil {
+				k.Status.SetDeploymentStatus(k.Generation, target.Proxy.Deployment.EffectiveStatus(), target.Proxy.LastActivity)
+			}
+		}
+		status, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&k.Status)
+		if err != nil {
+			return err
+		}
+		previous, _, _ := unstructured.NestedFieldNoCopy(object.Object, "status")
+		if reflect.DeepEqual(previous, status) {
+			return nil
+		}
+		object.Object["status"] = status
+		_, err = c.resources(namespace).UpdateStatus(ctx, object, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func (c *KibernateController) dedicatedProxyLabels(k *KibernateObject) map[string]string {
+	return map[string]string{
+		"app.kubernetes.io/name":       "kibernate",
+		"app.kubernetes.io/instance":   k.DedicatedProxyName(),
+		"app.kubernetes.io/managed-by": "kibernate",
+	}
+}
+
+func (c *KibernateController) DedicatedProxyObjects(k *KibernateObject) (*appsv1.Deployment, *corev1.Service) {
+	labels := c.dedicatedProxyLabels(k)
+	isController := true
+	objectMeta := metav1.ObjectMeta{
+		Name:      k.DedicatedProxyName(),
+		Namespace: k.Namespace,
+		Labels:    labels,
+		OwnerReferences: []metav1.OwnerReference{{
+			APIVersion: KibernateGroup + "/" + KibernateVersion,
+			Kind:       KibernateKind,
+			Name:       k.Name,
+			UID:        k.UID,
+			Controller: &isController,
+		}},
+	}
+	image := k.Spec.Proxy.Image
+	if image == "" {
+		image = c.Config.ProxyImage
+	}
+	if image == "" {
+		image = defaultProxyImage
+	}
+	serviceAccountName := k.Spec.Proxy.ServiceAccountName
+	if serviceAccountName == "" {
+		serviceAccountName = defaultProxyServiceAccount
+	}
+	args := []string{
+		"-mode=" + ModeCrd,
+		"-namespace=" + k.Namespace,
+		"-watchNamespaces=" + k.Namespace,
+		"-resourceName=" + k.Name,
+	}
+	if c.Config.DryRun {
+		args = append(args, "-dryRun")
+	}
+	args = append(args, k.Spec.Proxy.Args...)
+	replicas := int32(1)
+	deployment := &appsv1.Deployment{
+		ObjectMeta: objectMeta,
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: serviceAccountName,
+					Containers: []corev1.Container{{
+						Name:  "kibernate",
+						Image: image,
+						Args:  args,
+						Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: int32(c.Config.ListenPort)}},
+					}},
+				},
+			},
+		},
+	}
+	service := &corev1.Service{
+		ObjectMeta: objectMeta,
+		Spec: corev1.ServiceSpec{
+			Selector: labels,
+			Ports: []corev1.ServicePort{{
+				Name:       "http",
+				Port:       int32(c.Config.ListenPort),
+				TargetPort: intstr.FromString("http"),
+			}},
+		},
+	}
+	return deployment, service
+}
+
+func (c *KibernateController) isDedicatedProxyObject(objectMeta metav1.ObjectMeta, k *KibernateObject) bool {
+	return objectMeta.Labels["app.kubernetes.io/managed-by"] == "kibernate" && objectMeta.Labels["app.kubernetes.io/instance"] == k.DedicatedProxyName()
+}
+
+func (c *KibernateController) ReconcileDedicatedProxy(ctx context.Context, k *KibernateObject) error {
+	deployment, service := c.DedicatedProxyObjects(k)
+	deployments := c.KubeClientSet.AppsV1().Deployments(k.Namespace)
+	existingDeployment, err := deployments.Get(ctx, deployment.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = deployments.Create(ctx, deployment, metav1.CreateOptions{})
+		if err != nil {
+			return err
+		}
+		c.Logger.Info("Created dedicated proxy deployment", "resource", k.Key(), "deployment", deployment.Name)
+	} else if err != nil {
+		return err
+	} else if !c.isDedicatedProxyObject(existingDeployment.ObjectMeta, k) {
+		return fmt.Errorf("deployment %s already exists and is not managed by kibernate", deployment.Name)
+	} else {
+		existingDeployment.Labels = deployment.Labels
+		existingDeployment.OwnerReferences = deployment.OwnerReferences
+		existingDeployment.Spec = deployment.Spec
+		_, err = deployments.Update(ctx, existingDeployment, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+	}
+	services := c.KubeClientSet.CoreV1().Services(k.Namespace)
+	existingService, err := services.Get(ctx, service.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = services.Create(ctx, service, metav1.CreateOptions{})
+		if err != nil {
+			return err
+		}
+		c.Logger.Info("Created dedicated proxy service", "resource", k.Key(), "service", service.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !c.isDedicatedProxyObject(existingService.ObjectMeta, k) {
+		return fmt.Errorf("service %s already exists and is not managed by kibernate", service.Name)
+	}
+	existingService.Labels = service.Labels
+	existingService.OwnerReferences = service.OwnerReferences
+	existingService.Spec.Selector = service.Spec.Selector
+	existingService.Spec.Ports = service.Spec.Ports
+	_, err = services.Update(ctx, existingService, metav1.UpdateOptions{})
+	return err
+}
+
+func (c *KibernateController) DeleteDedicatedProxy(ctx context.Context, k *KibernateObject) error {
+	deployments := c.KubeClientSet.AppsV1().Deployments(k.Namespace)
+	deployment, err := deployments.Get(ctx, k.DedicatedProxyName(), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err == nil && c.isDedicatedProxyObject(deployment.ObjectMeta, k) {
+		err = deployments.Delete(ctx, deployment.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		c.Logger.Info("Deleted dedicated proxy deployment", "resource", k.Key(), "deployment", deployment.Name)
+	}
+	services := c.KubeClientSet.CoreV1().Services(k.Namespace)
+	service, err := services.Get(ctx, k.DedicatedProxyName(), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err == nil && c.isDedicatedProxyObject(service.ObjectMeta, k) {
+		err = services.Delete(ctx, service.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+type testController struct {
+	Controller    *KibernateController
+	KubeClient    *kubefake.Clientset
+	DynamicClient *dynamicfake.FakeDynamicClient
+}
+
+func newTestConfig() Config {
+	return Config{
+		Mode:             ModeCrd,
+		Namespace:        "apps",
+		ListenPort:       8080,
+		ServicePort:      80,
+		IdleTimeoutSecs:  600,
+		DefaultWaitType:  WaitTypeNone,
+		ShutdownWaitType: WaitTypeNone,
+	}
+}
+
+func newTestKibernate(proxyMode KibernateProxyMode, conditions ...metav1.Condition) *unstructured.Unstructured {
+	k := &KibernateObject{
+		TypeMeta:   metav1.TypeMeta{APIVersion: KibernateGroup + "/" + KibernateVersion, Kind: KibernateKind},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "web", Generation: 1, UID: "web-uid"},
+		Spec: KibernateSpec{
+			TargetRef: KibernateTargetRef{Name: "web"},
+			Service:   KibernateServiceRef{Name: "web"},
+			Proxy:     KibernateProxySpec{Mode: proxyMode},
+		},
+		Status: KibernateStatus{Conditions: conditions},
+	}
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(k)
+	if err != nil {
+		panic(err)
+	}
+	return &unstructured.Unstructured{Object: object}
+}
+
+func newTestController(t *testing.T, config Config, object *unstructured.Unstructured) *testController {
+	replicas := int32(1)
+	kubeClient := kubefake.NewSimpleClientset(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "web"},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+		Status:     appsv1.DeploymentStatus{Replicas: 1, ReadyReplicas: 1},
+	})
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{KibernateGroupVersionResource: KibernateKind + "List"}, object)
+	router, err := NewRouter(config, kubeClient)
+	if err != nil {
+		t.Fatalf("creating router: %v", err)
+	}
+	return &testController{
+		Controller:    NewKibernateController(config, dynamicClient, kubeClient, router),
+		KubeClient:    kubeClient,
+		DynamicClient: dynamicClient,
+	}
+}
+
+func (c *testController) status(t *testing.T) KibernateStatus {
+	object, err := c.DynamicClient.Resource(KibernateGroupVersionResource).Namespace("apps").Get(context.Background(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting Kibernate resource: %v", err)
+	}
+	k, err := KibernateObjectFromUnstructured(object)
+	if err != nil {
+		t.Fatalf("reading Kibernate resource: %v", err)
+	}
+	return k.Status
+}
+
+func TestReconcileDedicatedProxy(t *testing.T) {
+	object := newTestKibernate(KibernateProxyModeDedicated)
+	c := newTestController(t, newTestConfig(), object)
+	c.Controller.Reconcile(context.Background(), object)
+	deployment, err := c.KubeClient.AppsV1().Deployments("apps").Get(context.Background(), "kibernate-web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("dedicated proxy deployment not created: %v", err)
+	}
+	if len(deployment.OwnerReferences) != 1 || deployment.OwnerReferences[0].Name != "web" {
+		t.Errorf("dedicated proxy deployment owner references = %v, want the Kibernate resource", deployment.OwnerReferences)
+	}
+	_, err = c.KubeClient.CoreV1().Services("apps").Get(context.Background(), "kibernate-web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("dedicated proxy service not created: %v", err)
+	}
+	if c.Controller.Router.Target("apps/web") != nil {
+		t.Error("shared router serves a target with a dedicated proxy")
+	}
+	status := c.status(t)
+	if status.ObservedGeneration != 1 || status.Proxy != "kibernate-web" {
+		t.Errorf("status observedGeneration = %d, proxy = %q, want 1, kibernate-web", status.ObservedGeneration, status.Proxy)
+	}
+	if !meta.IsStatusConditionTrue(status.Conditions, KibernateConditionProxyDeployed) {
+		t.Errorf("condition %s is not true: %v", KibernateConditionProxyDeployed, status.Conditions)
+	}
+}
+
+func TestReconcileSharedProxy(t *testing.T) {
+	object := newTestKibernate(KibernateProxyModeShared, metav1.Condition{Type: KibernateConditionProxyDeployed, Status: metav1.ConditionTrue, Reason: "Deployed", LastTransitionTime: metav1.Now()})
+	c := newTestController(t, newTestConfig(), object)
+	c.Controller.Reconcile(context.Background(), object)
+	target := c.Controller.Router.Target("apps/web")
+	if target == nil {
+		t.Fatal("shared router does not serve the target")
+	}
+	if target.Revision != "1" || len(target.Routes) != 4 {
+		t.Errorf("target revision = %q, routes = %v, want 1 and the service routes", target.Revision, target.Routes)
+	}
+	status := c.status(t)
+	if status.Proxy != string(KibernateProxyModeShared) {
+		t.Errorf("status proxy = %q, want %q", status.Proxy, KibernateProxyModeShared)
+	}
+	if !meta.IsStatusConditionTrue(status.Conditions, KibernateConditionConfigured) {
+		t.Errorf("condition %s is not true: %v", KibernateConditionConfigured, status.Conditions)
+	}
+	if status.DeploymentStatus != DeploymentStatusReady || !meta.IsStatusConditionTrue(status.Conditions, KibernateConditionAwake) {
+		t.Errorf("status deploymentStatus = %q, conditions = %v, want ready and awake", status.DeploymentStatus, status.Conditions)
+	}
+	if meta.FindStatusCondition(status.Conditions, KibernateConditionProxyDeployed) != nil {
+		t.Errorf("condition %s left behind after switching to the shared proxy", KibernateConditionProxyDeployed)
+	}
+}
+
+func TestReconcileInvalidProxyMode(t *testing.T) {
+	object := newTestKibernate("sidecar")
+	c := newTestController(t, newTestConfig(), object)
+	c.Controller.Reconcile(context.Background(), object)
+	if c.Controller.Router.Target("apps/web") != nil {
+		t.Error("router serves a target with an invalid proxy mode")
+	}
+	condition := meta.FindStatusCondition(c.status(t).Conditions, KibernateConditionConfigured)
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != "InvalidSpec" {
+		t.Errorf("condition %s = %v, want false with reason InvalidSpec", KibernateConditionConfigured, condition)
+	}
+}
+
+func TestUpdateResourceStatusInDedicatedProxy(t *testing.T) {
+	object := newTestKibernate(KibernateProxyModeDedicated, metav1.Condition{Type: KibernateConditionProxyDeployed, Status: metav1.ConditionTrue, Reason: "Deployed", LastTransitionTime: metav1.Now()})
+	config := newTestConfig()
+	config.ResourceName = "web"
+	c := newTestController(t, config, object)
+	c.Controller.Reconcile(context.Background(), object)
+	if c.Controller.Router.Target("apps/web") == nil {
+		t.Fatal("dedicated proxy does not serve its target")
+	}
+	status := c.status(t)
+	if status.Proxy != "kibernate-web" {
+		t.Errorf("status proxy = %q, want kibernate-web", status.Proxy)
+	}
+	if !meta.IsStatusConditionTrue(status.Conditions, KibernateConditionProxyDeployed) {
+		t.Errorf("dedicated proxy removed the condition %s owned by the shared controller: %v", KibernateConditionProxyDeployed, status.Conditions)
+	}
+	if !meta.IsStatusConditionTrue(status.Conditions, KibernateConditionConfigured) {
+		t.Errorf("condition %s is not true: %v", KibernateConditionConfigured, status.Conditions)
+	}
+}
+
+func TestUpdateResourceStatusIgnoresUnreconciledGenerations(t *testing.T) {
+	object := newTestKibernate(KibernateProxyModeShared)
+	c := newTestController(t, newTestConfig(), object)
+	err := c.Controller.UpdateResourceStatus(context.Background(), "apps", "web")
+	if err != nil {
+		t.Fatalf("updating status: %v", err)
+	}
+	status := c.status(t)
+	if status.ObservedGeneration != 0 || len(status.Conditions) != 0 {
+		t.Errorf("status of an unreconciled resource was updated: %+v", status)
+	}
+}
@@ -0,0 +1,282 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"errors"
+	"fmt"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	KibernateGroup    = "kibernate.io"
+	KibernateVersion  = "v1alpha1"
+	KibernateKind     = "Kibernate"
+	KibernateResource = "kibernates"
+)
+
+var KibernateGroupVersionResource = schema.GroupVersionResource{Group: KibernateGroup, Version: KibernateVersion, Resource: KibernateResource}
+
+type KibernateProxyMode string
+
+const (
+	KibernateProxyModeShared    KibernateProxyMode = "shared"
+	KibernateProxyModeDedicated                    = "dedicated"
+)
+
+const (
+	KibernateConditionConfigured = "Configured"
+	KibernateConditionAsleep     = "Asleep"
+	KibernateConditionWaking     = "Waking"
+	KibernateConditionAwake      = "Awake"
+)
+
+type KibernateObject struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              KibernateSpec   `json:"spec"`
+	Status            KibernateStatus `json:"status,omitempty"`
+}
+
+type KibernateSpec struct {
+	TargetRef               KibernateTargetRef  `json:"targetRef"`
+	Service                 KibernateServiceRef `json:"service"`
+	Hosts                   []string            `json:"hosts,omitempty"`
+	Proxy                   KibernateProxySpec  `json:"proxy,omitempty"`
+	IdleTimeoutSecs         *uint16             `json:"idleTimeoutSecs,omitempty"`
+	MinUptimeSecs           *uint16             `json:"minUptimeSecs,omitempty"`
+	MaxDeactivationsPerHour *uint16             `json:"maxDeactivationsPerHour,omitempty"`
+	DrainTimeoutSecs        *uint16             `json:"drainTimeoutSecs,omitempty"`
+	IdleBackoffWindowSecs   *uint16             `json:"idleBackoffWindowSecs,omitempty"`
+	IdleBackoffMaxSecs      *uint16             `json:"idleBackoffMaxSecs,omitempty"`
+	DefaultWaitType         string              `json:"defaultWaitType,omitempty"`
+	RedirectUrl             string              `json:"redirectUrl,omitempty"`
+	LoadingConfigMap        string              `json:"loadingConfigMap,omitempty"`
+	ReadinessProbePath      string              `json:"readinessProbePath,omitempty"`
+	Dependencies            []string            `json:"dependencies,omitempty"`
+	Schedules               KibernateSchedules  `json:"schedules,omitempty"`
+	ConfigFile              `json:",inline"`
+}
+
+type KibernateTargetRef struct {
+	Kind string `json:"kind,omitempty"`
+	Name string `json:"name"`
+}
+
+type KibernateServiceRef struct {
+	Name string `json:"name"`
+	Port uint16 `json:"port,omitempty"`
+}
+
+type KibernateProxySpec struct {
+	Mode               KibernateProxyMode `json:"mode,omitempty"`
+	Image              string             `json:"image,omitempty"`
+	ServiceAccountName string             `json:"serviceAccountName,omitempty"`
+	Args               []string           `json:"args,omitempty"`
+}
+
+type KibernateSchedules struct {
+	NoDeactivationMoFrUTC string `json:"noDeactivationMoFrUTC,omitempty"`
+	NoDeactivationSatUTC  string `json:"noDeactivationSatUTC,omitempty"`
+	NoDeactivationSunUTC  string `json:"noDeactivationSunUTC,omitempty"`
+	Autostart             bool   `json:"autostart,omitempty"`
+}
+
+type KibernateStatus struct {
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	DeploymentStatus   DeploymentStatus   `json:"deploymentStatus,omitempty"`
+	LastActivity       *metav1.Time       `json:"lastActivity,omitempty"`
+	Proxy              string             `json:"proxy,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+}
+
+func KibernateObjectFromUnstructured(object *unstructured.Unstructured) (*KibernateObject, error) {
+	var k KibernateObject
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.UnstructuredContent(), &k)
+	if err != nil {
+		return nil, fmt.Errorf("error converting %s %s/%s: %s", KibernateKind, object.GetNamespace(), object.GetName(), err.Error())
+	}
+	return &k, nil
+}
+
+func (k *KibernateObject) Key() string {
+	return k.Namespace + "/" + k.Name
+}
+
+func (k *KibernateObject) ProxyMode() KibernateProxyMode {
+	if k.Spec.Proxy.Mode == "" {
+		return KibernateProxyModeShared
+	}
+	return k.Spec.Proxy.Mode
+}
+
+func (k *KibernateObject) DedicatedProxyName() string {
+	return "kibernate-" + k.Name
+}
+
+func (k *KibernateObject) Routes() []Route {
+	if len(k.Spec.Hosts) == 0 {
+		return ServiceRoutes(k.Spec.Service.Name, k.Namespace)
+	}
+	var routes []Route
+	for _, host := range k.Spec.Hosts {
+		routes = append(routes, Route{Host: strings.ToLower(host)})
+	}
+	return routes
+}
+
+func ServiceRoutes(service string, namespace string) []Route {
+	return []Route{
+		{Host: service},
+		{Host: service + "." + namespace},
+		{Host: service + "." + namespace + ".svc"},
+		{Host: service + "." + namespace + ".svc.cluster.local"},
+	}
+}
+
+func (k *KibernateObject) TargetConfig(base Config) (Config, error) {
+	config := NewTargetConfig(base, k.Namespace)
+	if k.Spec.TargetRef.Kind != "" && !strings.EqualFold(k.Spec.TargetRef.Kind, string(WorkloadKindDeployment)) {
+		return config, fmt.Errorf("targetRef.kind must be Deployment, got %s", k.Spec.TargetRef.Kind)
+	}
+	if k.Spec.TargetRef.Name == "" || k.Spec.Service.Name == "" {
+		return config, errors.New("targetRef.name and service.name must be set")
+	}
+	config.Deployment = k.Spec.TargetRef.Name
+	config.Service = k.Spec.Service.Name
+	if k.Spec.Service.Port != 0 {
+		config.ServicePort = k.Spec.Service.Port
+	}
+	if k.Spec.IdleTimeoutSecs != nil {
+		config.IdleTimeoutSecs = *k.Spec.IdleTimeoutSecs
+	}
+	if k.Spec.MinUptimeSecs != nil {
+		config.MinUptimeSecs = *k.Spec.MinUptimeSecs
+	}
+	if k.Spec.MaxDeactivationsPerHour != nil {
+		config.MaxDeactivationsPerHour = *k.Spec.MaxDeactivationsPerHour
+	}
+	if k.Spec.DrainTimeoutSecs != nil {
+		config.DrainTimeoutSecs = *k.Spec.DrainTimeoutSecs
+	}
+	if k.Spec.IdleBackoffWindowSecs != nil {
+		config.IdleBackoffWindowSecs = *k.Spec.IdleBackoffWindowSecs
+	}
+	if k.Spec.IdleBackoffMaxSecs != nil {
+		config.IdleBackoffMaxSecs = *k.Spec.IdleBackoffMaxSecs
+	}
+	if k.Spec.DefaultWaitType != "" {
+		config.DefaultWaitType = WaitType(k.Spec.DefaultWaitType)
+		if !IsValidWaitType(config.DefaultWaitType) {
+			return config, fmt.Errorf("invalid defaultWaitType '%s'", k.Spec.DefaultWaitType)
+		}
+	}
+	if k.Spec.RedirectUrl != "" {
+		config.RedirectUrl = k.Spec.RedirectUrl
+	}
+	if k.Spec.LoadingConfigMap != "" {
+		config.LoadingConfigMap = k.Spec.LoadingConfigMap
+	}
+	if k.Spec.ReadinessProbePath != "" {
+		config.ReadinessProbePath = k.Spec.ReadinessProbePath
+	}
+	for _, dependency := range k.Spec.Dependencies {
+		parsed, err := ParseDependency(dependency)
+		if err != nil {
+			return config, err
+		}
+		config.Dependencies = append(config.Dependencies, parsed)
+	}
+	for _, schedule := range []struct {
+		name   string
+		value  string
+		target *[]string
+	}{
+		{"noDeactivationMoFrUTC", k.Spec.Schedules.NoDeactivationMoFrUTC, &config.NoDeactivationMoFrFromToUTC},
+		{"noDeactivationSatUTC", k.Spec.Schedules.NoDeactivationSatUTC, &config.NoDeactivationSatFromToUTC},
+		{"noDeactivationSunUTC", k.Spec.Schedules.NoDeactivationSunUTC, &config.NoDeactivationSunFromToUTC},
+	} {
+		if schedule.value == "" {
+			continue
+		}
+		fromTo, err := ParseFromToUTC(schedule.value)
+		if err != nil {
+			return config, fmt.Errorf("schedules.%s: %s", schedule.name, err.Error())
+		}
+		*schedule.target = fromTo
+	}
+	if k.Spec.Schedules.Autostart {
+		config.NoDeactivationAutostart = true
+	}
+	err := k.Spec.ConfigFile.ApplyTo(&config)
+	if err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+func (k *KibernateObject) Revision() string {
+	return strconv.FormatInt(k.Generation, 10)
+}
+
+func (s *KibernateStatus) SetConfigured(generation int64, err error) {
+	s.ObservedGeneration = generation
+	if err != nil {
+		meta.SetStatusCondition(&s.Conditions, metav1.Condition{Type: KibernateConditionConfigured, Status: metav1.ConditionFalse, Reason: "InvalidSpec", Message: err.Error(), ObservedGeneration: generation})
+		return
+	}
+	meta.SetStatusCondition(&s.Conditions, metav1.Condition{Type: KibernateConditionConfigured, Status: metav1.ConditionTrue, Reason: "Reconciled", Message: "Target is served by kibernate", ObservedGeneration: generation})
+}
+
+func (s *KibernateStatus) SetDeploymentStatus(generation int64, status DeploymentStatus, lastActivity time.Time) {
+	if status == "" {
+		return
+	}
+	s.DeploymentStatus = status
+	if !lastActivity.IsZero() {
+		activity := metav1.NewTime(lastActivity.Truncate(time.Second))
+		s.LastActivity = &activity
+	}
+	asleep, waking, awake := metav1.ConditionFalse, metav1.ConditionFalse, metav1.ConditionFalse
+	switch status {
+	case DeploymenStatusDeactivated, DeploymentStatusDeactivating:
+		asleep = metav1.ConditionTrue
+	case DeploymentStatusActivating, DeploymentStatusPossiblyReady:
+		waking = metav1.ConditionTrue
+	case DeploymentStatusReady:
+		awake = metav1.ConditionTrue
+	}
+	reason := strings.ToUpper(string(status[:1])) + string(status[1:])
+	message := fmt.Sprintf("Deployment status is %s", status)
+	for _, condition := range []metav1.Condition{
+		{Type: KibernateConditionAsleep, Status: asleep},
+		{Type: KibernateConditionWaking, Status: waking},
+		{Type: KibernateConditionAwake, Status: awake},
+	} {
+		condition.Reason = reason
+		condition.Message = message
+		condition.ObservedGeneration = generation
+		meta.SetStatusCondition(&s.Conditions, condition)
+	}
+}
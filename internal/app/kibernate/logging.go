@@ -0,0 +1,78 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+type LogFormat string
+
+const (
+	LogFormatText LogFormat = "text"
+	LogFormatJson           = "json"
+)
+
+type contextKey string
+
+const requestLoggerContextKey contextKey = "requestLogger"
+
+func NewLogger(level string, format LogFormat, output io.Writer) (*slog.Logger, error) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level '%s'", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case LogFormatJson:
+		return slog.New(slog.NewJSONHandler(output, options)), nil
+	case LogFormatText, "":
+		return slog.New(slog.NewTextHandler(output, options)), nil
+	}
+	return nil, fmt.Errorf("invalid log format '%s'", format)
+}
+
+func TargetLogger(config Config) *slog.Logger {
+	return slog.Default().With("target", config.Namespace+"/"+config.Deployment)
+}
+
+func WithRequestLogger(request *http.Request, logger *slog.Logger) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), requestLoggerContextKey, logger))
+}
+
+func RequestLogger(request *http.Request) *slog.Logger {
+	if logger, ok := request.Context().Value(requestLoggerContextKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+func NewRequestId() string {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,145 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+type metric struct {
+	name   string
+	kind   string
+	help   string
+	values func(status StatusResponse) []metricValue
+}
+
+type metricValue struct {
+	labels string
+	value  float64
+}
+
+var metrics = []metric{
+	{
+		name: "kibernate_deployment_status",
+		kind: "gauge",
+		help: "The current status of the deployment, 1 for the current one.",
+		values: func(status StatusResponse) []metricValue {
+			var values []metricValue
+			for _, deploymentStatus := range []DeploymentStatus{DeploymentStatusReady, DeploymentStatusPossiblyReady, DeploymentStatusActivating, DeploymentStatusDeactivating, DeploymenStatusDeactivated} {
+				value := 0.0
+				if status.Status == deploymentStatus {
+					value = 1
+				}
+				values = append(values, metricValue{labels: ",status=" + strconv.Quote(string(deploymentStatus)), value: value})
+			}
+			return values
+		},
+	},
+	{
+		name: "kibernate_in_flight_requests",
+		kind: "gauge",
+		help: "The number of requests currently being proxied or waiting.",
+		values: func(status StatusResponse) []metricValue {
+			return []metricValue{{value: float64(status.InFlightRequests)}}
+		},
+	},
+	{
+		name: "kibernate_dry_run_asleep",
+		kind: "gauge",
+		help: "1 if the deployment would currently be deactivated in dry run mode.",
+		values: func(status StatusResponse) []metricValue {
+			if status.DryRun == nil {
+				return nil
+			}
+			value := 0.0
+			if status.DryRun.Asleep {
+				value = 1
+			}
+			return []metricValue{{value: value}}
+		},
+	},
+	{
+		name: "kibernate_dry_run_asleep_seconds_total",
+		kind: "counter",
+		help: "The number of seconds the deployment would have been deactivated in dry run mode.",
+		values: func(status StatusResponse) []metricValue {
+			if status.DryRun == nil {
+				return nil
+			}
+			return []metricValue{{value: status.DryRun.AsleepSeconds}}
+		},
+	},
+	{
+		name: "kibernate_dry_run_activations_total",
+		kind: "counter",
+		help: "The number of activations that would have happened in dry run mode.",
+		values: func(status StatusResponse) []metricValue {
+			if status.DryRun == nil {
+				return nil
+			}
+			return []metricValue{{value: float64(status.DryRun.Activations)}}
+		},
+	},
+	{
+		name: "kibernate_dry_run_deactivations_total",
+		kind: "counter",
+		help: "The number of deactivations that would have happened in dry run mode.",
+		values: func(status StatusResponse) []metricValue {
+			if status.DryRun == nil {
+				return nil
+			}
+			return []metricValue{{value: float64(status.DryRun.Deactivations)}}
+		},
+	},
+	{
+		name: "kibernate_dry_run_cold_start_requests_total",
+		kind: "counter",
+		help: "The number of requests that would have waited for an activation in dry run mode.",
+		values: func(status StatusResponse) []metricValue {
+			if status.DryRun == nil {
+				return nil
+			}
+			return []metricValue{{value: float64(status.DryRun.ColdStartRequests)}}
+		},
+	},
+}
+
+func WriteMetrics(writer io.Writer, statuses []StatusResponse) error {
+	for _, metric := range metrics {
+		headerWritten := false
+		for _, status := range statuses {
+			values := metric.values(status)
+			if len(values) > 0 && !headerWritten {
+				_, err := fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+				if err != nil {
+					return err
+				}
+				headerWritten = true
+			}
+			targetLabels := fmt.Sprintf("namespace=%s,deployment=%s", strconv.Quote(status.Namespace), strconv.Quote(status.Deployment))
+			for _, value := range values {
+				_, err := fmt.Fprintf(writer, "%s{%s%s} %s\n", metric.name, targetLabels, value.labels, strconv.FormatFloat(value.value, 'g', -1, 64))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	prewarmHistogramKey     = "histogram.json"
+	prewarmPersistInterval  = 5 * time.Minute
+	prewarmMinObservedDays  = 2
+	prewarmCheckIntervalSec = 60
+)
+
+type PrewarmHistogram struct {
+	ObservedDays   [7]uint32     `json:"observedDays"`
+	ActiveDays     [7][24]uint32 `json:"activeDays"`
+	CurrentDay     string        `json:"currentDay"`
+	CurrentHours   [24]bool      `json:"currentHours"`
+	Prewarms       uint16        `json:"prewarms"`
+	PrewarmedHours [24]bool      `json:"prewarmedHours"`
+}
+
+type Prewarmer struct {
+	Config        Config
+	Deployment    *DeploymentHandler
+	Histogram     PrewarmHistogram
+	Logger        *slog.Logger
+	mutex         sync.Mutex
+	dirty         bool
+	lastPersisted time.Time
+}
+
+func NewPrewarmer(config Config, deployment *DeploymentHandler) (*Prewarmer, error) {
+	if !config.PrewarmEnabled {
+		return nil, nil
+	}
+	p := &Prewarmer{
+		Config:     config,
+		Deployment: deployment,
+		Logger:     TargetLogger(config).With("component", "prewarmer"),
+	}
+	if p.Config.PrewarmConfigMap == "" {
+		p.Config.PrewarmConfigMap = "kibernate-prewarm-" + config.Deployment
+	}
+	err := p.Load()
+	if err != nil {
+		p.Logger.Error("Error loading activity histogram", "configMap", p.Config.PrewarmConfigMap, "error", err)
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Prewarmer) Load() error {
+	configMap, err := p.Deployment.KubeClientSet.CoreV1().ConfigMaps(p.Config.Namespace).Get(context.TODO(), p.Config.PrewarmConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		p.Logger.Info("No activity histogram found, starting with an empty one", "configMap", p.Config.PrewarmConfigMap)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal([]byte(configMap.Data[prewarmHistogramKey]), &p.Histogram)
+	if err != nil {
+		p.Logger.Warn("Activity histogram is invalid, starting with an empty one", "configMap", p.Config.PrewarmConfigMap, "error", err)
+		p.Histogram = PrewarmHistogram{}
+	}
+	return nil
+}
+
+func (p *Prewarmer) Persist() error {
+	p.mutex.Lock()
+	data, err := json.Marshal(p.Histogram)
+	p.lastPersisted = time.Now()
+	p.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	err = p.write(data)
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if current, err := json.Marshal(p.Histogram); err == nil && bytes.Equal(current, data) {
+		p.dirty = false
+	}
+	return nil
+}
+
+func (p *Prewarmer) write(data []byte) error {
+	configMaps := p.Deployment.KubeClientSet.CoreV1().ConfigMaps(p.Config.Namespace)
+	configMap, err := configMaps.Get(context.TODO(), p.Config.PrewarmConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = configMaps.Create(context.TODO(), &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   p.Config.PrewarmConfigMap,
+				Labels: map[string]string{"app.kubernetes.io/managed-by": "kibernate"},
+			},
+			Data: map[string]string{prewarmHistogramKey: string(data)},
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if configMap.Data == nil {
+		configMap.Data = map[string]string{}
+	}
+	configMap.Data[prewarmHistogramKey] = string(data)
+	_, err = configMaps.Update(context.TODO(), configMap, metav1.UpdateOptions{})
+	return err
+}
+
+func (p *Prewarmer) RecordActivity(t time.Time) {
+	if p == nil {
+		return
+	}
+	t = t.UTC()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.rollOver(t)
+	if !p.Histogram.CurrentHours[t.Hour()] {
+		p.Histogram.CurrentHours[t.Hour()] = true
+		p.dirty = true
+	}
+}
+
+func (p *Prewarmer) rollOver(t time.Time) bool {
+	day := t.Format("2006-01-02")
+	if p.Histogram.CurrentDay == day {
+		return false
+	}
+	if previousDay, err := time.Parse("2006-01-02", p.Histogram.CurrentDay); err == nil {
+		weekday := previousDay.Weekday()
+		p.Histogram.ObservedDays[weekday]++
+		for hour, active := range p.Histogram.CurrentHours {
+			if active {
+				p.Histogram.ActiveDays[weekday][hour]++
+			}
+		}
+	}
+	p.Histogram.CurrentDay = day
+	p.Histogram.CurrentHours = [24]bool{}
+	p.Histogram.Prewarms = 0
+	p.Histogram.PrewarmedHours = [24]bool{}
+	p.dirty = true
+	return true
+}
+
+func (p *Prewarmer) Confidence(weekday time.Weekday, hour int) (float64, bool) {
+	observedDays := p.Histogram.ObservedDays[weekday]
+	if observedDays < prewarmMinObservedDays {
+		return 0, false
+	}
+	return float64(p.Histogram.ActiveDays[weekday][hour]) / float64(observedDays), true
+}
+
+func (p *Prewarmer) ShouldPrewarm(now time.Time) (bool, float64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now = now.UTC()
+	rolledOver := p.rollOver(now)
+	if rolledOver {
+		p.lastPersisted = time.Time{}
+	}
+	target := now.Add(time.Duration(p.Config.PrewarmLeadSecs) * time.Second)
+	confidence, ok := p.Confidence(target.Weekday(), target.Hour())
+	if !ok || confidence < p.Config.PrewarmConfidence {
+		return false, confidence
+	}
+	if p.Histogram.PrewarmedHours[target.Hour()] || p.Histogram.Prewarms >= p.Config.PrewarmMaxPerDay {
+		return false, confidence
+	}
+	if p.Deployment.EffectiveStatus() != DeploymenStatusDeactivated {
+		return false, confidence
+	}
+	p.Histogram.Prewarms++
+	p.Histogram.PrewarmedHours[target.Hour()] = true
+	p.dirty = true
+	return true, confidence
+}
+
+func (p *Prewarmer) ContinuouslyPrewarm(ctx context.Context) {
+	ticker := time.NewTicker(prewarmCheckIntervalSec * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			p.mutex.Lock()
+			dirty := p.dirty
+			p.mutex.Unlock()
+			if dirty {
+				err := p.Persist()
+				if err != nil {
+					p.Logger.Error("Error persisting activity histogram", "configMap", p.Config.PrewarmConfigMap, "error", err)
+				}
+			}
+			return
+		case <-ticker.C:
+		}
+		prewarm, confidence := p.ShouldPrewarm(time.Now())
+		if prewarm {
+			p.Logger.Info("Traffic is likely soon, pre-warming deployment", "confidence", confidence, "leadSecs", p.Config.PrewarmLeadSecs)
+			_, err := p.Deployment.ActivateDeployment(context.Background(), ActivationTrigger{Reason: "prewarm"})
+			if err != nil {
+				p.Logger.Error("Error pre-warming deployment", "error", err)
+			}
+		}
+		p.mutex.Lock()
+		persist := p.dirty && time.Since(p.lastPersisted) >= prewarmPersistInterval
+		p.mutex.Unlock()
+		if persist {
+			err := p.Persist()
+			if err != nil {
+				p.Logger.Error("Error persisting activity histogram", "configMap", p.Config.PrewarmConfigMap, "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"time"
+)
+
+func newTestPrewarmer(t *testing.T, config Config) *Prewarmer {
+	config.Namespace = "apps"
+	config.Deployment = "web"
+	config.PrewarmEnabled = true
+	deployment := &DeploymentHandler{KubeClientSet: kubefake.NewSimpleClientset(), Status: DeploymenStatusDeactivated}
+	p, err := NewPrewarmer(config, deployment)
+	if err != nil {
+		t.Fatalf("creating prewarmer: %v", err)
+	}
+	return p
+}
+
+func recordTestWeeks(p *Prewarmer, weeks int, activeHours map[int]int) time.Time {
+	day := time.Date(2023, time.May, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < weeks*7; i++ {
+		for hour, activeWeeks := range activeHours {
+			if i/7 < activeWeeks {
+				p.RecordActivity(day.Add(time.Duration(hour)*time.Hour + 5*time.Minute))
+			}
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return day
+}
+
+func TestPrewarmerBuildsHistogram(t *testing.T) {
+	p := newTestPrewarmer(t, Config{})
+	next := recordTestWeeks(p, 2, map[int]int{9: 2, 14: 1})
+	p.RecordActivity(next)
+	monday := time.Monday
+	if got := p.Histogram.ObservedDays[monday]; got != 2 {
+		t.Errorf("observed Mondays = %d, want 2", got)
+	}
+	if got := p.Histogram.ActiveDays[monday][9]; got != 2 {
+		t.Errorf("active Mondays at 9 = %d, want 2", got)
+	}
+	if got := p.Histogram.ActiveDays[monday][14]; got != 1 {
+		t.Errorf("active Mondays at 14 = %d, want 1", got)
+	}
+	if confidence, ok := p.Confidence(monday, 14); !ok || confidence != 0.5 {
+		t.Errorf("confidence at 14 = %v, %v, want 0.5, true", confidence, ok)
+	}
+}
+
+func TestPrewarmerShouldPrewarm(t *testing.T) {
+	p := newTestPrewarmer(t, Config{PrewarmLeadSecs: 600, PrewarmConfidence: 0.6, PrewarmMaxPerDay: 2})
+	monday := recordTestWeeks(p, 2, map[int]int{7: 2, 8: 2, 9: 2, 14: 1})
+	tests := []struct {
+		name string
+		now  time.Time
+		want bool
+	}{
+		{"too early", monday.Add(6*time.Hour + 30*time.Minute), false},
+		{"within lead time", monday.Add(6*time.Hour + 55*time.Minute), true},
+		{"already pre-warmed hour", monday.Add(7*time.Hour + 10*time.Minute), false},
+		{"next likely hour", monday.Add(7*time.Hour + 55*time.Minute), true},
+		{"daily cap reached", monday.Add(8*time.Hour + 55*time.Minute), false},
+		{"below confidence on the next day", monday.AddDate(0, 0, 1).Add(13*time.Hour + 55*time.Minute), false},
+	}
+	for _, test := range tests {
+		prewarm, confidence := p.ShouldPrewarm(test.now)
+		if prewarm != test.want {
+			t.Errorf("%s: ShouldPrewarm() = %v with confidence %v, want %v", test.name, prewarm, confidence, test.want)
+		}
+	}
+}
+
+func TestPrewarmerSkipsAwakeDeployment(t *testing.T) {
+	p := newTestPrewarmer(t, Config{PrewarmLeadSecs: 600, PrewarmConfidence: 0.5, PrewarmMaxPerDay: 2})
+	monday := recordTestWeeks(p, 2, map[int]int{9: 2})
+	p.Deployment.Status = DeploymentStatusReady
+	if prewarm, _ := p.ShouldPrewarm(monday.Add(8*time.Hour + 55*time.Minute)); prewarm {
+		t.Error("awake deployment is pre-warmed")
+	}
+}
+
+func TestPrewarmerPersistsHistogram(t *testing.T) {
+	p := newTestPrewarmer(t, Config{})
+	recordTestWeeks(p, 1, map[int]int{9: 1})
+	for i := 0; i < 2; i++ {
+		err := p.Persist()
+		if err != nil {
+			t.Fatalf("persisting histogram: %v", err)
+		}
+	}
+	if p.dirty {
+		t.Error("histogram is dirty after being persisted")
+	}
+	loaded, err := NewPrewarmer(p.Config, p.Deployment)
+	if err != nil {
+		t.Fatalf("loading histogram: %v", err)
+	}
+	if loaded.Histogram != p.Histogram {
+		t.Errorf("loaded histogram %+v, want %+v", loaded.Histogram, p.Histogram)
+	}
+}
@@ -17,31 +17,43 @@
 package kibernate
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/kubernetes"
+	"log/slog"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"regexp"
 	"time"
 )
 
 type Proxy struct {
-	Config                 Config
-	TargetBaseUrl          *url.URL
-	HttpServer             *http.Server
-	WaitTypeNoneHandler    WaitTypeHandler
-	WaitTypeConnectHandler WaitTypeHandler
-	WaitTypeLoadingHandler WaitTypeHandler
-	DefaultWaitTypeHandler WaitTypeHandler
-	LastActivity           time.Time
-	Deployment             *DeploymentHandler
+	Config               Config
+	TargetBaseUrl        *url.URL
+	HttpServer           *http.Server
+	WaitTypeHandlers     map[WaitType]WaitTypeHandler
+	LastActivity         time.Time
+	Deployment           *DeploymentHandler
+	UptimeMonitorHandler *UptimeMonitorHandler
+	AccessLogger         *AccessLogger
+	Prewarmer            *Prewarmer
+	InFlight             *InFlightTracker
+	Logger               *slog.Logger
+	waitingContext       context.Context
+	cancelWaiting        context.CancelFunc
 }
 
-func NewProxy(config Config) (*Proxy, error) {
-	targetBaseUrl, err := url.Parse(fmt.Sprintf("http://%s:%d", config.Service, config.ServicePort))
+func NewProxy(config Config, clientSet kubernetes.Interface) (*Proxy, error) {
+	logger := TargetLogger(config)
+	targetBaseUrl, err := url.Parse(fmt.Sprintf("http://%s:%d", config.ServiceHost(), config.ServicePort))
 	if err != nil {
-		log.Printf("Error parsing target base URL: %s", err.Error())
+		logger.Error("Error parsing target base URL", "error", err)
 		return nil, err
 	}
 	httpServer := http.Server{
@@ -51,48 +63,138 @@ func NewProxy(config Config) (*Proxy, error) {
 		WriteTimeout:      60 * time.Second,
 		IdleTimeout:       60 * time.Second,
 	}
-	p := &Proxy{Config: config, TargetBaseUrl: targetBaseUrl, HttpServer: &httpServer}
+	p := &Proxy{Config: config, TargetBaseUrl: targetBaseUrl, HttpServer: &httpServer, Logger: logger, InFlight: NewInFlightTracker()}
 	p.HttpServer.Handler = p
-	p.Deployment, err = NewDeploymentHandler(p.Config)
+	p.waitingContext, p.cancelWaiting = context.WithCancel(context.Background())
+	p.AccessLogger, err = NewAccessLogger(p.Config)
 	if err != nil {
-		log.Printf("Error creating deployment handler: %s", err.Error())
+		p.Logger.Error("Error creating access logger", "error", err)
 		return nil, err
 	}
-	p.WaitTypeConnectHandler = NewWaitTypeConnectHandler(p.Config, p, p.Deployment)
-	p.WaitTypeLoadingHandler, err = NewWaitTypeLoadingHandler(p.Config)
+	p.Deployment, err = NewDeploymentHandler(p.Config, clientSet)
 	if err != nil {
-		log.Printf("Error creating wait type loading handler: %s", err.Error())
+		p.Logger.Error("Error creating deployment handler", "error", err)
 		return nil, err
 	}
-	p.WaitTypeNoneHandler = NewWaitTypeNoneHandler(p.Config)
-	switch p.Config.DefaultWaitType {
-	case WaitTypeConnect:
-		p.DefaultWaitTypeHandler = p.WaitTypeConnectHandler
-	case WaitTypeLoading:
-		p.DefaultWaitTypeHandler = p.WaitTypeLoadingHandler
-	case WaitTypeNone:
-		p.DefaultWaitTypeHandler = p.WaitTypeNoneHandler
+	p.Prewarmer, err = NewPrewarmer(p.Config, p.Deployment)
+	if err != nil {
+		p.Logger.Error("Error creating prewarmer", "error", err)
+		return nil, err
+	}
+	p.UptimeMonitorHandler = NewUptimeMonitorHandler(p.Config, p, p.Deployment)
+	p.WaitTypeHandlers = map[WaitType]WaitTypeHandler{}
+	p.RegisterWaitTypeHandler(WaitTypeConnect, NewWaitTypeConnectHandler(p.Config, p, p.Deployment))
+	if p.IsWaitTypeReachable(WaitTypeLoading) {
+		waitTypeLoadingHandler, err := NewWaitTypeLoadingHandler(p.Config, p.Deployment)
+		if err != nil {
+			p.Logger.Error("Error creating wait type loading handler", "error", err)
+			return nil, err
+		}
+		p.RegisterWaitTypeHandler(WaitTypeLoading, waitTypeLoadingHandler)
+	}
+	p.RegisterWaitTypeHandler(WaitTypeNone, NewWaitTypeNoneHandler(p.Config))
+	p.RegisterWaitTypeHandler(WaitTypeApi, NewWaitTypeApiHandler(p.Config, p.Deployment))
+	if p.Config.RedirectUrl != "" {
+		waitTypeRedirectHandler, err := NewWaitTypeRedirectHandler(p.Config)
+		if err != nil {
+			p.Logger.Error("Error creating wait type redirect handler", "error", err)
+			return nil, err
+		}
+		p.RegisterWaitTypeHandler(WaitTypeRedirect, waitTypeRedirectHandler)
+	}
+	for _, handler := range p.Config.CustomWaitTypeHandlers {
+		p.RegisterWaitTypeHandler(WaitType(handler.Name), NewWaitTypeUpstreamHandler(p.Config, handler))
+	}
+	err = p.ValidateWaitTypes()
+	if err != nil {
+		p.Logger.Error("Error validating wait types", "error", err)
+		return nil, err
 	}
 	return p, nil
 }
 
-func (p *Proxy) Start() error {
-	log.Printf("Starting proxy on port %d", p.Config.ListenPort)
-	go func() {
-		err := p.ContinuouslyCheckIdleness()
-		if err != nil {
-			panic(err.Error())
+func (p *Proxy) RegisterWaitTypeHandler(waitType WaitType, handler WaitTypeHandler) {
+	p.WaitTypeHandlers[waitType] = handler
+}
+
+func (p *Proxy) IsWaitTypeReachable(waitType WaitType) bool {
+	if p.Config.DefaultWaitType == waitType || p.Config.ShutdownWaitType == waitType {
+		return true
+	}
+	for _, rule := range p.Config.WaitTypeRules {
+		if rule.WaitType == waitType {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxy) ValidateWaitTypes() error {
+	if _, ok := p.WaitTypeHandlers[p.Config.DefaultWaitType]; !ok {
+		return fmt.Errorf("no handler for default wait type '%s'", p.Config.DefaultWaitType)
+	}
+	for _, rule := range p.Config.WaitTypeRules {
+		if _, ok := p.WaitTypeHandlers[rule.WaitType]; !ok {
+			return fmt.Errorf("no handler for wait type '%s' of rule '%s'", rule.WaitType, rule.When)
 		}
+	}
+	if p.Config.ShutdownWaitType == WaitTypeConnect {
+		return errors.New("shutdown wait type must not be 'connect'")
+	}
+	if _, ok := p.WaitTypeHandlers[p.Config.ShutdownWaitType]; !ok {
+		return fmt.Errorf("no handler for shutdown wait type '%s'", p.Config.ShutdownWaitType)
+	}
+	return nil
+}
+
+func (p *Proxy) Start(ctx context.Context) error {
+	p.Logger.Info("Starting proxy", "port", p.Config.ListenPort)
+	p.StartBackgroundTasks(ctx)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- p.HttpServer.ListenAndServe()
 	}()
-	return p.HttpServer.ListenAndServe()
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+		return p.Stop()
+	}
+}
+
+func (p *Proxy) StartBackgroundTasks(ctx context.Context) {
+	p.Deployment.Start(ctx)
+	if !p.Config.NoIdleDeactivation {
+		go func() {
+			err := p.ContinuouslyCheckIdleness(ctx)
+			if err != nil {
+				panic(err.Error())
+			}
+		}()
+	}
+	if p.Prewarmer != nil {
+		go p.Prewarmer.ContinuouslyPrewarm(ctx)
+	}
 }
 
-func (p *Proxy) ContinuouslyCheckIdleness() error {
+func (p *Proxy) RecordActivity(t time.Time) {
+	p.LastActivity = t
+	p.Prewarmer.RecordActivity(t)
+}
+
+func (p *Proxy) ContinuouslyCheckIdleness(ctx context.Context) error {
 	loc, err := time.LoadLocation("UTC")
 	if err != nil {
 		return err
 	}
-	for range time.Tick(10 * time.Second) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
 		now := time.Now().UTC()
 		nowTime, err := time.ParseInLocation("15:04", now.Format("15:04"), loc)
 		if err != nil {
@@ -135,73 +237,170 @@ func (p *Proxy) ContinuouslyCheckIdleness() error {
 				continue
 			}
 		}
-		if time.Since(p.LastActivity).Seconds() > float64(p.Config.IdleTimeoutSecs) && p.Deployment.Status == DeploymentStatusReady && time.Since(p.Deployment.LastStatusChange).Seconds() > float64(p.Config.IdleTimeoutSecs) {
-			log.Printf("Deployment %s has been idle for %f seconds, deactivating", p.Config.Deployment, time.Since(p.LastActivity).Seconds())
-			err := p.Deployment.DeactivateDeployment()
+		idleTimeout := p.Deployment.DeactivationPolicy.EffectiveIdleTimeout()
+		if time.Since(p.LastActivity) > idleTimeout && p.Deployment.EffectiveStatus() == DeploymentStatusReady && time.Since(p.Deployment.LastStatusChange) > idleTimeout {
+			allowed, reason := p.Deployment.DeactivationPolicy.AllowsDeactivation(time.Now())
+			if !allowed {
+				p.Logger.Debug("Deployment is idle, but deactivation is deferred", "reason", reason, "idleSeconds", time.Since(p.LastActivity).Seconds())
+				continue
+			}
+			if inFlight := p.InFlight.Count(); inFlight > 0 && (p.Config.DrainTimeoutSecs == 0 || p.InFlight.IsDrainPostponed()) {
+				p.Logger.Debug("Deployment is idle, but requests are still in flight", "inFlight", inFlight)
+				continue
+			}
+			p.Logger.Info("Deployment is idle, deactivating", "idleSeconds", time.Since(p.LastActivity).Seconds(), "idleTimeoutSecs", idleTimeout.Seconds(), "status", p.Deployment.Status)
+			err := p.DrainAndDeactivate(DeactivationTrigger{Reason: "idle", IdleDuration: time.Since(p.LastActivity)})
 			if err != nil {
-				log.Printf("Error deactivating deployment: %s", err.Error())
+				p.Logger.Error("Error deactivating deployment", "error", err)
 				return err
 			}
 		}
 	}
-	return nil
+}
+
+func (p *Proxy) DrainAndDeactivate(trigger DeactivationTrigger) error {
+	if p.Config.DrainTimeoutSecs == 0 || p.Config.DryRun {
+		return p.Deployment.DeactivateDeployment(trigger)
+	}
+	if p.InFlight.IsDrainPostponed() {
+		p.Logger.Debug("Previous drain timed out, postponing deactivation until no requests are in flight", "inFlight", p.InFlight.Count())
+		return nil
+	}
+	p.Logger.Info("Draining in-flight requests before deactivation", "inFlight", p.InFlight.Count(), "timeoutSecs", p.Config.DrainTimeoutSecs)
+	drained, err := p.InFlight.Drain(time.Duration(p.Config.DrainTimeoutSecs)*time.Second, func() error {
+		return p.Deployment.DeactivateDeployment(trigger)
+	})
+	if !drained {
+		p.Logger.Info("Requests are still in flight after draining, postponing deactivation until none are", "inFlight", p.InFlight.Count())
+	}
+	return err
 }
 
 func (p *Proxy) PatchThrough(writer http.ResponseWriter, request *http.Request) {
-	log.Printf("Proxying request for path '%s'", request.URL.Path)
+	RequestLogger(request).Debug("Proxying request", "path", request.URL.Path)
+	ctx, span := Tracer().Start(request.Context(), "kibernate.upstream", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("server.address", p.TargetBaseUrl.Host),
+		attribute.String("url.path", request.URL.Path),
+	))
+	defer span.End()
+	request = request.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(request.Header))
 	reverseProxy := httputil.NewSingleHostReverseProxy(p.TargetBaseUrl)
 	reverseProxy.ServeHTTP(writer, request)
+	if recorder, ok := writer.(*responseRecorder); ok {
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.statusCode))
+		if recorder.statusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.statusCode))
+		}
+	}
 }
 
 func (p *Proxy) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	p.Deployment.HostHeader = request.Header.Get("Host")
-	if p.Config.UptimeMonitorUserAgentMatch != nil && p.Config.UptimeMonitorUserAgentMatch.MatchString(request.Header.Get("User-Agent")) {
-		if p.Config.UptimeMonitorUserAgentExclude == nil || !p.Config.UptimeMonitorUserAgentExclude.MatchString(request.Header.Get("User-Agent")) {
-			log.Printf("Uptime monitor request received with User-Agent '%s' for path '%s'", request.Header.Get("User-Agent"), request.URL.Path)
-			if p.Deployment.Status == DeploymentStatusReady {
-				p.PatchThrough(writer, request)
-			} else {
-				writer.Header().Add("Content-Type", "text/plain")
-				writer.WriteHeader(http.StatusOK)
-				_, err := writer.Write([]byte(p.Config.UptimeMonitorResponseMessage))
-				if err != nil {
-					http.Error(writer, err.Error(), http.StatusInternalServerError)
-				}
-			}
-			return
-		}
+	startTime := time.Now()
+	requestId := request.Header.Get("X-Request-Id")
+	if requestId == "" {
+		requestId = NewRequestId()
+		request.Header.Set("X-Request-Id", requestId)
+	}
+	writer.Header().Set("X-Request-Id", requestId)
+	request = WithRequestLogger(request, p.Logger.With("requestId", requestId))
+	ctx := otel.GetTextMapPropagator().Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+	ctx, span := Tracer().Start(ctx, "kibernate.request", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("http.request.method", request.Method),
+		attribute.String("url.path", request.URL.Path),
+		attribute.String("server.address", request.Host),
+		attribute.String("kibernate.request_id", requestId),
+	))
+	defer span.End()
+	request = request.WithContext(ctx)
+	recorder := &responseRecorder{ResponseWriter: writer}
+	entry := &AccessLogEntry{
+		RequestId:        requestId,
+		Target:           p.Config.Namespace + "/" + p.Config.Deployment,
+		RemoteAddr:       request.RemoteAddr,
+		Method:           request.Method,
+		Host:             request.Host,
+		Uri:              request.RequestURI,
+		Protocol:         request.Proto,
+		Referer:          request.Referer(),
+		UserAgent:        request.UserAgent(),
+		DeploymentStatus: p.Deployment.Status,
+	}
+	p.HandleRequest(recorder, request, entry)
+	entry.Time = startTime
+	entry.StatusCode = recorder.statusCode
+	entry.Bytes = recorder.bytes
+	entry.DurationMs = time.Since(startTime).Milliseconds()
+	span.SetAttributes(
+		attribute.Int("http.response.status_code", entry.StatusCode),
+		attribute.String("kibernate.deployment.status", string(entry.DeploymentStatus)),
+		attribute.String("kibernate.wait_type", string(entry.WaitType)),
+		attribute.Int64("kibernate.wait_duration_ms", entry.WaitDurationMs),
+		attribute.Bool("kibernate.activation.triggered", entry.ActivationTriggered),
+	)
+	if entry.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(entry.StatusCode))
+	}
+	p.AccessLogger.Log(entry)
+}
+
+func (p *Proxy) HandleRequest(writer http.ResponseWriter, request *http.Request, entry *AccessLogEntry) {
+	p.Deployment.HostHeader = request.Host
+	if !p.InFlight.Begin(request.Context()) {
+		return
 	}
-	if p.IsPathConsideredActivity(request.URL.Path) {
-		if p.IsUserAgentConsideredActivity(request.Header.Get("User-Agent")) {
-			log.Printf("Activity detected for path '%s' with User-Agent '%s'", request.URL.Path, request.Header.Get("User-Agent"))
-			p.LastActivity = time.Now()
+	defer p.InFlight.End()
+	admissionCtx, admissionSpan := Tracer().Start(request.Context(), "kibernate.admission")
+	if p.UptimeMonitorHandler.Handle(writer, request) {
+		admissionSpan.SetAttributes(attribute.Bool("kibernate.uptime_monitor", true))
+		admissionSpan.End()
+		return
+	}
+	activity := p.IsRequestConsideredActivity(request)
+	if activity {
+		RequestLogger(request).Debug("Activity detected", "method", request.Method, "path", request.URL.Path, "userAgent", request.Header.Get("User-Agent"))
+		p.RecordActivity(time.Now())
+		if p.Deployment.Keda != nil && p.Deployment.Status == DeploymentStatusReady {
+			p.Deployment.Keda.SetActive(true)
 		}
 	}
-	if p.Deployment.Status == DeploymentStatusReady {
+	admissionSpan.SetAttributes(
+		attribute.Bool("kibernate.activity", activity),
+		attribute.String("kibernate.deployment.status", string(p.Deployment.Status)),
+	)
+	if p.Config.DryRun {
+		_, err := p.Deployment.ActivateDeployment(admissionCtx, ActivationTrigger{Reason: "request", Request: NewRequestMetadata(request, p.Config.TrustedProxyCidrs)})
+		if err != nil {
+			RequestLogger(request).Error("Error recording dry run activation", "error", err)
+		}
+		admissionSpan.End()
+		p.PatchThrough(writer, request)
+	} else if p.Deployment.Status == DeploymentStatusReady {
+		admissionSpan.End()
 		p.PatchThrough(writer, request)
 	} else {
-		log.Printf("Deployment %s is not ready, activating", p.Config.Deployment)
-		err := p.Deployment.ActivateDeployment()
+		RequestLogger(request).Debug("Deployment is not ready, activating", "status", p.Deployment.Status)
+		activated, err := p.Deployment.ActivateDeployment(admissionCtx, ActivationTrigger{Reason: "request", Request: NewRequestMetadata(request, p.Config.TrustedProxyCidrs)})
 		if err != nil {
-			log.Printf("Error activating deployment: %s", err.Error())
+			RequestLogger(request).Error("Error activating deployment", "error", err)
+			admissionSpan.RecordError(err)
+			admissionSpan.SetStatus(codes.Error, err.Error())
+			admissionSpan.End()
 			http.Error(writer, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		if p.IsPathMatchingFor(WaitTypeConnect, request.URL.Path) {
-			log.Printf("Path '%s' matches wait type '%s'", request.URL.Path, WaitTypeConnect)
-			err = p.WaitTypeConnectHandler.Handle(writer, request)
-		} else if p.IsPathMatchingFor(WaitTypeLoading, request.URL.Path) {
-			log.Printf("Path '%s' matches wait type '%s'", request.URL.Path, WaitTypeLoading)
-			err = p.WaitTypeLoadingHandler.Handle(writer, request)
-		} else if p.IsPathMatchingFor(WaitTypeNone, request.URL.Path) {
-			log.Printf("Path '%s' matches wait type '%s'", request.URL.Path, WaitTypeNone)
-			err = p.WaitTypeNoneHandler.Handle(writer, request)
-		} else {
-			log.Printf("Path '%s' matches default wait type '%s'", request.URL.Path, p.Config.DefaultWaitType)
-			err = p.DefaultWaitTypeHandler.Handle(writer, request)
+		if activated {
+			RequestLogger(request).Info("Activation triggered by request", "path", request.URL.Path)
 		}
+		entry.ActivationTriggered = activated
+		entry.WaitType = p.SelectWaitType(request)
+		admissionSpan.SetAttributes(attribute.String("kibernate.wait_type", string(entry.WaitType)))
+		admissionSpan.End()
+		waitStartTime := time.Now()
+		err = p.WaitTypeHandlers[entry.WaitType].Handle(writer, request)
+		entry.WaitDurationMs = time.Since(waitStartTime).Milliseconds()
 		if err != nil {
-			log.Printf("Error handling request: %s", err.Error())
+			RequestLogger(request).Error("Error handling request", "waitType", entry.WaitType, "error", err)
 			http.Error(writer, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -209,56 +408,58 @@ func (p *Proxy) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 }
 
 func (p *Proxy) Stop() error {
-	log.Println("Stopping proxy")
-	return p.HttpServer.Close()
+	p.Logger.Info("Stopping proxy", "timeoutSecs", p.Config.ShutdownTimeoutSecs)
+	p.cancelWaiting()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.Config.ShutdownTimeoutSecs)*time.Second)
+	defer cancel()
+	err := p.HttpServer.Shutdown(ctx)
+	if err != nil {
+		p.Logger.Warn("Proxied requests did not finish in time, closing remaining connections", "error", err)
+		return p.HttpServer.Close()
+	}
+	p.Logger.Info("Proxy stopped")
+	return nil
 }
 
-func (p *Proxy) IsPathConsideredActivity(path string) bool {
-	pathMatch := p.Config.ActivityPathMatch
-	pathExclude := p.Config.ActivityPathExclude
-	isMatching := false
-	if pathMatch != nil && pathMatch.MatchString(path) {
-		isMatching = true
-		if pathExclude != nil && pathExclude.MatchString(path) {
-			isMatching = false
-		}
+func (p *Proxy) WaitingContext(request *http.Request) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(request.Context())
+	stop := context.AfterFunc(p.waitingContext, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
 	}
-	return isMatching
+}
+
+func (p *Proxy) HandleShutdownFallback(writer http.ResponseWriter, request *http.Request) error {
+	RequestLogger(request).Info("Proxy is shutting down, answering waiting request with fallback", "waitType", p.Config.ShutdownWaitType)
+	return p.WaitTypeHandlers[p.Config.ShutdownWaitType].Handle(writer, request)
+}
+
+func (p *Proxy) IsRequestConsideredActivity(request *http.Request) bool {
+	activity, _ := ExplainActivity(p.Config, request)
+	return activity
+}
+
+func (p *Proxy) IsPathConsideredActivity(path string) bool {
+	return isConsideredActivity(p.Config.ActivityPathMatch, p.Config.ActivityPathExclude, path)
 }
 
 func (p *Proxy) IsUserAgentConsideredActivity(userAgent string) bool {
-	userAgentMatch := p.Config.ActivityUserAgentMatch
-	userAgentExclude := p.Config.ActivityUserAgentExclude
-	isMatching := false
-	if userAgentMatch != nil && userAgentMatch.MatchString(userAgent) {
-		isMatching = true
-		if userAgentExclude != nil && userAgentExclude.MatchString(userAgent) {
-			isMatching = false
-		}
-	}
-	return isMatching
+	return isConsideredActivity(p.Config.ActivityUserAgentMatch, p.Config.ActivityUserAgentExclude, userAgent)
 }
 
-func (p *Proxy) IsPathMatchingFor(waitType WaitType, path string) bool {
-	var pathMatch *regexp.Regexp
-	var pathExclude *regexp.Regexp
-	isMatching := false
-	switch waitType {
-	case WaitTypeConnect:
-		pathMatch = p.Config.WaitConnectPathMatch
-		pathExclude = p.Config.WaitConnectPathExclude
-	case WaitTypeLoading:
-		pathMatch = p.Config.WaitLoadingPathMatch
-		pathExclude = p.Config.WaitLoadingPathExclude
-	case WaitTypeNone:
-		pathMatch = p.Config.WaitNonePathMatch
-		pathExclude = p.Config.WaitNonePathExclude
-	}
-	if pathMatch != nil && pathMatch.MatchString(path) {
-		isMatching = true
-		if pathExclude != nil && pathExclude.MatchString(path) {
-			isMatching = false
+func (p *Proxy) SelectWaitType(request *http.Request) WaitType {
+	for _, rule := range p.Config.WaitTypeRules {
+		matches, err := rule.Matches(request)
+		if err != nil {
+			RequestLogger(request).Error("Error evaluating wait type rule", "rule", rule.When, "error", err)
+			continue
+		}
+		if matches {
+			RequestLogger(request).Debug("Request matches wait type rule", "path", request.URL.Path, "waitType", rule.WaitType, "rule", rule.When)
+			return rule.WaitType
 		}
 	}
-	return isMatching
+	RequestLogger(request).Debug("Request matches default wait type", "path", request.URL.Path, "waitType", p.Config.DefaultWaitType)
+	return p.Config.DefaultWaitType
 }
@@ -0,0 +1,132 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newTestProxy(t *testing.T, status DeploymentStatus, upstream *httptest.Server) (*Proxy, string) {
+	targetBaseUrl, _ := url.Parse(upstream.URL)
+	config := newTestConfig()
+	config.Deployment = "web"
+	config.DefaultWaitType = WaitTypeConnect
+	config.ShutdownTimeoutSecs = 5
+	deployment := &DeploymentHandler{Config: config, Status: status, Logger: slog.Default()}
+	p := &Proxy{Config: config, TargetBaseUrl: targetBaseUrl, Deployment: deployment, InFlight: NewInFlightTracker(), Logger: slog.Default()}
+	p.HttpServer = &http.Server{Handler: p}
+	p.waitingContext, p.cancelWaiting = context.WithCancel(context.Background())
+	p.UptimeMonitorHandler = NewUptimeMonitorHandler(config, p, deployment)
+	p.WaitTypeHandlers = map[WaitType]WaitTypeHandler{}
+	p.RegisterWaitTypeHandler(WaitTypeConnect, NewWaitTypeConnectHandler(config, p, deployment))
+	p.RegisterWaitTypeHandler(WaitTypeNone, NewWaitTypeNoneHandler(config))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	go p.HttpServer.Serve(listener)
+	t.Cleanup(func() {
+		p.HttpServer.Close()
+	})
+	return p, "http://" + listener.Addr().String()
+}
+
+type testResponse struct {
+	statusCode int
+	body       string
+	err        error
+}
+
+func getAsync(url string) <-chan testResponse {
+	responses := make(chan testResponse, 1)
+	go func() {
+		response, err := http.Get(url)
+		if err != nil {
+			responses <- testResponse{err: err}
+			return
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		responses <- testResponse{statusCode: response.StatusCode, body: string(body), err: err}
+	}()
+	return responses
+}
+
+func TestProxyStopLetsProxiedRequestsFinish(t *testing.T) {
+	received := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		close(received)
+		<-release
+		writer.Write([]byte("report"))
+	}))
+	defer upstream.Close()
+	p, baseUrl := newTestProxy(t, DeploymentStatusReady, upstream)
+	responses := getAsync(baseUrl + "/reports")
+	<-received
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- p.Stop()
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("proxy stopped while a proxied request was in flight")
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(release)
+	response := <-responses
+	if response.err != nil || response.statusCode != http.StatusOK || response.body != "report" {
+		t.Errorf("got %d %q (%v), want the upstream response", response.statusCode, response.body, response.err)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("stopping proxy: %v", err)
+	}
+}
+
+func TestProxyStopAnswersWaitingRequestsWithShutdownWaitType(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		t.Error("waiting request was proxied to the upstream")
+	}))
+	defer upstream.Close()
+	p, baseUrl := newTestProxy(t, DeploymentStatusActivating, upstream)
+	responses := getAsync(baseUrl + "/reports")
+	for deadline := time.Now().Add(5 * time.Second); p.InFlight.Count() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("request did not start waiting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := p.Stop(); err != nil {
+		t.Errorf("stopping proxy: %v", err)
+	}
+	select {
+	case response := <-responses:
+		if response.err != nil || response.statusCode != http.StatusServiceUnavailable || response.body != "503 - Service Unavailable" {
+			t.Errorf("got %d %q (%v), want the shutdown wait type response", response.statusCode, response.body, response.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting request was not answered")
+	}
+}
@@ -0,0 +1,285 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"io"
+	"k8s.io/client-go/util/jsonpath"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type ReadinessProbeType string
+
+const (
+	ReadinessProbeTypeHttp ReadinessProbeType = "http"
+	ReadinessProbeTypeTcp                     = "tcp"
+	ReadinessProbeTypeGrpc                    = "grpc"
+)
+
+type ReadinessProbeOutcome string
+
+const (
+	ReadinessProbeOutcomeProbing   ReadinessProbeOutcome = "probing"
+	ReadinessProbeOutcomeSucceeded                       = "succeeded"
+	ReadinessProbeOutcomeFailed                          = "failed"
+	ReadinessProbeOutcomeTimedOut                        = "timedOut"
+	ReadinessProbeOutcomeCancelled                       = "cancelled"
+)
+
+const readinessProbeMaxBodyBytes = 1024 * 1024
+
+type ReadinessProbeStatus struct {
+	Type                 ReadinessProbeType    `json:"type"`
+	Outcome              ReadinessProbeOutcome `json:"outcome"`
+	Attempts             int                   `json:"attempts"`
+	ConsecutiveSuccesses int                   `json:"consecutiveSuccesses"`
+	ConsecutiveFailures  int                   `json:"consecutiveFailures"`
+	LastProbeTime        time.Time             `json:"lastProbeTime"`
+	LastError            string                `json:"lastError,omitempty"`
+}
+
+type ReadinessProbe struct {
+	Config      Config
+	Address     string
+	HttpClient  *http.Client
+	JsonPath    *jsonpath.JSONPath
+	Logger      *slog.Logger
+	grpcConn    *grpc.ClientConn
+	status      ReadinessProbeStatus
+	statusMutex sync.Mutex
+}
+
+func IsReadinessProbeConfigured(config Config) bool {
+	return config.ReadinessProbeType == ReadinessProbeTypeTcp || config.ReadinessProbeType == ReadinessProbeTypeGrpc || config.ReadinessProbePath != ""
+}
+
+func NewReadinessProbe(config Config) (*ReadinessProbe, error) {
+	r := &ReadinessProbe{
+		Config:  config,
+		Logger:  TargetLogger(config),
+		Address: net.JoinHostPort(config.ServiceHost(), fmt.Sprint(config.ServicePort)),
+		HttpClient: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+	if r.Config.ReadinessProbeType == "" {
+		r.Config.ReadinessProbeType = ReadinessProbeTypeHttp
+	}
+	if r.Config.ReadinessProbeMethod == "" {
+		r.Config.ReadinessProbeMethod = http.MethodGet
+	}
+	if r.Config.ReadinessProbeSuccessThreshold == 0 {
+		r.Config.ReadinessProbeSuccessThreshold = 1
+	}
+	if r.Config.ReadinessProbeJsonPath != "" {
+		r.JsonPath = jsonpath.New("readinessProbe")
+		err := r.JsonPath.Parse(r.Config.ReadinessProbeJsonPath)
+		if err != nil {
+			r.Logger.Error("Error parsing readiness probe JSON path", "error", err)
+			return nil, err
+		}
+	}
+	if r.Config.ReadinessProbeType == ReadinessProbeTypeGrpc {
+		var err error
+		r.grpcConn, err = grpc.Dial(r.Address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			r.Logger.Error("Error creating readiness probe gRPC connection", "error", err)
+			return nil, err
+		}
+	}
+	r.status.Type = r.Config.ReadinessProbeType
+	return r, nil
+}
+
+func (r *ReadinessProbe) GetStatus() ReadinessProbeStatus {
+	r.statusMutex.Lock()
+	defer r.statusMutex.Unlock()
+	return r.status
+}
+
+func (r *ReadinessProbe) WaitForReady(ctx context.Context, hostHeader string) ReadinessProbeOutcome {
+	r.statusMutex.Lock()
+	r.status = ReadinessProbeStatus{Type: r.Config.ReadinessProbeType, Outcome: ReadinessProbeOutcomeProbing}
+	r.statusMutex.Unlock()
+	startTime := time.Now()
+	for r.Config.ReadinessTimeoutSecs == 0 || time.Since(startTime).Seconds() < float64(r.Config.ReadinessTimeoutSecs) {
+		_, span := Tracer().Start(ctx, "kibernate.readinessProbe", trace.WithAttributes(
+			attribute.String("kibernate.readiness_probe.type", string(r.Config.ReadinessProbeType)),
+		))
+		err := r.Probe(hostHeader)
+		status := r.RecordResult(err)
+		span.SetAttributes(attribute.Int("kibernate.readiness_probe.attempt", status.Attempts))
+		if err != nil {
+			r.Logger.Debug("Readiness probe attempt failed", "attempt", status.Attempts, "error", err)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+		if status.ConsecutiveSuccesses >= int(r.Config.ReadinessProbeSuccessThreshold) {
+			r.Logger.Info("Readiness probe succeeded", "attempts", status.Attempts)
+			r.SetOutcome(ReadinessProbeOutcomeSucceeded)
+			return ReadinessProbeOutcomeSucceeded
+		}
+		if r.Config.ReadinessProbeFailureThreshold > 0 && status.ConsecutiveFailures >= int(r.Config.ReadinessProbeFailureThreshold) {
+			r.Logger.Warn("Readiness probe gave up", "consecutiveFailures", status.ConsecutiveFailures, "lastError", status.LastError)
+			r.SetOutcome(ReadinessProbeOutcomeFailed)
+			return ReadinessProbeOutcomeFailed
+		}
+		select {
+		case <-ctx.Done():
+			r.Logger.Debug("Readiness probe cancelled", "attempts", status.Attempts)
+			r.SetOutcome(ReadinessProbeOutcomeCancelled)
+			return ReadinessProbeOutcomeCancelled
+		case <-time.After(1 * time.Second):
+		}
+	}
+	r.Logger.Warn("Readiness probe timed out", "timeoutSecs", r.Config.ReadinessTimeoutSecs)
+	r.SetOutcome(ReadinessProbeOutcomeTimedOut)
+	return ReadinessProbeOutcomeTimedOut
+}
+
+func (r *ReadinessProbe) RecordResult(err error) ReadinessProbeStatus {
+	r.statusMutex.Lock()
+	defer r.statusMutex.Unlock()
+	r.status.Attempts++
+	r.status.LastProbeTime = time.Now()
+	if err != nil {
+		r.status.ConsecutiveFailures++
+		r.status.ConsecutiveSuccesses = 0
+		r.status.LastError = err.Error()
+	} else {
+		r.status.ConsecutiveSuccesses++
+		r.status.ConsecutiveFailures = 0
+		r.status.LastError = ""
+	}
+	return r.status
+}
+
+func (r *ReadinessProbe) SetOutcome(outcome ReadinessProbeOutcome) {
+	r.statusMutex.Lock()
+	defer r.statusMutex.Unlock()
+	r.status.Outcome = outcome
+}
+
+func (r *ReadinessProbe) Probe(hostHeader string) error {
+	switch r.Config.ReadinessProbeType {
+	case ReadinessProbeTypeTcp:
+		return r.ProbeTcp()
+	case ReadinessProbeTypeGrpc:
+		return r.ProbeGrpc()
+	default:
+		return r.ProbeHttp(hostHeader)
+	}
+}
+
+func (r *ReadinessProbe) ProbeTcp() error {
+	conn, err := net.DialTimeout("tcp", r.Address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (r *ReadinessProbe) ProbeGrpc() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := healthpb.NewHealthClient(r.grpcConn).Check(ctx, &healthpb.HealthCheckRequest{Service: r.Config.ReadinessProbeGrpcService})
+	if err != nil {
+		return err
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("unexpected gRPC health status %s", resp.Status)
+	}
+	return nil
+}
+
+func (r *ReadinessProbe) ProbeHttp(hostHeader string) error {
+	req, err := http.NewRequest(r.Config.ReadinessProbeMethod, "http://"+r.Address+r.Config.ReadinessProbePath, nil)
+	if err != nil {
+		return err
+	}
+	for name, value := range r.Config.ReadinessProbeHeaders {
+		req.Header.Set(name, value)
+	}
+	if r.Config.ReadinessProbeHost != "" {
+		req.Host = r.Config.ReadinessProbeHost
+	} else if hostHeader != "" {
+		req.Host = hostHeader
+	}
+	resp, err := r.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, readinessProbeMaxBodyBytes))
+	if err != nil {
+		return err
+	}
+	if !r.IsExpectedStatusCode(resp.StatusCode) {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	if r.Config.ReadinessProbeBodyMatch != nil && !r.Config.ReadinessProbeBodyMatch.Match(body) {
+		return errors.New("response body does not match")
+	}
+	if r.JsonPath != nil {
+		var data interface{}
+		err := json.Unmarshal(body, &data)
+		if err != nil {
+			return fmt.Errorf("response body is not valid JSON: %s", err.Error())
+		}
+		var result bytes.Buffer
+		err = r.JsonPath.Execute(&result, data)
+		if err != nil {
+			return fmt.Errorf("JSON path evaluation failed: %s", err.Error())
+		}
+		if r.Config.ReadinessProbeJsonMatch != nil {
+			if !r.Config.ReadinessProbeJsonMatch.MatchString(result.String()) {
+				return fmt.Errorf("JSON path result '%s' does not match", result.String())
+			}
+		} else if result.Len() == 0 {
+			return errors.New("JSON path result is empty")
+		}
+	}
+	return nil
+}
+
+func (r *ReadinessProbe) IsExpectedStatusCode(statusCode int) bool {
+	if len(r.Config.ReadinessProbeStatusCodes) == 0 {
+		return statusCode == http.StatusOK
+	}
+	for _, statusCodeRange := range r.Config.ReadinessProbeStatusCodes {
+		if statusCode >= statusCodeRange.From && statusCode <= statusCodeRange.To {
+			return true
+		}
+	}
+	return false
+}
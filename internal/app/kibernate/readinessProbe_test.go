@@ -0,0 +1,143 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestReadinessProbe(t *testing.T, config Config, handler http.HandlerFunc) *ReadinessProbe {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	config.ReadinessProbePath = "/healthz"
+	r, err := NewReadinessProbe(config)
+	if err != nil {
+		t.Fatalf("creating readiness probe: %v", err)
+	}
+	r.Address = strings.TrimPrefix(server.URL, "http://")
+	return r
+}
+
+func TestReadinessProbeHttp(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		status int
+		body   string
+		ok     bool
+	}{
+		{"default accepts 200", Config{}, http.StatusOK, "", true},
+		{"default rejects 204", Config{}, http.StatusNoContent, "", false},
+		{"range accepts 204", Config{ReadinessProbeStatusCodes: []StatusCodeRange{{From: 200, To: 299}}}, http.StatusNoContent, "", true},
+		{"ranges reject 301", Config{ReadinessProbeStatusCodes: []StatusCodeRange{{From: 200, To: 299}, {From: 401, To: 401}}}, http.StatusMovedPermanently, "", false},
+		{"second range accepts 401", Config{ReadinessProbeStatusCodes: []StatusCodeRange{{From: 200, To: 299}, {From: 401, To: 401}}}, http.StatusUnauthorized, "", true},
+		{"body matches", Config{ReadinessProbeBodyMatch: regexp.MustCompile("^OK")}, http.StatusOK, "OK ready", true},
+		{"body does not match", Config{ReadinessProbeBodyMatch: regexp.MustCompile("^OK")}, http.StatusOK, "starting", false},
+		{"JSON path matches", Config{ReadinessProbeJsonPath: "{.status}", ReadinessProbeJsonMatch: regexp.MustCompile("^UP$")}, http.StatusOK, `{"status":"UP"}`, true},
+		{"JSON path does not match", Config{ReadinessProbeJsonPath: "{.status}", ReadinessProbeJsonMatch: regexp.MustCompile("^UP$")}, http.StatusOK, `{"status":"DOWN"}`, false},
+		{"JSON path present", Config{ReadinessProbeJsonPath: "{.checks[0].name}"}, http.StatusOK, `{"checks":[{"name":"db"}]}`, true},
+		{"JSON path missing", Config{ReadinessProbeJsonPath: "{.status}"}, http.StatusOK, `{}`, false},
+		{"invalid JSON", Config{ReadinessProbeJsonPath: "{.status}"}, http.StatusOK, "UP", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestReadinessProbe(t, test.config, func(writer http.ResponseWriter, request *http.Request) {
+				writer.WriteHeader(test.status)
+				_, _ = writer.Write([]byte(test.body))
+			})
+			err := r.Probe("")
+			if (err == nil) != test.ok {
+				t.Errorf("Probe() = %v, want ok %v", err, test.ok)
+			}
+		})
+	}
+}
+
+func TestReadinessProbeHttpRequest(t *testing.T) {
+	config := Config{
+		ReadinessProbeMethod:  http.MethodHead,
+		ReadinessProbeHeaders: map[string]string{"X-Probe": "kibernate"},
+		ReadinessProbeHost:    "app.example.com",
+	}
+	var method, host, header string
+	r := newTestReadinessProbe(t, config, func(writer http.ResponseWriter, request *http.Request) {
+		method, host, header = request.Method, request.Host, request.Header.Get("X-Probe")
+	})
+	err := r.Probe("ignored.example.com")
+	if err != nil {
+		t.Fatalf("probing: %v", err)
+	}
+	if method != http.MethodHead || host != "app.example.com" || header != "kibernate" {
+		t.Errorf("probe request was %s with host %s and header %s", method, host, header)
+	}
+}
+
+func TestReadinessProbeWaitForReadyThresholds(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    Config
+		responses []int
+		want      ReadinessProbeOutcome
+		attempts  int
+	}{
+		{"succeeds after success threshold", Config{ReadinessProbeSuccessThreshold: 2}, []int{500, 200, 200}, ReadinessProbeOutcomeSucceeded, 3},
+		{"succeeds before failure threshold", Config{ReadinessProbeFailureThreshold: 2}, []int{200, 500, 500}, ReadinessProbeOutcomeSucceeded, 1},
+		{"gives up after failure threshold", Config{ReadinessProbeFailureThreshold: 2}, []int{500, 500, 200}, ReadinessProbeOutcomeFailed, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attempt := 0
+			r := newTestReadinessProbe(t, test.config, func(writer http.ResponseWriter, request *http.Request) {
+				writer.WriteHeader(test.responses[attempt])
+				attempt++
+			})
+			if got := r.WaitForReady(context.Background(), ""); got != test.want {
+				t.Errorf("WaitForReady() = %s, want %s", got, test.want)
+			}
+			status := r.GetStatus()
+			if status.Outcome != test.want || status.Attempts != test.attempts {
+				t.Errorf("status is %s after %d attempts, want %s after %d", status.Outcome, status.Attempts, test.want, test.attempts)
+			}
+		})
+	}
+}
+
+func TestReadinessProbeWaitForReadyIsCancelled(t *testing.T) {
+	r := newTestReadinessProbe(t, Config{}, func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	outcome := make(chan ReadinessProbeOutcome)
+	go func() {
+		outcome <- r.WaitForReady(ctx, "")
+	}()
+	cancel()
+	select {
+	case got := <-outcome:
+		if got != ReadinessProbeOutcomeCancelled {
+			t.Errorf("WaitForReady() = %s, want %s", got, ReadinessProbeOutcomeCancelled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("readiness probe without timeout keeps probing after being cancelled")
+	}
+}
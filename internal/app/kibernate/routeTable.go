@@ -0,0 +1,105 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+)
+
+type RoutedBackend struct {
+	Key      string
+	Revision string
+	Config   Config
+	Routes   []Route
+}
+
+type RouteTable struct {
+	Router   *Router
+	Logger   *slog.Logger
+	mutex    sync.Mutex
+	backends map[string]map[string]*RoutedBackend
+}
+
+func NewRouteTable(router *Router) *RouteTable {
+	return &RouteTable{
+		Router:   router,
+		Logger:   slog.Default().With("component", "routeTable"),
+		backends: map[string]map[string]*RoutedBackend{},
+	}
+}
+
+func (t *RouteTable) SetBackends(sourceKey string, backends map[string]*RoutedBackend) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	affected := map[string]bool{}
+	for key := range t.backends[sourceKey] {
+		affected[key] = true
+	}
+	for key := range backends {
+		affected[key] = true
+	}
+	if len(backends) == 0 {
+		delete(t.backends, sourceKey)
+	} else {
+		t.backends[sourceKey] = backends
+	}
+	for key := range affected {
+		t.updateTarget(key)
+	}
+}
+
+func (t *RouteTable) RemoveStaleSources(namespace string, seen map[string]bool) {
+	t.mutex.Lock()
+	var stale []string
+	for key := range t.backends {
+		if IsKeyInNamespace(key, namespace) && !seen[key] {
+			stale = append(stale, key)
+		}
+	}
+	t.mutex.Unlock()
+	for _, key := range stale {
+		t.SetBackends(key, nil)
+	}
+}
+
+func (t *RouteTable) updateTarget(key string) {
+	var backend *RoutedBackend
+	var routes []Route
+	var sources []string
+	for source := range t.backends {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		if sourceBackend, ok := t.backends[source][key]; ok {
+			if backend == nil {
+				backend = sourceBackend
+			}
+			routes = append(routes, sourceBackend.Routes...)
+		}
+	}
+	if backend == nil {
+		t.Router.Remove(key)
+		return
+	}
+	err := t.Router.Upsert(key, backend.Revision, backend.Config, routes)
+	if err != nil {
+		t.Logger.Error("Error serving backend", "target", key, "error", err)
+	}
+}
@@ -0,0 +1,297 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"k8s.io/client-go/kubernetes"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Mode string
+
+const (
+	ModeSingle      Mode = "single"
+	ModeCrd              = "crd"
+	ModeAnnotations      = "annotations"
+	ModeIngress          = "ingress"
+	ModeGateway          = "gateway"
+)
+
+type Route struct {
+	Host       string `json:"host,omitempty"`
+	PathPrefix string `json:"pathPrefix,omitempty"`
+	Exact      bool   `json:"exact,omitempty"`
+}
+
+func (r Route) String() string {
+	host := r.Host
+	if host == "" {
+		host = "*"
+	}
+	return host + r.PathPrefix
+}
+
+func (r Route) MatchesHost(host string) bool {
+	if r.Host == "" {
+		return true
+	}
+	if strings.HasPrefix(r.Host, "*.") {
+		return strings.HasSuffix(host, r.Host[1:]) && len(host) > len(r.Host)-1
+	}
+	return r.Host == host
+}
+
+func (r Route) MatchesPath(path string) bool {
+	if r.Exact {
+		return path == r.PathPrefix
+	}
+	prefix := strings.TrimSuffix(r.PathPrefix, "/")
+	if prefix == "" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+func (r Route) Specificity() int {
+	specificity := len(strings.TrimSuffix(r.PathPrefix, "/")) * 2
+	if r.Exact {
+		specificity++
+	}
+	if r.Host != "" && !strings.HasPrefix(r.Host, "*.") {
+		specificity += 1 << 20
+	} else if r.Host != "" {
+		specificity += 1<<16 + len(r.Host)
+	}
+	return specificity
+}
+
+type RoutedTarget struct {
+	Key      string
+	Revision string
+	Routes   []Route
+	Proxy    *Proxy
+	cancel   context.CancelFunc
+}
+
+type Router struct {
+	Config       Config
+	HttpServer   *http.Server
+	AccessLogger *AccessLogger
+	Logger       *slog.Logger
+	NewProxy     func(config Config) (*Proxy, error)
+	mutex        sync.RWMutex
+	targets      map[string]*RoutedTarget
+	ctx          context.Context
+}
+
+var ErrKedaRequiresSingleMode = errors.New("scalingMode keda is only supported in single mode")
+
+func NewRouter(config Config, clientSet kubernetes.Interface) (*Router, error) {
+	if config.ScalingMode == ScalingModeKeda {
+		return nil, ErrKedaRequiresSingleMode
+	}
+	r := &Router{
+		Config: config,
+		Logger: slog.Default().With("component", "router"),
+		NewProxy: func(config Config) (*Proxy, error) {
+			return NewProxy(config, clientSet)
+		},
+		targets: map[string]*RoutedTarget{},
+	}
+	var err error
+	r.AccessLogger, err = NewAccessLogger(config)
+	if err != nil {
+		r.Logger.Error("Error creating access logger", "error", err)
+		return nil, err
+	}
+	r.HttpServer = &http.Server{
+		Addr:              fmt.Sprintf("0.0.0.0:%d", config.ListenPort),
+		Handler:           r,
+		ReadTimeout:       60 * time.Second,
+		ReadHeaderTimeout: 60 * time.Second,
+		WriteTimeout:      60 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+	return r, nil
+}
+
+func (r *Router) Start(ctx context.Context) error {
+	r.Logger.Info("Starting router", "port", r.Config.ListenPort)
+	r.mutex.Lock()
+	r.ctx = ctx
+	for _, target := range r.targets {
+		r.startTarget(target)
+	}
+	r.mutex.Unlock()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- r.HttpServer.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+		return r.Stop()
+	}
+}
+
+func (r *Router) Stop() error {
+	r.Logger.Info("Stopping router", "timeoutSecs", r.Config.ShutdownTimeoutSecs)
+	r.mutex.RLock()
+	for _, target := range r.targets {
+		target.Proxy.cancelWaiting()
+	}
+	r.mutex.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(r.Config.ShutdownTimeoutSecs)*time.Second)
+	defer cancel()
+	err := r.HttpServer.Shutdown(ctx)
+	if err != nil {
+		r.Logger.Warn("Proxied requests did not finish in time, closing remaining connections", "error", err)
+		return r.HttpServer.Close()
+	}
+	r.Logger.Info("Router stopped")
+	return nil
+}
+
+func (r *Router) startTarget(target *RoutedTarget) {
+	if r.ctx == nil {
+		return
+	}
+	var ctx context.Context
+	ctx, target.cancel = context.WithCancel(r.ctx)
+	target.Proxy.StartBackgroundTasks(ctx)
+}
+
+func (r *Router) stopTarget(target *RoutedTarget) {
+	if target.cancel != nil {
+		target.cancel()
+	}
+	target.Proxy.cancelWaiting()
+}
+
+func (r *Router) Upsert(key string, revision string, config Config, routes []Route) error {
+	r.mutex.Lock()
+	existing := r.targets[key]
+	if existing != nil && existing.Revision == revision {
+		existing.Routes = routes
+		r.mutex.Unlock()
+		return nil
+	}
+	r.mutex.Unlock()
+	config.AccessLogFormat = ""
+	proxy, err := r.NewProxy(config)
+	if err != nil {
+		r.Logger.Error("Error creating proxy for target", "key", key, "error", err)
+		return err
+	}
+	proxy.AccessLogger = r.AccessLogger
+	target := &RoutedTarget{Key: key, Revision: revision, Routes: routes, Proxy: proxy}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if previous, ok := r.targets[key]; ok {
+		r.stopTarget(previous)
+		r.Logger.Info("Updated target", "key", key, "target", config.Namespace+"/"+config.Deployment, "routes", routes)
+	} else {
+		r.Logger.Info("Added target", "key", key, "target", config.Namespace+"/"+config.Deployment, "routes", routes)
+	}
+	r.targets[key] = target
+	r.startTarget(target)
+	return nil
+}
+
+func (r *Router) Remove(key string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	target, ok := r.targets[key]
+	if !ok {
+		return false
+	}
+	r.stopTarget(target)
+	delete(r.targets, key)
+	r.Logger.Info("Removed target", "key", key)
+	return true
+}
+
+func (r *Router) Keys() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	keys := make([]string, 0, len(r.targets))
+	for key := range r.targets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (r *Router) Target(key string) *RoutedTarget {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.targets[key]
+}
+
+func (r *Router) Targets() []*RoutedTarget {
+	var targets []*RoutedTarget
+	for _, key := range r.Keys() {
+		if target := r.Target(key); target != nil {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+func (r *Router) Match(host string, path string) *RoutedTarget {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var match *RoutedTarget
+	matchSpecificity := -1
+	for _, target := range r.targets {
+		for _, route := range target.Routes {
+			if !route.MatchesHost(host) || !route.MatchesPath(path) {
+				continue
+			}
+			specificity := route.Specificity()
+			if specificity > matchSpecificity || (specificity == matchSpecificity && target.Key < match.Key) {
+				match = target
+				matchSpecificity = specificity
+			}
+		}
+	}
+	return match
+}
+
+func (r *Router) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	target := r.Match(request.Host, request.URL.Path)
+	if target == nil {
+		r.Logger.Debug("No target matches request", "host", request.Host, "path", request.URL.Path)
+		http.Error(writer, fmt.Sprintf("no target configured for host %s", request.Host), http.StatusNotFound)
+		return
+	}
+	target.Proxy.ServeHTTP(writer, request)
+}
@@ -0,0 +1,89 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"testing"
+)
+
+func TestRouteMatchesHost(t *testing.T) {
+	tests := []struct {
+		route Route
+		host  string
+		want  bool
+	}{
+		{Route{}, "example.com", true},
+		{Route{Host: "example.com"}, "example.com", true},
+		{Route{Host: "example.com"}, "www.example.com", false},
+		{Route{Host: "*.example.com"}, "www.example.com", true},
+		{Route{Host: "*.example.com"}, "a.b.example.com", true},
+		{Route{Host: "*.example.com"}, "example.com", false},
+		{Route{Host: "*.example.com"}, ".example.com", false},
+		{Route{Host: "*.example.com"}, "badexample.com", false},
+	}
+	for _, test := range tests {
+		if got := test.route.MatchesHost(test.host); got != test.want {
+			t.Errorf("Route{Host: %q}.MatchesHost(%q) = %v, want %v", test.route.Host, test.host, got, test.want)
+		}
+	}
+}
+
+func TestRouteMatchesPath(t *testing.T) {
+	tests := []struct {
+		route Route
+		path  string
+		want  bool
+	}{
+		{Route{}, "/anything", true},
+		{Route{PathPrefix: "/"}, "/anything", true},
+		{Route{PathPrefix: "/api"}, "/api", true},
+		{Route{PathPrefix: "/api"}, "/api/users", true},
+		{Route{PathPrefix: "/api/"}, "/api", true},
+		{Route{PathPrefix: "/api"}, "/apis", false},
+		{Route{PathPrefix: "/api"}, "/", false},
+		{Route{PathPrefix: "/api", Exact: true}, "/api", true},
+		{Route{PathPrefix: "/api", Exact: true}, "/api/users", false},
+		{Route{PathPrefix: "/", Exact: true}, "/index.html", false},
+	}
+	for _, test := range tests {
+		if got := test.route.MatchesPath(test.path); got != test.want {
+			t.Errorf("Route{PathPrefix: %q, Exact: %v}.MatchesPath(%q) = %v, want %v", test.route.PathPrefix, test.route.Exact, test.path, got, test.want)
+		}
+	}
+}
+
+func TestRouteSpecificity(t *testing.T) {
+	tests := []struct {
+		more Route
+		less Route
+	}{
+		{Route{Host: "www.example.com"}, Route{Host: "*.example.com", PathPrefix: "/api/users"}},
+		{Route{Host: "*.example.com"}, Route{PathPrefix: "/api/users"}},
+		{Route{Host: "*.www.example.com"}, Route{Host: "*.example.com"}},
+		{Route{Host: "example.com", PathPrefix: "/api/users"}, Route{Host: "example.com", PathPrefix: "/api"}},
+		{Route{PathPrefix: "/api", Exact: true}, Route{PathPrefix: "/api"}},
+		{Route{PathPrefix: "/api/"}, Route{PathPrefix: "/"}},
+	}
+	for _, test := range tests {
+		if test.more.Specificity() <= test.less.Specificity() {
+			t.Errorf("%v (%d) is not more specific than %v (%d)", test.more, test.more.Specificity(), test.less, test.less.Specificity())
+		}
+	}
+	if (Route{PathPrefix: "/api/"}).Specificity() != (Route{PathPrefix: "/api"}).Specificity() {
+		t.Error("a trailing slash changes the specificity of a path prefix")
+	}
+}
@@ -0,0 +1,123 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newTestSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	_, err := InitTracing(Config{})
+	if err != nil {
+		t.Fatalf("initializing tracing: %v", err)
+	}
+	previous := otel.GetTracerProvider()
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+	})
+	return recorder
+}
+
+func endedSpans(recorder *tracetest.SpanRecorder) map[string]sdktrace.ReadOnlySpan {
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	return spans
+}
+
+func TestProxyTracesRequestsAndPropagatesContext(t *testing.T) {
+	recorder := newTestSpanRecorder(t)
+	var traceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		traceparent = request.Header.Get("Traceparent")
+	}))
+	defer upstream.Close()
+	targetBaseUrl, _ := url.Parse(upstream.URL)
+	config := newTestConfig()
+	config.Deployment = "web"
+	deployment := &DeploymentHandler{Config: config, Status: DeploymentStatusReady, Logger: slog.Default()}
+	p := &Proxy{Config: config, TargetBaseUrl: targetBaseUrl, Deployment: deployment, InFlight: NewInFlightTracker(), Logger: slog.Default()}
+	p.UptimeMonitorHandler = NewUptimeMonitorHandler(config, p, deployment)
+	request := httptest.NewRequest(http.MethodGet, "/reports", nil)
+	request.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	p.ServeHTTP(httptest.NewRecorder(), request)
+	spans := endedSpans(recorder)
+	requestSpan, ok := spans["kibernate.request"]
+	if !ok {
+		t.Fatalf("no request span in %v", spans)
+	}
+	if requestSpan.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || requestSpan.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("request span does not continue the incoming trace")
+	}
+	for _, name := range []string{"kibernate.admission", "kibernate.upstream"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("no %s span", name)
+		}
+		if span.Parent().SpanID() != requestSpan.SpanContext().SpanID() {
+			t.Errorf("%s span is not a child of the request span", name)
+		}
+	}
+	upstreamSpan := spans["kibernate.upstream"]
+	want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + upstreamSpan.SpanContext().SpanID().String() + "-01"
+	if traceparent != want {
+		t.Errorf("upstream got traceparent %s, want %s", traceparent, want)
+	}
+}
+
+func TestDeploymentHandlerTracesStatusPhases(t *testing.T) {
+	recorder := newTestSpanRecorder(t)
+	ctx, activationSpan := Tracer().Start(context.Background(), "kibernate.activate")
+	d := &DeploymentHandler{Status: DeploymenStatusDeactivated, Logger: slog.Default()}
+	d.SetActivationContext(ctx)
+	activationSpan.End()
+	d.SetStatus(DeploymentStatusActivating)
+	probeCtx := d.StatusPhaseContext()
+	d.SetStatus(DeploymentStatusPossiblyReady)
+	d.SetStatus(DeploymentStatusReady)
+	spans := endedSpans(recorder)
+	for _, name := range []string{"kibernate.status.activating", "kibernate.status.possiblyReady"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("no %s span", name)
+		}
+		if span.Parent().SpanID() != activationSpan.SpanContext().SpanID() {
+			t.Errorf("%s span is not a child of the activation span", name)
+		}
+	}
+	if trace.SpanContextFromContext(probeCtx).SpanID() != spans["kibernate.status.activating"].SpanContext().SpanID() {
+		t.Error("status phase context does not carry the phase span")
+	}
+	for name := range spans {
+		if strings.HasPrefix(name, "kibernate.status.ready") {
+			t.Errorf("ready status is traced as a phase")
+		}
+	}
+}
@@ -0,0 +1,171 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"text/template"
+	"time"
+)
+
+type UptimeMonitorRule struct {
+	PathMatch        *regexp.Regexp
+	PathExclude      *regexp.Regexp
+	UserAgentMatch   *regexp.Regexp
+	UserAgentExclude *regexp.Regexp
+	Statuses         []DeploymentStatus
+	ResponseCode     uint16
+	Headers          map[string]*template.Template
+	Body             *template.Template
+	RawBody          string
+}
+
+type UptimeMonitorTemplateData struct {
+	Status           DeploymentStatus
+	Namespace        string
+	Deployment       string
+	Service          string
+	LastStatusChange time.Time
+	LastActivity     time.Time
+	Host             string
+	Path             string
+}
+
+type UptimeMonitorHandler struct {
+	Config     Config
+	Proxy      *Proxy
+	Deployment *DeploymentHandler
+	Rules      []UptimeMonitorRule
+}
+
+func NewUptimeMonitorHandler(config Config, proxy *Proxy, deployment *DeploymentHandler) *UptimeMonitorHandler {
+	u := &UptimeMonitorHandler{
+		Config:     config,
+		Proxy:      proxy,
+		Deployment: deployment,
+		Rules:      config.UptimeMonitorRules,
+	}
+	if config.UptimeMonitorUserAgentMatch != nil {
+		u.Rules = append(u.Rules, UptimeMonitorRule{
+			UserAgentMatch:   config.UptimeMonitorUserAgentMatch,
+			UserAgentExclude: config.UptimeMonitorUserAgentExclude,
+			ResponseCode:     config.UptimeMonitorResponseCode,
+			RawBody:          config.UptimeMonitorResponseMessage,
+		})
+	}
+	return u
+}
+
+func (u *UptimeMonitorHandler) Handle(writer http.ResponseWriter, request *http.Request) bool {
+	status := u.Deployment.EffectiveStatus()
+	isMonitorRequest := false
+	for _, rule := range u.Rules {
+		if !rule.MatchesRequest(request) {
+			continue
+		}
+		isMonitorRequest = true
+		if !rule.MatchesStatus(status) {
+			continue
+		}
+		RequestLogger(request).Info("Uptime monitor request answered", "path", request.URL.Path, "userAgent", request.Header.Get("User-Agent"), "status", status)
+		u.Respond(writer, request, rule, status)
+		return true
+	}
+	if !isMonitorRequest {
+		return false
+	}
+	if status == DeploymentStatusReady || u.Config.DryRun {
+		RequestLogger(request).Info("Uptime monitor request proxied", "path", request.URL.Path, "userAgent", request.Header.Get("User-Agent"), "status", status)
+		u.Proxy.PatchThrough(writer, request)
+		return true
+	}
+	RequestLogger(request).Info("Uptime monitor request matches no rule for the current status, answering unavailable", "path", request.URL.Path, "userAgent", request.Header.Get("User-Agent"), "status", status)
+	http.Error(writer, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	return true
+}
+
+func (u *UptimeMonitorHandler) Respond(writer http.ResponseWriter, request *http.Request, rule UptimeMonitorRule, status DeploymentStatus) {
+	data := UptimeMonitorTemplateData{
+		Status:           status,
+		Namespace:        u.Config.Namespace,
+		Deployment:       u.Config.Deployment,
+		Service:          u.Config.Service,
+		LastStatusChange: u.Deployment.LastStatusChange,
+		LastActivity:     u.Proxy.LastActivity,
+		Host:             request.Host,
+		Path:             request.URL.Path,
+	}
+	var body bytes.Buffer
+	if rule.Body != nil {
+		err := rule.Body.Execute(&body, data)
+		if err != nil {
+			RequestLogger(request).Error("Error rendering uptime monitor response body", "error", err)
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		body.WriteString(rule.RawBody)
+	}
+	writer.Header().Set("Content-Type", "text/plain")
+	for name, headerTemplate := range rule.Headers {
+		var value bytes.Buffer
+		err := headerTemplate.Execute(&value, data)
+		if err != nil {
+			RequestLogger(request).Error("Error rendering uptime monitor response header", "header", name, "error", err)
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set(name, value.String())
+	}
+	responseCode := int(rule.ResponseCode)
+	if responseCode == 0 {
+		responseCode = http.StatusOK
+	}
+	writer.WriteHeader(responseCode)
+	_, err := writer.Write(body.Bytes())
+	if err != nil {
+		RequestLogger(request).Error("Error writing response", "error", err)
+	}
+}
+
+func (r *UptimeMonitorRule) MatchesRequest(request *http.Request) bool {
+	return matchesIncludeExclude(r.PathMatch, r.PathExclude, request.URL.Path) && matchesIncludeExclude(r.UserAgentMatch, r.UserAgentExclude, request.Header.Get("User-Agent"))
+}
+
+func (r *UptimeMonitorRule) MatchesStatus(status DeploymentStatus) bool {
+	if len(r.Statuses) == 0 {
+		return status != DeploymentStatusReady
+	}
+	for _, ruleStatus := range r.Statuses {
+		if ruleStatus == status {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesIncludeExclude(match *regexp.Regexp, exclude *regexp.Regexp, value string) bool {
+	if match != nil && !match.MatchString(value) {
+		return false
+	}
+	if exclude != nil && exclude.MatchString(value) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"text/template"
+)
+
+func TestUptimeMonitorHandler(t *testing.T) {
+	config := Config{
+		Namespace:  "apps",
+		Deployment: "web",
+		UptimeMonitorRules: []UptimeMonitorRule{
+			{
+				PathMatch: regexp.MustCompile("^/healthz$"),
+				Statuses:  []DeploymentStatus{DeploymenStatusDeactivated},
+				Headers:   map[string]*template.Template{"Content-Type": template.Must(template.New("header").Parse("application/json"))},
+				Body:      template.Must(template.New("body").Parse(`{"status":"{{.Status}}","deployment":"{{.Namespace}}/{{.Deployment}}"}`)),
+			},
+			{
+				PathMatch:    regexp.MustCompile("^/healthz$"),
+				Statuses:     []DeploymentStatus{DeploymentStatusActivating},
+				ResponseCode: http.StatusServiceUnavailable,
+				RawBody:      "waking up",
+			},
+		},
+		UptimeMonitorUserAgentMatch:  regexp.MustCompile("Pingdom"),
+		UptimeMonitorResponseCode:    http.StatusAccepted,
+		UptimeMonitorResponseMessage: "{{.Status}}",
+	}
+	tests := []struct {
+		name        string
+		status      DeploymentStatus
+		path        string
+		userAgent   string
+		handled     bool
+		code        int
+		contentType string
+		body        string
+	}{
+		{"templated rule while deactivated", DeploymenStatusDeactivated, "/healthz", "", true, http.StatusOK, "application/json", `{"status":"deactivated","deployment":"apps/web"}`},
+		{"raw rule while activating", DeploymentStatusActivating, "/healthz", "", true, http.StatusServiceUnavailable, "text/plain", "waking up"},
+		{"no rule for the status", DeploymentStatusPossiblyReady, "/healthz", "", true, http.StatusServiceUnavailable, "text/plain; charset=utf-8", "Service Unavailable\n"},
+		{"other path", DeploymenStatusDeactivated, "/login", "Mozilla/5.0", false, 0, "", ""},
+		{"legacy user agent rule keeps the message literal", DeploymentStatusActivating, "/login", "Pingdom.com_bot", true, http.StatusAccepted, "text/plain", "{{.Status}}"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u := NewUptimeMonitorHandler(config, &Proxy{}, &DeploymentHandler{Status: test.status})
+			request := httptest.NewRequest(http.MethodGet, test.path, nil)
+			request.Header.Set("User-Agent", test.userAgent)
+			recorder := httptest.NewRecorder()
+			handled := u.Handle(recorder, request)
+			if handled != test.handled {
+				t.Fatalf("Handle() = %v, want %v", handled, test.handled)
+			}
+			if !handled {
+				return
+			}
+			if recorder.Code != test.code {
+				t.Errorf("code = %d, want %d", recorder.Code, test.code)
+			}
+			if got := recorder.Header().Get("Content-Type"); got != test.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, test.contentType)
+			}
+			if got := recorder.Body.String(); got != test.body {
+				t.Errorf("body = %q, want %q", got, test.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+type Problem struct {
+	Type              string           `json:"type"`
+	Title             string           `json:"title"`
+	Status            int              `json:"status"`
+	Detail            string           `json:"detail"`
+	Instance          string           `json:"instance"`
+	DeploymentStatus  DeploymentStatus `json:"deploymentStatus"`
+	RetryAfterSeconds int              `json:"retryAfterSeconds"`
+}
+
+type WaitTypeApiHandler struct {
+	Config     Config
+	Deployment *DeploymentHandler
+}
+
+func NewWaitTypeApiHandler(config Config, deployment *DeploymentHandler) *WaitTypeApiHandler {
+	return &WaitTypeApiHandler{
+		Config:     config,
+		Deployment: deployment,
+	}
+}
+
+func (w *WaitTypeApiHandler) Handle(writer http.ResponseWriter, request *http.Request) error {
+	statusCode := int(w.Config.ApiStatusCode)
+	if statusCode == 0 {
+		statusCode = http.StatusServiceUnavailable
+	}
+	retryAfterSeconds := w.RetryAfterSeconds()
+	problem := Problem{
+		Type:              "urn:kibernate:problem:activating",
+		Title:             "Service is waking up",
+		Status:            statusCode,
+		Detail:            fmt.Sprintf("Deployment %s is %s, retry in %d seconds", w.Config.Deployment, w.Deployment.Status, retryAfterSeconds),
+		Instance:          request.URL.RequestURI(),
+		DeploymentStatus:  w.Deployment.Status,
+		RetryAfterSeconds: retryAfterSeconds,
+	}
+	body, err := json.Marshal(problem)
+	if err != nil {
+		RequestLogger(request).Error("Error marshalling problem", "error", err)
+		return err
+	}
+	writer.Header().Set("Content-Type", "application/problem+json")
+	writer.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	writer.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	writer.WriteHeader(statusCode)
+	_, err = writer.Write(body)
+	if err != nil {
+		RequestLogger(request).Error("Error writing response", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (w *WaitTypeApiHandler) RetryAfterSeconds() int {
+	return w.Deployment.RetryAfterSeconds(w.Config.ApiRetryAfterDefaultSecs)
+}
@@ -0,0 +1,74 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWaitTypeApiHandler(t *testing.T) {
+	tests := []struct {
+		name              string
+		config            Config
+		coldStarts        []time.Duration
+		activatingSince   time.Duration
+		code              int
+		retryAfter        string
+		retryAfterSeconds int
+	}{
+		{"default status and retry after", Config{ApiRetryAfterDefaultSecs: 20}, nil, 0, http.StatusServiceUnavailable, "20", 20},
+		{"configured status", Config{ApiStatusCode: http.StatusTooManyRequests, ApiRetryAfterDefaultSecs: 20}, nil, 0, http.StatusTooManyRequests, "20", 20},
+		{"accepted", Config{ApiStatusCode: http.StatusAccepted, ApiRetryAfterDefaultSecs: 20}, nil, 0, http.StatusAccepted, "20", 20},
+		{"observed cold starts", Config{ApiRetryAfterDefaultSecs: 20}, []time.Duration{30 * time.Second, 50 * time.Second}, 10 * time.Second, http.StatusServiceUnavailable, "30", 30},
+		{"overdue cold start", Config{ApiRetryAfterDefaultSecs: 20}, []time.Duration{5 * time.Second}, time.Minute, http.StatusServiceUnavailable, "1", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.Deployment = "web"
+			deployment := &DeploymentHandler{Status: DeploymentStatusActivating, coldStartDurations: test.coldStarts}
+			if test.activatingSince > 0 {
+				deployment.activationStartTime = time.Now().Add(-test.activatingSince)
+			}
+			recorder := httptest.NewRecorder()
+			err := NewWaitTypeApiHandler(test.config, deployment).Handle(recorder, httptest.NewRequest(http.MethodGet, "/api/users?page=2", nil))
+			if err != nil {
+				t.Fatalf("handling request: %v", err)
+			}
+			if recorder.Code != test.code {
+				t.Errorf("code = %d, want %d", recorder.Code, test.code)
+			}
+			if got := recorder.Header().Get("Retry-After"); got != test.retryAfter {
+				t.Errorf("Retry-After = %s, want %s", got, test.retryAfter)
+			}
+			if got := recorder.Header().Get("Content-Type"); got != "application/problem+json" {
+				t.Errorf("Content-Type = %s, want application/problem+json", got)
+			}
+			var problem Problem
+			err = json.Unmarshal(recorder.Body.Bytes(), &problem)
+			if err != nil {
+				t.Fatalf("decoding problem: %v", err)
+			}
+			if problem.Status != test.code || problem.Instance != "/api/users?page=2" || problem.DeploymentStatus != DeploymentStatusActivating || problem.RetryAfterSeconds != test.retryAfterSeconds {
+				t.Errorf("problem is %+v", problem)
+			}
+		})
+	}
+}
@@ -17,7 +17,8 @@
 package kibernate
 
 import (
-	"log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"net/http"
 )
 
@@ -36,9 +37,23 @@ func NewWaitTypeConnectHandler(config Config, proxy *Proxy, deployment *Deployme
 }
 
 func (w *WaitTypeConnectHandler) Handle(writer http.ResponseWriter, request *http.Request) error {
-	log.Printf("Handling request with wait type connect for path '%s' - waiting for deployment to become ready", request.URL.Path)
-	w.Deployment.WaitForReady()
-	log.Printf("Deployment is ready, proxying request for path '%s'", request.URL.Path)
+	RequestLogger(request).Debug("Waiting for deployment to become ready", "path", request.URL.Path, "waitType", WaitTypeConnect)
+	_, span := Tracer().Start(request.Context(), "kibernate.wait", trace.WithAttributes(
+		attribute.String("kibernate.wait_type", string(WaitTypeConnect)),
+		attribute.String("kibernate.deployment.status", string(w.Deployment.Status)),
+	))
+	ctx, cancel := w.Proxy.WaitingContext(request)
+	defer cancel()
+	ready := w.Deployment.WaitForReady(ctx)
+	span.SetAttributes(attribute.Bool("kibernate.ready", ready))
+	span.End()
+	if !ready {
+		if request.Context().Err() != nil {
+			return nil
+		}
+		return w.Proxy.HandleShutdownFallback(writer, request)
+	}
+	RequestLogger(request).Debug("Deployment is ready, proxying request", "path", request.URL.Path)
 	w.Proxy.PatchThrough(writer, request)
 	return nil
 }
@@ -17,52 +17,274 @@
 package kibernate
 
 import (
+	"bytes"
 	"context"
+	_ "embed"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+const (
+	contentTypeHtml = "text/html"
+	contentTypeJson = "application/json"
+	contentTypeText = "text/plain"
+)
+
+//go:embed assets/loading.html
+var defaultLoadingHtml string
+
+var cliUserAgentRegexp = regexp.MustCompile(`(?i)^(curl|wget|httpie|xh)/`)
+
+type LoadingTemplateData struct {
+	Status                   DeploymentStatus `json:"status"`
+	Namespace                string           `json:"namespace"`
+	Deployment               string           `json:"deployment"`
+	Service                  string           `json:"service"`
+	RequestedUrl             string           `json:"requestedUrl"`
+	Language                 string           `json:"language,omitempty"`
+	ElapsedWaitSeconds       int              `json:"elapsedWaitSeconds"`
+	ExpectedRemainingSeconds int              `json:"expectedRemainingSeconds"`
+	ExpectedRemainingKnown   bool             `json:"expectedRemainingKnown"`
+}
+
+type LoadingPage interface {
+	Execute(writer io.Writer, data any) error
+}
+
+type RawLoadingPage string
+
+func (p RawLoadingPage) Execute(writer io.Writer, data any) error {
+	_, err := io.WriteString(writer, string(p))
+	return err
+}
+
 type WaitTypeLoadingHandler struct {
-	Config      Config
-	LoadingHtml string
+	Config          Config
+	Deployment      *DeploymentHandler
+	DefaultTemplate LoadingPage
+	Templates       map[string]LoadingPage
+	Languages       []string
+	Logger          *slog.Logger
+}
+
+func NewWaitTypeLoadingHandler(config Config, deployment *DeploymentHandler) (*WaitTypeLoadingHandler, error) {
+	w := &WaitTypeLoadingHandler{
+		Config:     config,
+		Deployment: deployment,
+		Templates:  map[string]LoadingPage{},
+		Logger:     TargetLogger(config),
+	}
+	sources, isTemplate, err := w.LoadSources()
+	if err != nil {
+		w.Logger.Error("Error loading loading page", "error", err)
+		return nil, err
+	}
+	err = w.ParseTemplates(sources, isTemplate)
+	if err != nil {
+		w.Logger.Error("Error parsing loading templates", "error", err)
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *WaitTypeLoadingHandler) LoadSources() (map[string]string, bool, error) {
+	if w.Config.LoadingInline != "" {
+		w.Logger.Info("Using inline loading page")
+		return map[string]string{"": w.Config.LoadingInline}, true, nil
+	}
+	if w.Config.LoadingFile != "" {
+		w.Logger.Info("Using loading page from file", "file", w.Config.LoadingFile, "template", w.Config.LoadingTemplates)
+		sources, err := LoadLoadingFileSources(w.Config.LoadingFile)
+		return sources, w.Config.LoadingTemplates, err
+	}
+	if w.Config.LoadingConfigMap != "" {
+		sources, err := w.LoadConfigMapSources()
+		if !apierrors.IsNotFound(err) {
+			return sources, w.Config.LoadingTemplates, err
+		}
+		w.Logger.Info("Config map not found, using embedded default loading page", "configMap", w.Config.LoadingConfigMap)
+	}
+	return map[string]string{"": defaultLoadingHtml}, true, nil
 }
 
-func NewWaitTypeLoadingHandler(config Config) (*WaitTypeLoadingHandler, error) {
-	clientConfig, err := rest.InClusterConfig()
+func (w *WaitTypeLoadingHandler) LoadConfigMapSources() (map[string]string, error) {
+	configMap, err := w.Deployment.KubeClientSet.CoreV1().ConfigMaps(w.Config.Namespace).Get(context.TODO(), w.Config.LoadingConfigMap, metav1.GetOptions{})
 	if err != nil {
-		log.Printf("Error creating in-cluster config: %s", err.Error())
 		return nil, err
 	}
-	clientSet, err := kubernetes.NewForConfig(clientConfig)
+	key := w.Config.LoadingConfigMapKey
+	if key == "" {
+		key = "loading.html"
+	}
+	if _, ok := configMap.Data[key]; !ok {
+		return nil, fmt.Errorf("%s not found in %s config map", key, w.Config.LoadingConfigMap)
+	}
+	w.Logger.Info("Using loading page from config map", "configMap", w.Config.LoadingConfigMap, "key", key)
+	sources := map[string]string{}
+	languageKeyRegexp := languageVariantRegexp(key)
+	for dataKey, value := range configMap.Data {
+		if dataKey == key {
+			sources[""] = value
+		} else if match := languageKeyRegexp.FindStringSubmatch(dataKey); match != nil {
+			sources[strings.ToLower(match[1])] = value
+		}
+	}
+	return sources, nil
+}
+
+func LoadLoadingFileSources(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
 	if err != nil {
-		log.Printf("Error creating client set: %s", err.Error())
 		return nil, err
 	}
-	loadingHtmlConfigMap, err := clientSet.CoreV1().ConfigMaps(config.Namespace).Get(context.TODO(), "kibernate-loading-html", metav1.GetOptions{})
+	sources := map[string]string{"": string(content)}
+	dirEntries, err := os.ReadDir(filepath.Dir(path))
 	if err != nil {
-		log.Printf("Error getting kibernate-loading-html config map: %s", err.Error())
 		return nil, err
 	}
-	loadingHtml, ok := loadingHtmlConfigMap.Data["loading.html"]
-	if !ok {
-		log.Println("loading.html not found in kibernate-loading-html config map")
-		return nil, errors.New("loading.html not found in kibernate-loading-html config map")
+	languageFileRegexp := languageVariantRegexp(filepath.Base(path))
+	for _, dirEntry := range dirEntries {
+		match := languageFileRegexp.FindStringSubmatch(dirEntry.Name())
+		if dirEntry.IsDir() || match == nil {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(filepath.Dir(path), dirEntry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		sources[strings.ToLower(match[1])] = string(content)
 	}
-	return &WaitTypeLoadingHandler{
-		Config:      config,
-		LoadingHtml: loadingHtml,
-	}, nil
+	return sources, nil
+}
+
+func languageVariantRegexp(name string) *regexp.Regexp {
+	extension := filepath.Ext(name)
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(strings.TrimSuffix(name, extension)) + `\.([A-Za-z]{2,3}(-[A-Za-z0-9]+)*)` + regexp.QuoteMeta(extension) + `$`)
+}
+
+func (w *WaitTypeLoadingHandler) ParseTemplates(sources map[string]string, isTemplate bool) error {
+	for language, source := range sources {
+		name := "loading"
+		if language != "" {
+			name += "." + language
+		}
+		var parsedTemplate LoadingPage = RawLoadingPage(source)
+		if isTemplate {
+			var err error
+			parsedTemplate, err = template.New(name).Parse(source)
+			if err != nil {
+				return fmt.Errorf("invalid template %s: %s", name, err.Error())
+			}
+		}
+		if language == "" {
+			w.DefaultTemplate = parsedTemplate
+			continue
+		}
+		w.Templates[language] = parsedTemplate
+		w.Languages = append(w.Languages, language)
+	}
+	if w.DefaultTemplate == nil {
+		return errors.New("no default loading template")
+	}
+	sort.Strings(w.Languages)
+	return nil
 }
 
 func (w *WaitTypeLoadingHandler) Handle(writer http.ResponseWriter, request *http.Request) error {
-	writer.Header().Set("Content-Type", "text/html")
+	data := w.TemplateData(request)
+	var body bytes.Buffer
+	statusCode := http.StatusServiceUnavailable
+	contentType := w.NegotiateContentType(request)
+	switch contentType {
+	case contentTypeJson:
+		err := json.NewEncoder(&body).Encode(data)
+		if err != nil {
+			RequestLogger(request).Error("Error encoding loading response", "error", err)
+			return err
+		}
+	case contentTypeText:
+		body.WriteString(w.PlainText(data))
+	default:
+		statusCode = http.StatusOK
+		loadingTemplate := w.DefaultTemplate
+		data.Language = NegotiateLanguage(request.Header.Get("Accept-Language"), w.Languages)
+		if data.Language != "" {
+			loadingTemplate = w.Templates[data.Language]
+			writer.Header().Set("Content-Language", data.Language)
+		}
+		err := loadingTemplate.Execute(&body, data)
+		if err != nil {
+			RequestLogger(request).Error("Error rendering loading template", "error", err)
+			return err
+		}
+	}
+	writer.Header().Set("Content-Type", contentType+"; charset=utf-8")
 	writer.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	writer.Header().Set("Pragma", "no-cache")
 	writer.Header().Set("Expires", "0")
-	_, err := writer.Write([]byte(w.LoadingHtml))
+	writer.Header().Set("Vary", "Accept, Accept-Language")
+	if statusCode != http.StatusOK {
+		writer.Header().Set("Retry-After", strconv.Itoa(w.Deployment.RetryAfterSeconds(w.Config.ApiRetryAfterDefaultSecs)))
+	}
+	writer.WriteHeader(statusCode)
+	_, err := writer.Write(body.Bytes())
 	return err
 }
+
+func (w *WaitTypeLoadingHandler) NegotiateContentType(request *http.Request) string {
+	accept := strings.TrimSpace(request.Header.Get("Accept"))
+	if accept == "" || accept == "*/*" {
+		if request.Header.Get("X-Requested-With") == "XMLHttpRequest" || request.Header.Get("Sec-Fetch-Dest") == "empty" {
+			return contentTypeJson
+		}
+		if cliUserAgentRegexp.MatchString(request.Header.Get("User-Agent")) {
+			return contentTypeText
+		}
+		return contentTypeHtml
+	}
+	contentType := NegotiateContentType(accept, []string{contentTypeHtml, contentTypeJson, contentTypeText})
+	if contentType == "" {
+		return contentTypeHtml
+	}
+	return contentType
+}
+
+func (w *WaitTypeLoadingHandler) TemplateData(request *http.Request) LoadingTemplateData {
+	data := LoadingTemplateData{
+		Status:             w.Deployment.Status,
+		Namespace:          w.Config.Namespace,
+		Deployment:         w.Config.Deployment,
+		Service:            w.Config.Service,
+		RequestedUrl:       OriginalUrl(request, w.Config.TrustedProxyCidrs),
+		ElapsedWaitSeconds: int(w.Deployment.ActivatingSince() / time.Second),
+	}
+	remaining, ok := w.Deployment.ExpectedRemainingColdStart()
+	if ok {
+		data.ExpectedRemainingSeconds = int(math.Ceil(remaining.Seconds()))
+		data.ExpectedRemainingKnown = true
+	}
+	return data
+}
+
+func (w *WaitTypeLoadingHandler) PlainText(data LoadingTemplateData) string {
+	text := fmt.Sprintf("%s is %s, waiting for %d seconds", data.Service, data.Status, data.ElapsedWaitSeconds)
+	if data.ExpectedRemainingKnown {
+		text += fmt.Sprintf(", about %d seconds remaining", data.ExpectedRemainingSeconds)
+	}
+	return text + "\n"
+}
@@ -0,0 +1,177 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"encoding/json"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestLoadingHandler(t *testing.T, config Config) *WaitTypeLoadingHandler {
+	config.Namespace = "apps"
+	config.Deployment = "web"
+	config.Service = "web"
+	config.ApiRetryAfterDefaultSecs = 30
+	w, err := NewWaitTypeLoadingHandler(config, &DeploymentHandler{Status: DeploymentStatusActivating})
+	if err != nil {
+		t.Fatalf("creating loading handler: %v", err)
+	}
+	return w
+}
+
+func TestWaitTypeLoadingHandlerNegotiatesResponses(t *testing.T) {
+	w := newTestLoadingHandler(t, Config{LoadingInline: `<p>{{.Service}} is {{.Status}}, back to {{.RequestedUrl}}</p>`})
+	tests := []struct {
+		name        string
+		headers     map[string]string
+		code        int
+		contentType string
+		retryAfter  string
+		body        string
+	}{
+		{"browser", map[string]string{"Accept": "text/html,*/*;q=0.8"}, http.StatusOK, "text/html; charset=utf-8", "", "<p>web is activating, back to http://app.example.com/reports?year=2023</p>"},
+		{"curl", map[string]string{"User-Agent": "curl/8.0.1"}, http.StatusServiceUnavailable, "text/plain; charset=utf-8", "30", "web is activating, waiting for 0 seconds\n"},
+		{"fetch", map[string]string{"Accept": "*/*", "Sec-Fetch-Dest": "empty"}, http.StatusServiceUnavailable, "application/json; charset=utf-8", "30", ""},
+		{"API client", map[string]string{"Accept": "application/json"}, http.StatusServiceUnavailable, "application/json; charset=utf-8", "30", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "http://app.example.com/reports?year=2023", nil)
+			for name, value := range test.headers {
+				request.Header.Set(name, value)
+			}
+			recorder := httptest.NewRecorder()
+			err := w.Handle(recorder, request)
+			if err != nil {
+				t.Fatalf("handling request: %v", err)
+			}
+			if recorder.Code != test.code {
+				t.Errorf("code = %d, want %d", recorder.Code, test.code)
+			}
+			if got := recorder.Header().Get("Content-Type"); got != test.contentType {
+				t.Errorf("Content-Type = %s, want %s", got, test.contentType)
+			}
+			if got := recorder.Header().Get("Retry-After"); got != test.retryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, test.retryAfter)
+			}
+			if test.contentType == "application/json; charset=utf-8" {
+				var data LoadingTemplateData
+				err = json.Unmarshal(recorder.Body.Bytes(), &data)
+				if err != nil {
+					t.Fatalf("decoding loading response: %v", err)
+				}
+				if data.Status != DeploymentStatusActivating || data.Service != "web" || data.RequestedUrl != "http://app.example.com/reports?year=2023" {
+					t.Errorf("loading response is %+v", data)
+				}
+			} else if got := recorder.Body.String(); got != test.body {
+				t.Errorf("body = %q, want %q", got, test.body)
+			}
+		})
+	}
+}
+
+func TestWaitTypeLoadingHandlerLoadsSources(t *testing.T) {
+	directory := t.TempDir()
+	for name, content := range map[string]string{"loading.html": "file", "loading.de.html": "file de", "other.fr.html": "other"} {
+		err := os.WriteFile(filepath.Join(directory, name), []byte(content), 0o600)
+		if err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "loading"},
+		Data:       map[string]string{"page.html": "config map", "page.en-GB.html": "config map en-GB", "other": "other"},
+	}
+	tests := []struct {
+		name       string
+		config     Config
+		sources    map[string]string
+		isTemplate bool
+		err        bool
+	}{
+		{"embedded default", Config{}, map[string]string{"": defaultLoadingHtml}, true, false},
+		{"inline", Config{LoadingInline: "inline", LoadingFile: filepath.Join(directory, "loading.html")}, map[string]string{"": "inline"}, true, false},
+		{"file", Config{LoadingFile: filepath.Join(directory, "loading.html")}, map[string]string{"": "file", "de": "file de"}, false, false},
+		{"file template", Config{LoadingFile: filepath.Join(directory, "loading.html"), LoadingTemplates: true}, map[string]string{"": "file", "de": "file de"}, true, false},
+		{"missing file", Config{LoadingFile: filepath.Join(directory, "missing.html")}, nil, false, true},
+		{"config map", Config{LoadingConfigMap: "loading", LoadingConfigMapKey: "page.html"}, map[string]string{"": "config map", "en-gb": "config map en-GB"}, false, false},
+		{"missing config map key", Config{LoadingConfigMap: "loading"}, nil, false, true},
+		{"missing config map", Config{LoadingConfigMap: "kibernate-loading-html"}, map[string]string{"": defaultLoadingHtml}, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.Namespace = "apps"
+			w := &WaitTypeLoadingHandler{
+				Config:     test.config,
+				Deployment: &DeploymentHandler{KubeClientSet: kubefake.NewSimpleClientset(configMap)},
+				Logger:     TargetLogger(test.config),
+			}
+			sources, isTemplate, err := w.LoadSources()
+			if (err != nil) != test.err {
+				t.Fatalf("LoadSources() error = %v, want error %v", err, test.err)
+			}
+			if !maps.Equal(sources, test.sources) || isTemplate != test.isTemplate {
+				t.Errorf("LoadSources() = %v, %v, want %v, %v", sources, isTemplate, test.sources, test.isTemplate)
+			}
+		})
+	}
+}
+
+func TestWaitTypeLoadingHandlerServesFilesVerbatim(t *testing.T) {
+	w := newTestLoadingHandler(t, Config{LoadingInline: "unused"})
+	err := w.ParseTemplates(map[string]string{"": "<p>{{.Status}}</p>"}, false)
+	if err != nil {
+		t.Fatalf("parsing templates: %v", err)
+	}
+	recorder := httptest.NewRecorder()
+	err = w.Handle(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatalf("handling request: %v", err)
+	}
+	if got := recorder.Body.String(); got != "<p>{{.Status}}</p>" {
+		t.Errorf("body = %s, want the page verbatim", got)
+	}
+}
+
+func TestProxyLoadsLoadingPageOnlyWhenReachable(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		want   bool
+	}{
+		{"connect", Config{DefaultWaitType: WaitTypeConnect, ShutdownWaitType: WaitTypeNone}, false},
+		{"default loading", Config{DefaultWaitType: WaitTypeLoading, ShutdownWaitType: WaitTypeNone}, true},
+		{"shutdown loading", Config{DefaultWaitType: WaitTypeConnect, ShutdownWaitType: WaitTypeLoading}, true},
+		{"rule loading", Config{DefaultWaitType: WaitTypeConnect, ShutdownWaitType: WaitTypeNone, WaitTypeRules: []WaitTypeRule{{When: "true", WaitType: WaitTypeLoading}}}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &Proxy{Config: test.config}
+			if got := p.IsWaitTypeReachable(WaitTypeLoading); got != test.want {
+				t.Errorf("IsWaitTypeReachable(loading) = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
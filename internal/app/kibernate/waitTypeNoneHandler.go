@@ -17,7 +17,6 @@
 package kibernate
 
 import (
-	"log"
 	"net/http"
 )
 
@@ -35,7 +34,7 @@ func (w *WaitTypeNoneHandler) Handle(writer http.ResponseWriter, request *http.R
 	writer.WriteHeader(http.StatusServiceUnavailable)
 	_, err := writer.Write([]byte("503 - Service Unavailable"))
 	if err != nil {
-		log.Printf("Error writing response: %s", err.Error())
+		RequestLogger(request).Error("Error writing response", "error", err)
 		return err
 	}
 	return nil
@@ -0,0 +1,78 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+type WaitTypeRedirectHandler struct {
+	Config      Config
+	RedirectUrl *url.URL
+}
+
+func NewWaitTypeRedirectHandler(config Config) (*WaitTypeRedirectHandler, error) {
+	redirectUrl, err := url.Parse(config.RedirectUrl)
+	if err != nil {
+		TargetLogger(config).Error("Error parsing redirect URL", "error", err)
+		return nil, err
+	}
+	if !redirectUrl.IsAbs() {
+		return nil, errors.New("redirect URL must be absolute")
+	}
+	return &WaitTypeRedirectHandler{
+		Config:      config,
+		RedirectUrl: redirectUrl,
+	}, nil
+}
+
+func (w *WaitTypeRedirectHandler) Handle(writer http.ResponseWriter, request *http.Request) error {
+	location := *w.RedirectUrl
+	if w.Config.RedirectQueryParameter != "" {
+		query := location.Query()
+		query.Set(w.Config.RedirectQueryParameter, OriginalUrl(request, w.Config.TrustedProxyCidrs))
+		location.RawQuery = query.Encode()
+	}
+	statusCode := int(w.Config.RedirectStatusCode)
+	if statusCode == 0 {
+		statusCode = http.StatusFound
+	}
+	RequestLogger(request).Debug("Redirecting request", "path", request.URL.Path, "location", location.String())
+	writer.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	http.Redirect(writer, request, location.String(), statusCode)
+	return nil
+}
+
+func OriginalUrl(request *http.Request, trustedProxies []*net.IPNet) string {
+	scheme := "http"
+	if request.TLS != nil {
+		scheme = "https"
+	} else if forwardedProto := request.Header.Get("X-Forwarded-Proto"); (forwardedProto == "http" || forwardedProto == "https") && isFromTrustedProxy(request, trustedProxies) {
+		scheme = forwardedProto
+	}
+	originalUrl := url.URL{
+		Scheme:   scheme,
+		Host:     request.Host,
+		Path:     request.URL.Path,
+		RawPath:  request.URL.RawPath,
+		RawQuery: request.URL.RawQuery,
+	}
+	return originalUrl.String()
+}
@@ -0,0 +1,81 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWaitTypeRedirectHandler(t *testing.T) {
+	_, trustedProxies, _ := net.ParseCIDR("10.0.0.0/8")
+	tests := []struct {
+		name           string
+		config         Config
+		target         string
+		remoteAddr     string
+		forwardedProto string
+		tls            bool
+		code           int
+		location       string
+	}{
+		{"without query parameter", Config{RedirectUrl: "https://status.example.com/"}, "http://app.example.com/a?b=c", "192.0.2.1:1234", "", false, http.StatusFound, "https://status.example.com/"},
+		{"embeds the original URL", Config{RedirectUrl: "https://status.example.com/wait?lang=en", RedirectQueryParameter: "return"}, "http://app.example.com/a?b=c", "192.0.2.1:1234", "", false, http.StatusFound, "https://status.example.com/wait?lang=en&return=http%3A%2F%2Fapp.example.com%2Fa%3Fb%3Dc"},
+		{"honors the status code", Config{RedirectUrl: "https://status.example.com/", RedirectStatusCode: http.StatusTemporaryRedirect, RedirectQueryParameter: "return"}, "http://app.example.com/", "192.0.2.1:1234", "", false, http.StatusTemporaryRedirect, "https://status.example.com/?return=http%3A%2F%2Fapp.example.com%2F"},
+		{"TLS", Config{RedirectUrl: "https://status.example.com/", RedirectQueryParameter: "return"}, "http://app.example.com/", "192.0.2.1:1234", "", true, http.StatusFound, "https://status.example.com/?return=https%3A%2F%2Fapp.example.com%2F"},
+		{"forwarded proto from a trusted proxy", Config{RedirectUrl: "https://status.example.com/", RedirectQueryParameter: "return", TrustedProxyCidrs: []*net.IPNet{trustedProxies}}, "http://app.example.com/", "10.1.2.3:1234", "https", false, http.StatusFound, "https://status.example.com/?return=https%3A%2F%2Fapp.example.com%2F"},
+		{"forwarded proto from an untrusted client", Config{RedirectUrl: "https://status.example.com/", RedirectQueryParameter: "return", TrustedProxyCidrs: []*net.IPNet{trustedProxies}}, "http://app.example.com/", "192.0.2.1:1234", "https", false, http.StatusFound, "https://status.example.com/?return=http%3A%2F%2Fapp.example.com%2F"},
+		{"invalid forwarded proto", Config{RedirectUrl: "https://status.example.com/", RedirectQueryParameter: "return", TrustedProxyCidrs: []*net.IPNet{trustedProxies}}, "http://app.example.com/", "10.1.2.3:1234", "javascript", false, http.StatusFound, "https://status.example.com/?return=http%3A%2F%2Fapp.example.com%2F"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler, err := NewWaitTypeRedirectHandler(test.config)
+			if err != nil {
+				t.Fatalf("creating handler: %v", err)
+			}
+			request := httptest.NewRequest(http.MethodGet, test.target, nil)
+			request.RemoteAddr = test.remoteAddr
+			if test.forwardedProto != "" {
+				request.Header.Set("X-Forwarded-Proto", test.forwardedProto)
+			}
+			if test.tls {
+				request.TLS = &tls.ConnectionState{}
+			}
+			recorder := httptest.NewRecorder()
+			err = handler.Handle(recorder, request)
+			if err != nil {
+				t.Fatalf("handling request: %v", err)
+			}
+			if recorder.Code != test.code {
+				t.Errorf("code = %d, want %d", recorder.Code, test.code)
+			}
+			if got := recorder.Header().Get("Location"); got != test.location {
+				t.Errorf("Location = %s, want %s", got, test.location)
+			}
+		})
+	}
+}
+
+func TestWaitTypeRedirectHandlerRequiresAbsoluteUrl(t *testing.T) {
+	_, err := NewWaitTypeRedirectHandler(Config{RedirectUrl: "/status"})
+	if err == nil {
+		t.Error("relative redirect URL is accepted")
+	}
+}
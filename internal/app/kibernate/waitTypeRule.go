@@ -0,0 +1,99 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"fmt"
+	"github.com/antonmedv/expr"
+	"github.com/antonmedv/expr/vm"
+	"net/http"
+	"strconv"
+)
+
+type WaitTypeRule struct {
+	When     string
+	WaitType WaitType
+	Handler  string
+	Program  *vm.Program
+}
+
+func NewWaitTypeRule(when string, waitType WaitType) (WaitTypeRule, error) {
+	program, err := expr.Compile(when, expr.Env(WaitTypeRuleEnv(&http.Request{Header: http.Header{}})), expr.AsBool())
+	if err != nil {
+		return WaitTypeRule{}, fmt.Errorf("invalid expression '%s': %s", when, err.Error())
+	}
+	return WaitTypeRule{When: when, WaitType: waitType, Program: program}, nil
+}
+
+func NewHandlerWaitTypeRule(when string, handler string) (WaitTypeRule, error) {
+	rule, err := NewWaitTypeRule(when, WaitType(handler))
+	rule.Handler = handler
+	return rule, err
+}
+
+func NewPathWaitTypeRule(pathMatch string, pathExclude string, waitType WaitType) (WaitTypeRule, error) {
+	when := fmt.Sprintf("path matches %s", strconv.Quote(pathMatch))
+	if pathExclude != "" {
+		when += fmt.Sprintf(" && !(path matches %s)", strconv.Quote(pathExclude))
+	}
+	return NewWaitTypeRule(when, waitType)
+}
+
+func (r *WaitTypeRule) Matches(request *http.Request) (bool, error) {
+	result, err := expr.Run(r.Program, WaitTypeRuleEnv(request))
+	if err != nil {
+		return false, err
+	}
+	return result.(bool), nil
+}
+
+func WaitTypeRuleEnv(request *http.Request) map[string]interface{} {
+	headers := map[string]string{}
+	for name, values := range request.Header {
+		if len(values) > 0 {
+			headers[name] = values[0]
+		}
+	}
+	cookies := map[string]string{}
+	for _, cookie := range request.Cookies() {
+		cookies[cookie.Name] = cookie.Value
+	}
+	path := ""
+	if request.URL != nil {
+		path = request.URL.Path
+	}
+	return map[string]interface{}{
+		"path":    path,
+		"host":    request.Host,
+		"method":  request.Method,
+		"accept":  request.Header.Get("Accept"),
+		"headers": headers,
+		"cookies": cookies,
+		"header": func(name string) string {
+			return request.Header.Get(name)
+		},
+		"cookie": func(name string) string {
+			return cookies[name]
+		},
+		"query": func(name string) string {
+			if request.URL == nil {
+				return ""
+			}
+			return request.URL.Query().Get(name)
+		},
+	}
+}
@@ -0,0 +1,128 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWaitTypeRulesAreEvaluatedInOrder(t *testing.T) {
+	configFile := ConfigFile{
+		WaitTypeRules: []WaitTypeRuleSpec{
+			{When: `path startsWith "/api/" && accept contains "application/json"`, WaitType: "none"},
+			{When: `path startsWith "/api/"`, WaitType: "api"},
+			{When: `method == "GET" && cookie("session") != ""`, WaitType: "loading"},
+			{When: `host == "docs.example.com" || query("mirror") == "1"`, Handler: "mirror"},
+			{When: `header("X-Requested-With") == "XMLHttpRequest"`, WaitType: "none"},
+		},
+		WaitTypeHandlers: []WaitTypeHandlerSpec{{Name: "mirror", Upstream: "https://mirror.example.com"}},
+	}
+	config := Config{DefaultWaitType: WaitTypeConnect}
+	err := configFile.ApplyTo(&config)
+	if err != nil {
+		t.Fatalf("applying config file: %v", err)
+	}
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		headers map[string]string
+		want    WaitType
+	}{
+		{"JSON API call", http.MethodGet, "http://app.example.com/api/users", map[string]string{"Accept": "application/json"}, WaitTypeNone},
+		{"browser API call", http.MethodGet, "http://app.example.com/api/users", map[string]string{"Accept": "text/html", "Cookie": "session=1"}, WaitTypeApi},
+		{"browser with session", http.MethodGet, "http://app.example.com/", map[string]string{"Cookie": "session=1"}, WaitTypeLoading},
+		{"POST with session", http.MethodPost, "http://app.example.com/", map[string]string{"Cookie": "session=1"}, WaitTypeConnect},
+		{"handler by host", http.MethodGet, "http://docs.example.com/", nil, "mirror"},
+		{"handler by query", http.MethodGet, "http://app.example.com/?mirror=1", map[string]string{"X-Requested-With": "XMLHttpRequest"}, "mirror"},
+		{"header", http.MethodGet, "http://app.example.com/", map[string]string{"X-Requested-With": "XMLHttpRequest"}, WaitTypeNone},
+		{"default", http.MethodGet, "http://app.example.com/", nil, WaitTypeConnect},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(test.method, test.target, nil)
+			for name, value := range test.headers {
+				request.Header.Set(name, value)
+			}
+			waitType, _, ruleErrors := ExplainWaitType(config, request)
+			if len(ruleErrors) > 0 {
+				t.Fatalf("rule errors: %v", ruleErrors)
+			}
+			if waitType != test.want {
+				t.Errorf("wait type = %s, want %s", waitType, test.want)
+			}
+		})
+	}
+}
+
+func TestWaitTypeRuleSpecErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		configFile ConfigFile
+		err        string
+	}{
+		{"neither wait type nor handler", ConfigFile{WaitTypeRules: []WaitTypeRuleSpec{{When: "true"}}}, "either waitType or handler"},
+		{"wait type and handler", ConfigFile{WaitTypeRules: []WaitTypeRuleSpec{{When: "true", WaitType: "none", Handler: "mirror"}}}, "either waitType or handler"},
+		{"undefined handler", ConfigFile{WaitTypeRules: []WaitTypeRuleSpec{{When: "true", Handler: "mirror"}}}, "not defined"},
+		{"invalid expression", ConfigFile{WaitTypeRules: []WaitTypeRuleSpec{{When: "path +", WaitType: "none"}}}, "invalid expression"},
+		{"non-boolean expression", ConfigFile{WaitTypeRules: []WaitTypeRuleSpec{{When: "path", WaitType: "none"}}}, "invalid expression"},
+		{"built-in handler name", ConfigFile{WaitTypeHandlers: []WaitTypeHandlerSpec{{Name: "loading", Upstream: "https://mirror.example.com"}}}, "built-in wait type"},
+		{"relative upstream", ConfigFile{WaitTypeHandlers: []WaitTypeHandlerSpec{{Name: "mirror", Upstream: "/mirror"}}}, "absolute http or https URL"},
+		{"duplicate handler", ConfigFile{WaitTypeHandlers: []WaitTypeHandlerSpec{{Name: "mirror", Upstream: "https://a.example.com"}, {Name: "mirror", Upstream: "https://b.example.com"}}}, "more than once"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.configFile.ApplyTo(&Config{})
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("ApplyTo() = %v, want an error containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestWaitTypeUpstreamHandler(t *testing.T) {
+	var host, path, forwardedHost string
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		host, path, forwardedHost = request.Host, request.URL.RequestURI(), request.Header.Get("X-Forwarded-Host")
+		writer.WriteHeader(http.StatusTeapot)
+		_, _ = writer.Write([]byte("mirrored"))
+	}))
+	defer upstream.Close()
+	configFile := ConfigFile{WaitTypeHandlers: []WaitTypeHandlerSpec{{Name: "mirror", Upstream: upstream.URL + "/base"}}}
+	config := Config{}
+	err := configFile.ApplyTo(&config)
+	if err != nil {
+		t.Fatalf("applying config file: %v", err)
+	}
+	handler := NewWaitTypeUpstreamHandler(config, config.CustomWaitTypeHandlers[0])
+	recorder := httptest.NewRecorder()
+	err = handler.Handle(recorder, httptest.NewRequest(http.MethodGet, "http://app.example.com/docs?page=2", nil))
+	if err != nil {
+		t.Fatalf("handling request: %v", err)
+	}
+	body, _ := io.ReadAll(recorder.Body)
+	if recorder.Code != http.StatusTeapot || string(body) != "mirrored" {
+		t.Errorf("response is %d %q, want the upstream response", recorder.Code, body)
+	}
+	if host != strings.TrimPrefix(upstream.URL, "http://") || path != "/base/docs?page=2" || forwardedHost != "app.example.com" {
+		t.Errorf("upstream got host %s, path %s and forwarded host %s", host, path, forwardedHost)
+	}
+}
@@ -0,0 +1,51 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+type WaitTypeUpstreamHandler struct {
+	Config       Config
+	Name         string
+	Upstream     *url.URL
+	ReverseProxy *httputil.ReverseProxy
+}
+
+func NewWaitTypeUpstreamHandler(config Config, handler CustomWaitTypeHandler) *WaitTypeUpstreamHandler {
+	w := &WaitTypeUpstreamHandler{
+		Config:   config,
+		Name:     handler.Name,
+		Upstream: handler.Upstream,
+	}
+	w.ReverseProxy = &httputil.ReverseProxy{
+		Rewrite: func(proxyRequest *httputil.ProxyRequest) {
+			proxyRequest.SetURL(w.Upstream)
+			proxyRequest.SetXForwarded()
+		},
+	}
+	return w
+}
+
+func (w *WaitTypeUpstreamHandler) Handle(writer http.ResponseWriter, request *http.Request) error {
+	RequestLogger(request).Debug("Proxying waiting request to upstream", "handler", w.Name, "upstream", w.Upstream.String())
+	w.ReverseProxy.ServeHTTP(writer, request)
+	return nil
+}
@@ -0,0 +1,302 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type LifecycleEventType string
+
+const (
+	LifecycleEventStatusChanged       LifecycleEventType = "statusChanged"
+	LifecycleEventActivationTriggered                    = "activationTriggered"
+	LifecycleEventDeactivationDecided                    = "deactivationDecided"
+)
+
+type WebhookFormat string
+
+const (
+	WebhookFormatJson        WebhookFormat = "json"
+	WebhookFormatCloudEvents               = "cloudevents"
+	WebhookFormatSlack                     = "slack"
+)
+
+const webhookQueueSize = 100
+
+type RequestMetadata struct {
+	Method    string `json:"method"`
+	Host      string `json:"host"`
+	Path      string `json:"path"`
+	UserAgent string `json:"userAgent,omitempty"`
+	ClientIp  string `json:"clientIp,omitempty"`
+}
+
+func NewRequestMetadata(request *http.Request, trustedProxyCidrs []*net.IPNet) *RequestMetadata {
+	metadata := &RequestMetadata{
+		Method:    request.Method,
+		Host:      request.Host,
+		Path:      request.URL.Path,
+		UserAgent: request.Header.Get("User-Agent"),
+	}
+	if clientIp := ClientIp(request, trustedProxyCidrs); clientIp != nil {
+		metadata.ClientIp = clientIp.String()
+	}
+	return metadata
+}
+
+type ActivationTrigger struct {
+	Reason  string           `json:"reason"`
+	Request *RequestMetadata `json:"request,omitempty"`
+}
+
+type DeactivationTrigger struct {
+	Reason       string        `json:"reason"`
+	IdleDuration time.Duration `json:"-"`
+}
+
+type LifecycleEvent struct {
+	Type           LifecycleEventType `json:"type"`
+	Time           time.Time          `json:"time"`
+	Namespace      string             `json:"namespace"`
+	Deployment     string             `json:"deployment"`
+	Reason         string             `json:"reason,omitempty"`
+	PreviousStatus DeploymentStatus   `json:"previousStatus,omitempty"`
+	Status         DeploymentStatus   `json:"status"`
+	IdleSeconds    float64            `json:"idleSeconds"`
+	Request        *RequestMetadata   `json:"request,omitempty"`
+}
+
+func (e *LifecycleEvent) Summary() string {
+	switch e.Type {
+	case LifecycleEventActivationTriggered:
+		if e.Request != nil {
+			return fmt.Sprintf("%s/%s is waking up because of %s %s", e.Namespace, e.Deployment, e.Request.Method, e.Request.Path)
+		}
+		return fmt.Sprintf("%s/%s is waking up because of %s", e.Namespace, e.Deployment, e.Reason)
+	case LifecycleEventDeactivationDecided:
+		return fmt.Sprintf("%s/%s is going to sleep after %.0f seconds idle (%s)", e.Namespace, e.Deployment, e.IdleSeconds, e.Reason)
+	}
+	summary := fmt.Sprintf("%s/%s changed from %s to %s", e.Namespace, e.Deployment, e.PreviousStatus, e.Status)
+	if e.Request != nil {
+		summary += fmt.Sprintf(" (woken up by %s %s)", e.Request.Method, e.Request.Path)
+	}
+	return summary
+}
+
+type WebhookNotifier struct {
+	Config     Config
+	HttpClient *http.Client
+	Logger     *slog.Logger
+	mutex      sync.Mutex
+	stopped    bool
+	queues     map[string]chan LifecycleEvent
+}
+
+func NewWebhookNotifier(config Config) *WebhookNotifier {
+	timeoutSecs := config.WebhookTimeoutSecs
+	if timeoutSecs == 0 {
+		timeoutSecs = 10
+	}
+	n := &WebhookNotifier{
+		Config: config,
+		HttpClient: &http.Client{
+			Timeout: time.Duration(timeoutSecs) * time.Second,
+		},
+		Logger: TargetLogger(config),
+		queues: map[string]chan LifecycleEvent{},
+	}
+	for _, url := range config.WebhookUrls {
+		n.queues[url] = make(chan LifecycleEvent, webhookQueueSize)
+	}
+	return n
+}
+
+func (n *WebhookNotifier) Start(ctx context.Context) {
+	for url, queue := range n.queues {
+		go n.ContinuouslyDeliver(ctx, url, queue)
+	}
+}
+
+func (n *WebhookNotifier) Notify(event LifecycleEvent) {
+	if n == nil || len(n.queues) == 0 {
+		return
+	}
+	event.Time = time.Now().UTC()
+	event.Namespace = n.Config.Namespace
+	event.Deployment = n.Config.Deployment
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for url, queue := range n.queues {
+		if n.stopped {
+			n.DeadLetter(url, event, "kibernate is shutting down")
+			continue
+		}
+		select {
+		case queue <- event:
+		default:
+			n.DeadLetter(url, event, "webhook queue is full")
+		}
+	}
+}
+
+func (n *WebhookNotifier) ContinuouslyDeliver(ctx context.Context, url string, queue chan LifecycleEvent) {
+	for {
+		select {
+		case event := <-queue:
+			n.Deliver(ctx, url, event)
+		case <-ctx.Done():
+			n.mutex.Lock()
+			n.stopped = true
+			n.mutex.Unlock()
+			for {
+				select {
+				case event := <-queue:
+					n.DeadLetter(url, event, "kibernate is shutting down")
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (n *WebhookNotifier) Deliver(ctx context.Context, url string, event LifecycleEvent) {
+	body, contentType, err := n.Payload(event)
+	if err != nil {
+		n.DeadLetter(url, event, err.Error())
+		return
+	}
+	backoff := 1 * time.Second
+	for attempt := 0; attempt <= int(n.Config.WebhookMaxRetries); attempt++ {
+		if attempt > 0 {
+			sleep(ctx, backoff)
+			backoff *= 2
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		err = n.Send(ctx, url, body, contentType)
+		if err == nil {
+			return
+		}
+		n.Logger.Warn("Error delivering webhook", "event", event.Type, "url", url, "attempt", attempt+1, "error", err)
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	n.DeadLetter(url, event, err.Error())
+}
+
+func (n *WebhookNotifier) Payload(event LifecycleEvent) ([]byte, string, error) {
+	switch n.Config.WebhookFormat {
+	case WebhookFormatCloudEvents:
+		id := make([]byte, 16)
+		_, err := rand.Read(id)
+		if err != nil {
+			return nil, "", err
+		}
+		body, err := json.Marshal(map[string]interface{}{
+			"specversion":     "1.0",
+			"id":              hex.EncodeToString(id),
+			"source":          fmt.Sprintf("/kibernate/%s/%s", event.Namespace, event.Deployment),
+			"type":            "io.kibernate." + string(event.Type),
+			"time":            event.Time.Format(time.RFC3339Nano),
+			"datacontenttype": "application/json",
+			"data":            event,
+		})
+		return body, "application/cloudevents+json", err
+	case WebhookFormatSlack:
+		body, err := json.Marshal(map[string]string{"text": event.Summary()})
+		return body, "application/json", err
+	default:
+		body, err := json.Marshal(event)
+		return body, "application/json", err
+	}
+}
+
+func (n *WebhookNotifier) Send(ctx context.Context, url string, body []byte, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "kibernate")
+	if n.Config.WebhookSecret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Kibernate-Timestamp", timestamp)
+		req.Header.Set("X-Kibernate-Signature", "sha256="+SignWebhookPayload(n.Config.WebhookSecret, timestamp, body))
+	}
+	resp, err := n.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func SignWebhookPayload(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (n *WebhookNotifier) DeadLetter(url string, event LifecycleEvent, reason string) {
+	entry, err := json.Marshal(map[string]interface{}{
+		"url":    url,
+		"reason": reason,
+		"event":  event,
+	})
+	if err != nil {
+		n.Logger.Error("Error marshalling webhook dead letter", "error", err)
+		return
+	}
+	if n.Config.WebhookDeadLetterFile == "" {
+		n.Logger.Error("Webhook dead letter", "deadLetter", string(entry))
+		return
+	}
+	file, err := os.OpenFile(n.Config.WebhookDeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		n.Logger.Error("Error opening webhook dead letter file", "error", err, "deadLetter", string(entry))
+		return
+	}
+	defer file.Close()
+	_, err = file.Write(append(entry, '\n'))
+	if err != nil {
+		n.Logger.Error("Error writing webhook dead letter file", "error", err, "deadLetter", string(entry))
+	}
+}
@@ -0,0 +1,85 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSignWebhookPayload(t *testing.T) {
+	tests := []struct {
+		secret    string
+		timestamp string
+		body      string
+		want      string
+	}{
+		{"secret", "1700000000", `{"event":"activated"}`, "a62e4c83fb11286726e5ca697d6cc59b225de32fab4203970d3528007c11bcd6"},
+		{"other", "1700000000", `{"event":"activated"}`, "87f197c5e6ef18ae4e13d01f16db6736485de75f89cf454194fdfbd5aff8c54a"},
+		{"secret", "1700000001", `{"event":"activated"}`, "00a26c75531c7602609db29ff51fbf848416602f972447937e05b6e2c43eb079"},
+		{"secret", "1700000000", "", "4bc5f74d868b97888288889c5d9d65df02526f94c1592a79fdf4fe8b26e311e5"},
+	}
+	for _, test := range tests {
+		if got := SignWebhookPayload(test.secret, test.timestamp, []byte(test.body)); got != test.want {
+			t.Errorf("SignWebhookPayload(%q, %q, %q) = %s, want %s", test.secret, test.timestamp, test.body, got, test.want)
+		}
+	}
+}
+
+func TestWebhookNotifierSendSignsPayload(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+	}{
+		{"with secret", "secret"},
+		{"without secret", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var received *http.Request
+			var receivedBody []byte
+			server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				received = request
+				receivedBody, _ = io.ReadAll(request.Body)
+			}))
+			defer server.Close()
+			notifier := NewWebhookNotifier(Config{WebhookSecret: test.secret, WebhookTimeoutSecs: 5})
+			body := []byte(`{"event":"activated"}`)
+			err := notifier.Send(context.Background(), server.URL, body, "application/json")
+			if err != nil {
+				t.Fatalf("Send() error = %v", err)
+			}
+			if string(receivedBody) != string(body) {
+				t.Errorf("received body %q, want %q", receivedBody, body)
+			}
+			timestamp := received.Header.Get("X-Kibernate-Timestamp")
+			signature := received.Header.Get("X-Kibernate-Signature")
+			if test.secret == "" {
+				if timestamp != "" || signature != "" {
+					t.Errorf("unsigned webhook has timestamp %q and signature %q", timestamp, signature)
+				}
+				return
+			}
+			if want := "sha256=" + SignWebhookPayload(test.secret, timestamp, body); timestamp == "" || signature != want {
+				t.Errorf("signature = %q for timestamp %q, want %q", signature, timestamp, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+/*
+   Copyright 2023 Michael Werner
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kibernate
+
+import (
+	"context"
+	"fmt"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"log/slog"
+	"time"
+)
+
+type WorkloadKind string
+
+const (
+	WorkloadKindDeployment  WorkloadKind = "deployment"
+	WorkloadKindStatefulSet              = "statefulset"
+)
+
+type WorkloadHandler struct {
+	Namespace     string
+	Kind          WorkloadKind
+	Name          string
+	KubeClientSet kubernetes.Interface
+	Logger        *slog.Logger
+}
+
+func NewWorkloadHandler(namespace string, kind WorkloadKind, name string, clientSet kubernetes.Interface) (*WorkloadHandler, error) {
+	if kind != WorkloadKindDeployment && kind != WorkloadKindStatefulSet {
+		return nil, fmt.Errorf("unsupported workload kind '%s'", kind)
+	}
+	w := &WorkloadHandler{
+		Namespace:     namespace,
+		Kind:          kind,
+		Name:          name,
+		KubeClientSet: clientSet,
+	}
+	w.Logger = slog.Default().With("workload", namespace+"/"+w.String())
+	return w, nil
+}
+
+func (w *WorkloadHandler) String() string {
+	return fmt.Sprintf("%s/%s", w.Kind, w.Name)
+}
+
+func (w *WorkloadHandler) GetScale() (*autoscalingv1.Scale, error) {
+	if w.Kind == WorkloadKindStatefulSet {
+		return w.KubeClientSet.AppsV1().StatefulSets(w.Namespace).GetScale(context.TODO(), w.Name, metav1.GetOptions{})
+	}
+	return w.KubeClientSet.AppsV1().Deployments(w.Namespace).GetScale(context.TODO(), w.Name, metav1.GetOptions{})
+}
+
+func (w *WorkloadHandler) UpdateScale(scale *autoscalingv1.Scale) error {
+	var err error
+	if w.Kind == WorkloadKindStatefulSet {
+		_, err = w.KubeClientSet.AppsV1().StatefulSets(w.Namespace).UpdateScale(context.TODO(), w.Name, scale, metav1.UpdateOptions{})
+	} else {
+		_, err = w.KubeClientSet.AppsV1().Deployments(w.Namespace).UpdateScale(context.TODO(), w.Name, scale, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+func (w *WorkloadHandler) GetReplicas() (specReplicas int32, replicas int32, readyReplicas int32, err error) {
+	if w.Kind == WorkloadKindStatefulSet {
+		statefulSet, err := w.KubeClientSet.AppsV1().StatefulSets(w.Namespace).Get(context.TODO(), w.Name, metav1.GetOptions{})
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		return *statefulSet.Spec.Replicas, statefulSet.Status.Replicas, statefulSet.Status.ReadyReplicas, nil
+	}
+	deployment, err := w.KubeClientSet.AppsV1().Deployments(w.Namespace).Get(context.TODO(), w.Name, metav1.GetOptions{})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return *deployment.Spec.Replicas, deployment.Status.Replicas, deployment.Status.ReadyReplicas, nil
+}
+
+func (w *WorkloadHandler) IsReady() (bool, error) {
+	specReplicas, _, readyReplicas, err := w.GetReplicas()
+	if err != nil {
+		return false, err
+	}
+	return specReplicas > 0 && readyReplicas > 0, nil
+}
+
+func (w *WorkloadHandler) IsDeactivated() (bool, error) {
+	specReplicas, replicas, _, err := w.GetReplicas()
+	if err != nil {
+		return false, err
+	}
+	return specReplicas == 0 && replicas == 0, nil
+}
+
+func (w *WorkloadHandler) Activate() (bool, error) {
+	scale, err := w.GetScale()
+	if err != nil {
+		w.Logger.Error("Error getting scale", "error", err)
+		return false, err
+	}
+	if scale.Spec.Replicas < 1 {
+		scale.Spec.Replicas = 1
+		err := w.UpdateScale(scale)
+		if err != nil {
+			w.Logger.Error("Error updating scale", "error", err)
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func (w *WorkloadHandler) Deactivate() (bool, error) {
+	scale, err := w.GetScale()
+	if err != nil {
+		w.Logger.Error("Error getting scale", "error", err)
+		return false, err
+	}
+	if scale.Spec.Replicas > 0 {
+		scale.Spec.Replicas = 0
+		err := w.UpdateScale(scale)
+		if err != nil {
+			w.Logger.Error("Error updating scale", "error", err)
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func (w *WorkloadHandler) WaitFor(ctx context.Context, condition func() (bool, error), timeoutSecs uint16) bool {
+	startTime := time.Now()
+	for timeoutSecs == 0 || time.Since(startTime).Seconds() < float64(timeoutSecs) {
+		ok, err := condition()
+		if err != nil {
+			w.Logger.Error("Error checking workload", "error", err)
+		} else if ok {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(1 * time.Second):
+		}
+	}
+	return false
+}